@@ -9,7 +9,9 @@ import (
 	"github.com/aryanA101a/villi/bitfield"
 	"github.com/aryanA101a/villi/handshake"
 	"github.com/aryanA101a/villi/message"
+	"github.com/aryanA101a/villi/mse"
 	"github.com/aryanA101a/villi/peers"
+	"github.com/aryanA101a/villi/utp"
 )
 
 type Client struct {
@@ -19,6 +21,16 @@ type Client struct {
 	peer     peers.Peer
 	infoHash [20]byte
 	peerID   [20]byte
+	// extensions is set if the peer speaks the extension protocol, fast if
+	// both sides speak the fast extension
+	extensions bool
+	fast       bool
+	// encrypted is set if the connection is RC4 encrypted
+	encrypted bool
+	// handlers are the registered extensions by the id we assigned them,
+	// peerExtensions the ids the peer assigned to the ones it supports
+	handlers       map[uint8]extensionHandler
+	peerExtensions map[string]uint8
 }
 
 func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Handshake, error) {
@@ -45,49 +57,150 @@ func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Han
 	return res, nil
 }
 
-func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
-	conn.SetDeadline(time.Now().Add(5 * time.Second))
-	defer conn.SetDeadline(time.Time{})
+// Dialer connects to peers. With a uTP socket peers are dialed over uTP
+// first and over TCP if that fails.
+type Dialer struct {
+	// Encryption is the MSE policy, with mse.Preferred a peer that does not
+	// speak MSE is dialed again in plaintext
+	Encryption mse.Policy
+	// UTP is the socket uTP connections are made from, nil for TCP only
+	UTP *utp.Socket
+}
 
-	msg, err := message.Read(conn)
-	if err != nil {
-		return nil, err
+// Dial connects to a peer and completes the handshake. The peer's bitfield,
+// have all or have none (if any) arrives as a regular message, peers with no
+// pieces may well send none of them.
+func (d Dialer) Dial(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
+	if d.UTP != nil {
+		c, err := d.dialOver(peer, peerID, infoHash, true)
+		if err == nil {
+			return c, nil
+		}
 	}
-	if msg.ID != message.MsgBitfield {
-		err := fmt.Errorf("expected bitfield but got ID %d", msg.ID)
-		return nil, err
+	return d.dialOver(peer, peerID, infoHash, false)
+}
+
+// dialOver dials the peer over one transport. With mse.Preferred a peer that
+// took the connection but not the MSE handshake is dialed again the same
+// way in plaintext.
+func (d Dialer) dialOver(peer peers.Peer, peerID, infoHash [20]byte, overUTP bool) (*Client, error) {
+	c, connected, err := d.dial(peer, peerID, infoHash, d.Encryption, overUTP)
+	if err != nil && connected && d.Encryption == mse.Preferred {
+		c, _, err = d.dial(peer, peerID, infoHash, mse.Disabled, overUTP)
 	}
-	return msg.Payload, nil
+	return c, err
 }
 
-func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", peer.String(), 3*time.Second)
+// dial makes one attempt at connecting to the peer, connected tells whether
+// it got as far as the handshakes.
+func (d Dialer) dial(peer peers.Peer, peerID, infoHash [20]byte, policy mse.Policy, overUTP bool) (c *Client, connected bool, err error) {
+	var conn net.Conn
+	if overUTP {
+		conn, err = d.UTP.DialTimeout(peer.String(), 3*time.Second)
+	} else {
+		conn, err = net.DialTimeout("tcp", peer.String(), 3*time.Second)
+	}
 	if err != nil {
-
-		return nil, err
+		return nil, false, err
 	}
-	_, err = completeHandshake(conn, infoHash, peerID)
+	encrypted := false
+	if policy != mse.Disabled {
+		ec, err := mse.Initiate(conn, infoHash, policy)
+		if err != nil {
+			conn.Close()
+			return nil, true, err
+		}
+		conn = ec
+		encrypted = ec.Encrypted()
+	}
+	res, err := completeHandshake(conn, infoHash, peerID)
 	if err != nil {
 		conn.Close()
+		return nil, true, err
+	}
+
+	return &Client{
+		Conn:       conn,
+		encrypted:  encrypted,
+		Choked:     true,
+		peer:       peer,
+		infoHash:   infoHash,
+		peerID:     peerID,
+		extensions: res.SupportsExtensions(),
+		fast:       res.SupportsFast(),
+	}, true, nil
+}
+
+// Accept completes the handshake of an inbound connection. The peer speaks
+// first; lookup tells whether we serve the info hash it asked for and with
+// which peer id to answer. The returned client has an empty bitfield, the
+// peer's bitfield (if any) arrives as a regular message.
+func Accept(conn net.Conn, lookup func(infoHash [20]byte) (peerID [20]byte, ok bool)) (*Client, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{})
+
+	req, err := handshake.Read(conn)
+	if err != nil {
 		return nil, err
 	}
+	peerID, ok := lookup(req.InfoHash)
+	if !ok {
+		return nil, fmt.Errorf("unknown infohash %x", req.InfoHash)
+	}
 
-	bf, err := recvBitfield(conn)
+	res := handshake.New(req.InfoHash, peerID)
+	_, err = conn.Write(res.Serialize())
 	if err != nil {
-		conn.Close()
 		return nil, err
 	}
 
+	peer, err := peers.FromAddr(conn.RemoteAddr())
+	if err != nil {
+		return nil, err
+	}
+	encrypted := false
+	if ec, ok := conn.(*mse.Conn); ok {
+		encrypted = ec.Encrypted()
+	}
 	return &Client{
-		Conn:     conn,
-		Choked:   true,
-		Bitfield: bf,
-		peer:     peer,
-		infoHash: infoHash,
-		peerID:   peerID,
+		Conn:       conn,
+		encrypted:  encrypted,
+		Choked:     true,
+		peer:       peer,
+		infoHash:   req.InfoHash,
+		peerID:     peerID,
+		extensions: req.SupportsExtensions(),
+		fast:       req.SupportsFast(),
 	}, nil
 }
 
+func (c *Client) Peer() peers.Peer {
+	return c.peer
+}
+
+// SupportsExtensions reports whether the peer set the extension protocol bit
+// in its handshake.
+func (c *Client) SupportsExtensions() bool {
+	return c.extensions
+}
+
+// Encrypted reports whether the connection is encrypted with MSE.
+func (c *Client) Encrypted() bool {
+	return c.encrypted
+}
+
+// OverUTP reports whether the connection runs over uTP rather than TCP.
+func (c *Client) OverUTP() bool {
+	_, ok := c.Conn.RemoteAddr().(*net.UDPAddr)
+	return ok
+}
+
+// SupportsFast reports whether the fast extension (BEP 6) is in use on the
+// connection.
+func (c *Client) SupportsFast() bool {
+	return c.fast
+}
+
 func (c *Client) Read() (*message.Message, error) {
 	msg, err := message.Read(c.Conn)
 	return msg, err
@@ -99,6 +212,18 @@ func (c *Client) SendRequest(index, begin, length int) error {
 	return err
 }
 
+func (c *Client) SendCancel(index, begin, length int) error {
+	msg := message.FormatCancel(index, begin, length)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+func (c *Client) SendReject(index, begin, length int) error {
+	msg := message.FormatReject(index, begin, length)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
 func (c *Client) SendInterested() error {
 	msg := message.Message{ID: message.MsgInterested}
 	_, err := c.Conn.Write(msg.Serialize())
@@ -111,6 +236,11 @@ func (c *Client) SendNotInterested() error {
 	return err
 }
 
+func (c *Client) SendChoke() error {
+	msg := message.Message{ID: message.MsgChoke}
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
 
 func (c *Client) SendUnchoke() error {
 	msg := message.Message{ID: message.MsgUnchoke}
@@ -123,3 +253,45 @@ func (c *Client) SendHave(index int) error {
 	_, err := c.Conn.Write(msg.Serialize())
 	return err
 }
+
+func (c *Client) SendBitfield(bf bitfield.Bitfield) error {
+	msg := message.Message{ID: message.MsgBitfield, Payload: bf}
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+func (c *Client) SendHaveAll() error {
+	msg := message.Message{ID: message.MsgHaveAll}
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+func (c *Client) SendHaveNone() error {
+	msg := message.Message{ID: message.MsgHaveNone}
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+func (c *Client) SendAllowedFast(index int) error {
+	msg := message.FormatAllowedFast(index)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+func (c *Client) SendPiece(index, begin int, block []byte) error {
+	msg := message.FormatPiece(index, begin, block)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+func (c *Client) SendExtended(id uint8, payload []byte) error {
+	msg := message.FormatExtended(id, payload)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+func (c *Client) SendKeepAlive() error {
+	var msg *message.Message
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
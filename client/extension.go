@@ -0,0 +1,97 @@
+package client
+
+import (
+	"fmt"
+
+	"github.com/aryanA101a/villi/extension"
+	"github.com/aryanA101a/villi/message"
+)
+
+type extensionHandler struct {
+	name   string
+	handle func(payload []byte) error
+}
+
+// RegisterExtension plugs in the handler of the named extension (BEP 10),
+// which gets the payload of every message of that extension the peer sends.
+// Extensions are announced by SendExtendedHandshake, so they have to be
+// registered before it is called. Like reading, handling messages is meant
+// for a single goroutine.
+func (c *Client) RegisterExtension(name string, handle func(payload []byte) error) {
+	if c.handlers == nil {
+		c.handlers = make(map[uint8]extensionHandler)
+	}
+	for id, h := range c.handlers {
+		if h.name == name {
+			c.handlers[id] = extensionHandler{name, handle}
+			return
+		}
+	}
+	id := uint8(len(c.handlers) + 1)
+	c.handlers[id] = extensionHandler{name, handle}
+}
+
+// SendExtendedHandshake sends hs with its m dictionary set to the registered
+// extensions. The caller fills in the other fields.
+func (c *Client) SendExtendedHandshake(hs extension.Handshake) error {
+	hs.M = make(map[string]int)
+	for id, h := range c.handlers {
+		hs.M[h.name] = int(id)
+	}
+	payload, err := hs.Serialize()
+	if err != nil {
+		return err
+	}
+	return c.SendExtended(extension.HandshakeID, payload)
+}
+
+// HandleExtended passes an extended message on to the handler registered
+// for it; messages of extensions we did not register are ignored. The
+// extended handshake is returned instead, after noting which extensions the
+// peer supports.
+func (c *Client) HandleExtended(msg *message.Message) (*extension.Handshake, error) {
+	id, payload, err := message.ParseExtended(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	if id == extension.HandshakeID {
+		hs, err := extension.ParseHandshake(payload)
+		if err != nil {
+			return nil, err
+		}
+		// a later handshake updates the earlier one, id 0 disables
+		if c.peerExtensions == nil {
+			c.peerExtensions = make(map[string]uint8)
+		}
+		for name, id := range hs.M {
+			if id <= 0 || id > 255 {
+				delete(c.peerExtensions, name)
+				continue
+			}
+			c.peerExtensions[name] = uint8(id)
+		}
+		return hs, nil
+	}
+
+	h, ok := c.handlers[id]
+	if !ok {
+		return nil, nil
+	}
+	return nil, h.handle(payload)
+}
+
+// PeerExtension returns the id the peer wants messages of the named
+// extension sent with, zero if it does not support it.
+func (c *Client) PeerExtension(name string) uint8 {
+	return c.peerExtensions[name]
+}
+
+// SendExtension sends a message of the named extension.
+func (c *Client) SendExtension(name string, payload []byte) error {
+	id := c.PeerExtension(name)
+	if id == 0 {
+		return fmt.Errorf("peer does not support %s", name)
+	}
+	return c.SendExtended(id, payload)
+}
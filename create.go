@@ -0,0 +1,139 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aryanA101a/villi/torrentfile"
+	"github.com/aryanA101a/villi/utils"
+)
+
+// listFlag collects the values of a flag given more than once.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, " ")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func runCreate(args []string) int {
+	fs := flag.NewFlagSet("create", flag.ExitOnError)
+	var trackers, webSeeds listFlag
+	var opts torrentfile.CreateOptions
+	outputFlag := fs.String("o", "", "Where to write the torrent")
+	fs.StringVar(outputFlag, "output", "", "Where to write the torrent")
+	pieceLengthFlag := fs.String("piece-length", "", "Piece length, e.g. 256k or 4m")
+	fs.Var(&trackers, "tracker", "Comma separated tracker URLs of one tier, repeat for more tiers")
+	fs.Var(&webSeeds, "web-seed", "URL the data can also be downloaded from, repeat for more")
+	fs.StringVar(&opts.Comment, "comment", "", "Comment stored in the torrent")
+	fs.StringVar(&opts.CreatedBy, "created-by", "villi", "Program recorded as the creator, empty to leave out")
+	noDateFlag := fs.Bool("no-date", false, "Leave the creation date out")
+	fs.BoolVar(&opts.Private, "private", false, "Only get peers from the trackers")
+	fs.StringVar(&opts.Source, "source", "", "Source tag, makes the info hash differ per tracker")
+	fs.Usage = func() {
+		fmt.Print(createUsageText)
+	}
+	args = parseArgs(fs, args)
+	if len(args) != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	if *pieceLengthFlag != "" {
+		pieceLength, err := parseSize(*pieceLengthFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, utils.BoldRed(err))
+			return 2
+		}
+		opts.PieceLength = pieceLength
+	}
+	for _, tier := range trackers {
+		var urls []string
+		for _, u := range strings.Split(tier, ",") {
+			if u = strings.TrimSpace(u); u != "" {
+				urls = append(urls, u)
+			}
+		}
+		opts.Announce = append(opts.Announce, urls)
+	}
+	opts.WebSeeds = webSeeds
+	if !*noDateFlag {
+		opts.CreationDate = time.Now()
+	}
+
+	tf, data, err := torrentfile.Create(args[0], opts, func(done, total int) {
+		fmt.Fprintf(os.Stderr, "\rhashing piece %d/%d", done, total)
+	})
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, utils.BoldRed(err))
+		return 1
+	}
+
+	output := *outputFlag
+	if output == "" {
+		output = tf.Name + ".torrent"
+	}
+	err = os.WriteFile(output, data, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, utils.BoldRed(err))
+		return 1
+	}
+
+	fmt.Println(utils.Bold(fmt.Sprintf("Wrote %s: %s in %d files, %d pieces of %s",
+		filepath.Clean(output), utils.ConvertToHumanReadable(tf.Length), len(tf.Files), len(tf.PieceHashes),
+		utils.ConvertToHumanReadable(uint64(tf.PieceLength)))))
+	fmt.Printf("info hash: %x\n", tf.InfoHash)
+	fmt.Printf("magnet:    %s\n", tf.Magnet())
+	return 0
+}
+
+// parseSize reads a byte count with an optional k, m or g suffix for KiB,
+// MiB or GiB.
+func parseSize(s string) (uint, error) {
+	shift := 0
+	lower := strings.TrimSuffix(strings.ToLower(s), "ib")
+	switch {
+	case strings.HasSuffix(lower, "k"):
+		shift = 10
+	case strings.HasSuffix(lower, "m"):
+		shift = 20
+	case strings.HasSuffix(lower, "g"):
+		shift = 30
+	}
+	if shift > 0 {
+		lower = lower[:len(lower)-1]
+	}
+	n, err := strconv.ParseUint(lower, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return uint(n << shift), nil
+}
+
+var createUsageText = `Usage: villi create [options] path
+
+Makes a torrent of the file or directory at path, then prints its info hash
+and a magnet link.
+
+Options:
+  -o, --output    Where to write the torrent (default name.torrent)
+  --piece-length  Piece length, a power of two of at least 16k, e.g. 256k or 4m
+                  (default picked from the size of the data)
+  --tracker       Comma separated tracker URLs of one tier, repeat for more tiers
+  --web-seed      URL the data can also be downloaded from, repeat for more
+  --comment       Comment stored in the torrent
+  --created-by    Program recorded as the creator, empty to leave out (default villi)
+  --no-date       Leave the creation date out
+  --private       Only get peers from the trackers
+  --source        Source tag, makes the info hash differ per tracker
+`
@@ -0,0 +1,371 @@
+// Package dht implements a node of the mainline DHT (BEP 5), the Kademlia
+// network BitTorrent clients use to find peers without a tracker.
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aryanA101a/villi/peers"
+	bencode "github.com/zeebo/bencode"
+)
+
+// DefaultBootstrap are well-known nodes used to join the DHT.
+var DefaultBootstrap = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// how long a node gets to answer a query
+const queryTimeout = 3 * time.Second
+
+// tokens are derived from a secret that changes this often; tokens of the
+// previous secret are still accepted
+const tokenRotation = 5 * time.Minute
+
+// peers announced to us are forgotten after this long unless they announce
+// again
+const peerExpiry = 30 * time.Minute
+
+// limits on the peers we store for other nodes
+const (
+	maxInfoHashes   = 1000
+	maxPeersPerHash = 100
+)
+
+// Node is our node in the DHT. It answers queries from other nodes for as
+// long as it is open.
+type Node struct {
+	id    [20]byte
+	conn  PacketConn
+	table *table
+
+	mu      sync.Mutex
+	pending map[string]*transaction
+	nextTx  uint16
+	// secrets[0] is the current token secret, secrets[1] the previous one
+	secrets [2][8]byte
+	// peers that announced themselves to us, by info hash
+	peers map[[20]byte]map[string]*storedPeer
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+type storedPeer struct {
+	peer      peers.Peer
+	announced time.Time
+}
+
+type transaction struct {
+	addr  string
+	reply chan *krpcMsg
+}
+
+// PacketConn is what a node sends and receives its messages over, a
+// *net.UDPConn or a socket shared with another protocol.
+type PacketConn interface {
+	ReadFrom(b []byte) (int, net.Addr, error)
+	WriteTo(b []byte, addr net.Addr) (int, error)
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// New starts a node listening on the UDP address addr, e.g. ":6881".
+func New(addr string) (*Node, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return NewConn(conn)
+}
+
+// NewConn starts a node on conn, which it closes when it is closed. Only
+// IPv4 nodes are talked to.
+func NewConn(conn PacketConn) (*Node, error) {
+	n := &Node{
+		conn:    conn,
+		pending: make(map[string]*transaction),
+		peers:   make(map[[20]byte]map[string]*storedPeer),
+		done:    make(chan struct{}),
+	}
+	_, err := rand.Read(n.id[:])
+	if err == nil {
+		_, err = rand.Read(n.secrets[0][:])
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	n.secrets[1] = n.secrets[0]
+	n.table = newTable(n.id)
+
+	go n.serve()
+	go n.rotateSecrets()
+	return n, nil
+}
+
+func (n *Node) ID() [20]byte {
+	return n.id
+}
+
+func (n *Node) Addr() *net.UDPAddr {
+	return n.conn.LocalAddr().(*net.UDPAddr)
+}
+
+// Nodes returns the number of nodes in the routing table.
+func (n *Node) Nodes() int {
+	return n.table.len()
+}
+
+func (n *Node) Close() error {
+	var err error
+	n.closeOnce.Do(func() {
+		close(n.done)
+		err = n.conn.Close()
+	})
+	return err
+}
+
+func (n *Node) serve() {
+	buf := make([]byte, 65536)
+	for {
+		size, from, err := n.conn.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-n.done:
+				return
+			default:
+				continue
+			}
+		}
+		addr, ok := from.(*net.UDPAddr)
+		if !ok || addr.IP.To4() == nil {
+			continue
+		}
+		msg, err := parseMsg(buf[:size])
+		if err != nil {
+			continue
+		}
+
+		switch msg.Y {
+		case "q":
+			n.handleQuery(msg, addr)
+		case "r", "e":
+			n.mu.Lock()
+			tx, ok := n.pending[msg.T]
+			if ok && tx.addr == addr.String() {
+				delete(n.pending, msg.T)
+			}
+			n.mu.Unlock()
+			if ok && tx.addr == addr.String() {
+				tx.reply <- msg
+			}
+		}
+	}
+}
+
+func (n *Node) rotateSecrets() {
+	ticker := time.NewTicker(tokenRotation)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			n.rotate()
+		case <-n.done:
+			return
+		}
+	}
+}
+
+// rotate replaces the token secret, keeping the current one as the
+// previous.
+func (n *Node) rotate() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.secrets[1] = n.secrets[0]
+	rand.Read(n.secrets[0][:])
+}
+
+func (n *Node) send(addr *net.UDPAddr, msg *krpcMsg) error {
+	buf, err := bencode.EncodeBytes(msg)
+	if err != nil {
+		return err
+	}
+	_, err = n.conn.WriteTo(buf, addr)
+	return err
+}
+
+// query sends a query to addr and waits for the answer. A node that answers
+// goes into the routing table.
+func (n *Node) query(addr *net.UDPAddr, q string, args *krpcArgs) (*krpcReturn, error) {
+	args.ID = string(n.id[:])
+
+	n.mu.Lock()
+	n.nextTx++
+	t := string([]byte{byte(n.nextTx >> 8), byte(n.nextTx)})
+	tx := &transaction{addr: addr.String(), reply: make(chan *krpcMsg, 1)}
+	n.pending[t] = tx
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, t)
+		n.mu.Unlock()
+	}()
+
+	err := n.send(addr, &krpcMsg{T: t, Y: "q", Q: q, A: args})
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(queryTimeout)
+	defer timer.Stop()
+	select {
+	case msg := <-tx.reply:
+		if msg.Y == "e" {
+			return nil, msg.remoteError()
+		}
+		c := &contact{addr: addr}
+		copy(c.id[:], msg.R.ID)
+		n.table.seen(c)
+		return msg.R, nil
+	case <-timer.C:
+		return nil, fmt.Errorf("%s query to %s timed out", q, addr)
+	case <-n.done:
+		return nil, fmt.Errorf("node closed")
+	}
+}
+
+func (n *Node) handleQuery(msg *krpcMsg, addr *net.UDPAddr) {
+	c := &contact{addr: addr}
+	copy(c.id[:], msg.A.ID)
+	n.table.seen(c)
+
+	r := &krpcReturn{ID: string(n.id[:])}
+	switch msg.Q {
+	case "ping":
+
+	case "find_node":
+		if len(msg.A.Target) != 20 {
+			n.replyError(addr, msg.T, errProtocol, "invalid target")
+			return
+		}
+		var target [20]byte
+		copy(target[:], msg.A.Target)
+		r.Nodes = encodeNodes(n.table.closest(target, K))
+
+	case "get_peers":
+		if len(msg.A.InfoHash) != 20 {
+			n.replyError(addr, msg.T, errProtocol, "invalid info_hash")
+			return
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], msg.A.InfoHash)
+		r.Token = n.token(addr.IP, 0)
+		r.Values = n.storedPeers(infoHash)
+		if len(r.Values) == 0 {
+			r.Nodes = encodeNodes(n.table.closest(infoHash, K))
+		}
+
+	case "announce_peer":
+		if len(msg.A.InfoHash) != 20 {
+			n.replyError(addr, msg.T, errProtocol, "invalid info_hash")
+			return
+		}
+		if !n.validToken(addr.IP, msg.A.Token) {
+			n.replyError(addr, msg.T, errProtocol, "bad token")
+			return
+		}
+		port := msg.A.Port
+		if msg.A.ImpliedPort != 0 {
+			port = addr.Port
+		}
+		if port <= 0 || port > 65535 {
+			n.replyError(addr, msg.T, errProtocol, "invalid port")
+			return
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], msg.A.InfoHash)
+		n.storePeer(infoHash, peers.Peer{IP: addr.IP, Port: uint16(port)})
+
+	default:
+		n.replyError(addr, msg.T, errMethod, "method unknown")
+		return
+	}
+	n.send(addr, &krpcMsg{T: msg.T, Y: "r", R: r})
+}
+
+func (n *Node) replyError(addr *net.UDPAddr, t string, code int, message string) {
+	n.send(addr, &krpcMsg{T: t, Y: "e", E: []interface{}{code, message}})
+}
+
+// token is what a node querying get_peers from ip has to present to announce
+// itself afterwards.
+func (n *Node) token(ip net.IP, secret int) string {
+	n.mu.Lock()
+	s := n.secrets[secret]
+	n.mu.Unlock()
+	buf := make([]byte, 0, net.IPv6len+len(s))
+	buf = append(buf, ip.To16()...)
+	h := sha1.Sum(append(buf, s[:]...))
+	return string(h[:8])
+}
+
+func (n *Node) validToken(ip net.IP, token string) bool {
+	return token == n.token(ip, 0) || token == n.token(ip, 1)
+}
+
+func (n *Node) storePeer(infoHash [20]byte, peer peers.Peer) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	stored, ok := n.peers[infoHash]
+	if !ok {
+		if len(n.peers) >= maxInfoHashes {
+			return
+		}
+		stored = make(map[string]*storedPeer)
+		n.peers[infoHash] = stored
+	}
+	if _, ok := stored[peer.String()]; !ok && len(stored) >= maxPeersPerHash {
+		return
+	}
+	stored[peer.String()] = &storedPeer{peer: peer, announced: time.Now()}
+}
+
+// storedPeers returns the peers announced for infoHash in compact form,
+// dropping the expired ones.
+func (n *Node) storedPeers(infoHash [20]byte) []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var values []string
+	for addr, sp := range n.peers[infoHash] {
+		if time.Since(sp.announced) > peerExpiry {
+			delete(n.peers[infoHash], addr)
+			continue
+		}
+		ip := sp.peer.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf := make([]byte, 6)
+		copy(buf, ip)
+		binary.BigEndian.PutUint16(buf[4:], sp.peer.Port)
+		values = append(values, string(buf))
+	}
+	if len(n.peers[infoHash]) == 0 {
+		delete(n.peers, infoHash)
+	}
+	return values
+}
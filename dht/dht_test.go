@@ -0,0 +1,91 @@
+package dht
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// newLocalNode starts a node on a free local port, closed when the test
+// ends.
+func newLocalNode(t *testing.T) *Node {
+	n, err := New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+func TestAnnounceGetPeers(t *testing.T) {
+	a := newLocalNode(t)
+	b := newLocalNode(t)
+	c := newLocalNode(t)
+
+	for _, n := range []*Node{b, c} {
+		err := n.Bootstrap([]string{a.Addr().String()})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// c joined after b, through a it learnt of both
+	if c.Nodes() != 2 {
+		t.Fatalf("c knows %d nodes, want 2", c.Nodes())
+	}
+
+	infoHash := [20]byte{0xab, 0xcd}
+	if list := c.Announce(infoHash, 7000); len(list) != 0 {
+		t.Errorf("first announce found peers %v", list)
+	}
+	list := b.GetPeers(infoHash)
+	if len(list) != 1 || list[0].String() != "127.0.0.1:7000" {
+		t.Fatalf("got peers %v, want 127.0.0.1:7000", list)
+	}
+
+	// another torrent has no peers
+	if list := b.GetPeers([20]byte{1}); len(list) != 0 {
+		t.Errorf("got peers %v of a torrent nobody announced", list)
+	}
+}
+
+func TestAnnounceBadToken(t *testing.T) {
+	a := newLocalNode(t)
+	b := newLocalNode(t)
+
+	_, err := b.query(a.Addr(), "announce_peer", &krpcArgs{
+		InfoHash: string(make([]byte, 20)),
+		Port:     7000,
+		Token:    "made up",
+	})
+	var krpcErr *krpcError
+	if !errors.As(err, &krpcErr) || krpcErr.Code != errProtocol {
+		t.Fatalf("got error %v, want a protocol error", err)
+	}
+	if list := a.storedPeers([20]byte{}); len(list) != 0 {
+		t.Errorf("stored peers %q announced with a bad token", list)
+	}
+}
+
+func TestTokenRotation(t *testing.T) {
+	n := newLocalNode(t)
+	ip := net.IPv4(192, 0, 2, 1)
+	token := n.token(ip, 0)
+
+	if !n.validToken(ip, token) {
+		t.Fatal("fresh token not valid")
+	}
+	if n.validToken(net.IPv4(192, 0, 2, 2), token) {
+		t.Error("token valid for another address")
+	}
+	n.rotate()
+	if !n.validToken(ip, token) {
+		t.Error("token of the previous secret not valid")
+	}
+	if n.token(ip, 0) == token {
+		t.Error("secret did not change")
+	}
+	n.rotate()
+	if n.validToken(ip, token) {
+		t.Error("token still valid after two rotations")
+	}
+}
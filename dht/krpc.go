@@ -0,0 +1,135 @@
+package dht
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	bencode "github.com/zeebo/bencode"
+)
+
+// KRPC error codes
+const (
+	errGeneric  = 201
+	errServer   = 202
+	errProtocol = 203
+	errMethod   = 204
+)
+
+// compactNodeSize is the length of a node in a compact node list: its id,
+// IPv4 address and port
+const compactNodeSize = 26
+
+// krpcMsg is a KRPC message: a query (y=q), a response (y=r) or an error
+// (y=e). T is the transaction id the response echoes.
+type krpcMsg struct {
+	T string        `bencode:"t"`
+	Y string        `bencode:"y"`
+	Q string        `bencode:"q,omitempty"`
+	A *krpcArgs     `bencode:"a,omitempty"`
+	R *krpcReturn   `bencode:"r,omitempty"`
+	E []interface{} `bencode:"e,omitempty"`
+}
+
+type krpcArgs struct {
+	ID          string `bencode:"id"`
+	Target      string `bencode:"target,omitempty"`
+	InfoHash    string `bencode:"info_hash,omitempty"`
+	Port        int    `bencode:"port,omitempty"`
+	ImpliedPort int    `bencode:"implied_port,omitempty"`
+	Token       string `bencode:"token,omitempty"`
+}
+
+type krpcReturn struct {
+	ID     string   `bencode:"id"`
+	Nodes  string   `bencode:"nodes,omitempty"`
+	Values []string `bencode:"values,omitempty"`
+	Token  string   `bencode:"token,omitempty"`
+}
+
+// krpcError is the error a remote node answered a query with.
+type krpcError struct {
+	Code    int
+	Message string
+}
+
+func (e *krpcError) Error() string {
+	return fmt.Sprintf("dht error %d: %s", e.Code, e.Message)
+}
+
+func parseMsg(buf []byte) (*krpcMsg, error) {
+	msg := krpcMsg{}
+	err := bencode.DecodeBytes(buf, &msg)
+	if err != nil {
+		return nil, err
+	}
+	switch msg.Y {
+	case "q":
+		if msg.A == nil || len(msg.A.ID) != 20 {
+			return nil, fmt.Errorf("query without a valid id")
+		}
+	case "r":
+		if msg.R == nil || len(msg.R.ID) != 20 {
+			return nil, fmt.Errorf("response without a valid id")
+		}
+	case "e":
+	default:
+		return nil, fmt.Errorf("unknown message type %q", msg.Y)
+	}
+	return &msg, nil
+}
+
+// remoteError turns the e list of an error message into a krpcError.
+func (msg *krpcMsg) remoteError() *krpcError {
+	e := &krpcError{Code: errGeneric}
+	if len(msg.E) > 0 {
+		if code, ok := msg.E[0].(int64); ok {
+			e.Code = int(code)
+		}
+	}
+	if len(msg.E) > 1 {
+		if s, ok := msg.E[1].(string); ok {
+			e.Message = s
+		}
+	}
+	return e
+}
+
+// contact is a node we know the id and address of.
+type contact struct {
+	id   [20]byte
+	addr *net.UDPAddr
+}
+
+func encodeNodes(contacts []*contact) string {
+	buf := make([]byte, 0, len(contacts)*compactNodeSize)
+	for _, c := range contacts {
+		ip := c.addr.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, c.id[:]...)
+		buf = append(buf, ip...)
+		buf = append(buf, byte(c.addr.Port>>8), byte(c.addr.Port))
+	}
+	return string(buf)
+}
+
+func decodeNodes(s string) ([]*contact, error) {
+	if len(s)%compactNodeSize != 0 {
+		return nil, fmt.Errorf("received malformed nodes of length %d", len(s))
+	}
+	contacts := make([]*contact, 0, len(s)/compactNodeSize)
+	for i := 0; i < len(s); i += compactNodeSize {
+		c := &contact{addr: &net.UDPAddr{
+			IP:   net.IP([]byte(s[i+20 : i+24])),
+			Port: int(binary.BigEndian.Uint16([]byte(s[i+24 : i+26]))),
+		}}
+		copy(c.id[:], s[i:i+20])
+		if c.addr.Port == 0 {
+			continue
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts, nil
+}
@@ -0,0 +1,133 @@
+package dht
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	bencode "github.com/zeebo/bencode"
+)
+
+func TestNodesRoundTrip(t *testing.T) {
+	contacts := []*contact{
+		{id: [20]byte{1}, addr: &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 6881}},
+		{id: [20]byte{2}, addr: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 6882}},
+		{id: [20]byte{3}, addr: &net.UDPAddr{IP: net.IPv4(198, 51, 100, 7).To4(), Port: 65535}},
+	}
+	s := encodeNodes(contacts)
+	// the IPv6 node has no place in a compact node list
+	if len(s) != 2*compactNodeSize {
+		t.Fatalf("encoded %d bytes, want %d", len(s), 2*compactNodeSize)
+	}
+
+	got, err := decodeNodes(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []*contact{contacts[0], contacts[2]}
+	if len(got) != len(want) {
+		t.Fatalf("decoded %d nodes, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].id != want[i].id || !got[i].addr.IP.Equal(want[i].addr.IP) || got[i].addr.Port != want[i].addr.Port {
+			t.Errorf("node %d: got %x at %v, want %x at %v", i, got[i].id, got[i].addr, want[i].id, want[i].addr)
+		}
+	}
+}
+
+func TestDecodeNodes(t *testing.T) {
+	tests := []struct {
+		name    string
+		s       string
+		nodes   int
+		wantErr bool
+	}{
+		{"empty", "", 0, false},
+		{"truncated", strings.Repeat("x", compactNodeSize-1), 0, true},
+		{"port 0 dropped", strings.Repeat("\x00", compactNodeSize), 0, false},
+		{"two", strings.Repeat("\x01", 2*compactNodeSize), 2, false},
+	}
+	for _, tt := range tests {
+		got, err := decodeNodes(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v", tt.name, err)
+			continue
+		}
+		if len(got) != tt.nodes {
+			t.Errorf("%s: got %d nodes, want %d", tt.name, len(got), tt.nodes)
+		}
+	}
+}
+
+func TestParseMsg(t *testing.T) {
+	id := strings.Repeat("a", 20)
+	tests := []struct {
+		name    string
+		msg     interface{}
+		wantErr bool
+	}{
+		{"query", krpcMsg{T: "aa", Y: "q", Q: "ping", A: &krpcArgs{ID: id}}, false},
+		{"query without id", krpcMsg{T: "aa", Y: "q", Q: "ping", A: &krpcArgs{ID: "short"}}, true},
+		{"query without args", krpcMsg{T: "aa", Y: "q", Q: "ping"}, true},
+		{"response", krpcMsg{T: "aa", Y: "r", R: &krpcReturn{ID: id}}, false},
+		{"response without id", krpcMsg{T: "aa", Y: "r", R: &krpcReturn{}}, true},
+		{"error", krpcMsg{T: "aa", Y: "e", E: []interface{}{201, "oops"}}, false},
+		{"unknown type", krpcMsg{T: "aa", Y: "x"}, true},
+	}
+	for _, tt := range tests {
+		buf, err := bencode.EncodeBytes(tt.msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = parseMsg(buf)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+	if _, err := parseMsg([]byte("not bencode")); err == nil {
+		t.Error("parsed garbage")
+	}
+}
+
+func TestMsgEncoding(t *testing.T) {
+	// the get_peers query of BEP 5
+	msg := krpcMsg{T: "aa", Y: "q", Q: "get_peers", A: &krpcArgs{
+		ID:       "abcdefghij0123456789",
+		InfoHash: "mnopqrstuvwxyz123456",
+	}}
+	buf, err := bencode.EncodeBytes(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "d1:ad2:id20:abcdefghij01234567899:info_hash20:mnopqrstuvwxyz123456e1:q9:get_peers1:t2:aa1:y1:qe"
+	if string(buf) != want {
+		t.Errorf("got %s, want %s", buf, want)
+	}
+
+	got, err := parseMsg(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*got, msg) {
+		t.Errorf("got %+v back, want %+v", *got, msg)
+	}
+}
+
+func TestRemoteError(t *testing.T) {
+	buf := []byte("d1:eli203e14:invalid targete1:t2:aa1:y1:ee")
+	msg, err := parseMsg(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := msg.remoteError()
+	if e.Code != errProtocol || e.Message != "invalid target" {
+		t.Errorf("got %+v", e)
+	}
+
+	// a malformed list still gives an error
+	e = (&krpcMsg{Y: "e"}).remoteError()
+	if e.Code != errGeneric {
+		t.Errorf("got code %d for an empty list, want %d", e.Code, errGeneric)
+	}
+}
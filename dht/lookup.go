@@ -0,0 +1,183 @@
+package dht
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/aryanA101a/villi/peers"
+)
+
+// number of queries a lookup keeps in flight
+const alpha = 3
+
+// responder is a node that answered during a lookup, with the token it
+// handed out for announcing.
+type responder struct {
+	*contact
+	token string
+}
+
+type lookupResult struct {
+	peers []peers.Peer
+	// closest are the K nodes closest to the target that answered
+	closest []responder
+}
+
+type queryReply struct {
+	c   *contact
+	r   *krpcReturn
+	err error
+}
+
+// lookup walks towards target by querying, alpha at a time, the closest
+// nodes it knows of, until the K closest have all answered or failed. With
+// get_peers it also collects the peers handed out on the way.
+func (n *Node) lookup(target [20]byte, q string) *lookupResult {
+	shortlist := n.table.closest(target, K)
+	known := make(map[string]bool)
+	for _, c := range shortlist {
+		known[c.addr.String()] = true
+	}
+	queried := make(map[*contact]bool)
+	tokens := make(map[*contact]string)
+	found := make(map[string]peers.Peer)
+
+	replies := make(chan queryReply)
+	inflight := 0
+	for {
+		sortByDistance(shortlist, target)
+		for i := 0; i < len(shortlist) && i < K && inflight < alpha; i++ {
+			c := shortlist[i]
+			if queried[c] {
+				continue
+			}
+			queried[c] = true
+			inflight++
+			go func(c *contact) {
+				args := &krpcArgs{}
+				if q == "get_peers" {
+					args.InfoHash = string(target[:])
+				} else {
+					args.Target = string(target[:])
+				}
+				r, err := n.query(c.addr, q, args)
+				replies <- queryReply{c, r, err}
+			}(c)
+		}
+		if inflight == 0 {
+			break
+		}
+
+		reply := <-replies
+		inflight--
+		if reply.err != nil {
+			n.table.failed(reply.c.id)
+			for i, c := range shortlist {
+				if c == reply.c {
+					shortlist = append(shortlist[:i], shortlist[i+1:]...)
+					break
+				}
+			}
+			continue
+		}
+
+		tokens[reply.c] = reply.r.Token
+		for _, v := range reply.r.Values {
+			if len(v) != 6 {
+				continue
+			}
+			list, err := peers.Unmarshal([]byte(v))
+			if err != nil {
+				continue
+			}
+			for _, peer := range list {
+				found[peer.String()] = peer
+			}
+		}
+		nodes, err := decodeNodes(reply.r.Nodes)
+		if err != nil {
+			continue
+		}
+		for _, c := range nodes {
+			if c.id == n.id || known[c.addr.String()] {
+				continue
+			}
+			known[c.addr.String()] = true
+			shortlist = append(shortlist, c)
+		}
+	}
+
+	result := &lookupResult{}
+	for _, peer := range found {
+		result.peers = append(result.peers, peer)
+	}
+	for _, c := range shortlist {
+		token, ok := tokens[c]
+		if !ok {
+			continue
+		}
+		result.closest = append(result.closest, responder{c, token})
+		if len(result.closest) == K {
+			break
+		}
+	}
+	return result
+}
+
+// Bootstrap joins the DHT through the given host:port addresses, e.g.
+// DefaultBootstrap or the nodes listed in a torrent, and fills the routing
+// table with the nodes around our own id.
+func (n *Node) Bootstrap(addrs []string) error {
+	replies := make(chan error, len(addrs))
+	for _, addr := range addrs {
+		go func(addr string) {
+			udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+			if err != nil {
+				replies <- err
+				return
+			}
+			_, err = n.query(udpAddr, "find_node", &krpcArgs{Target: string(n.id[:])})
+			replies <- err
+		}(addr)
+	}
+	for range addrs {
+		<-replies
+	}
+
+	n.lookup(n.id, "find_node")
+	if n.table.len() == 0 {
+		return fmt.Errorf("no DHT node answered")
+	}
+	return nil
+}
+
+// GetPeers looks up the peers of a torrent.
+func (n *Node) GetPeers(infoHash [20]byte) []peers.Peer {
+	return n.lookup(infoHash, "get_peers").peers
+}
+
+// Announce looks up the peers of a torrent and tells the nodes closest to
+// its info hash that we accept connections for it on port.
+func (n *Node) Announce(infoHash [20]byte, port uint16) []peers.Peer {
+	result := n.lookup(infoHash, "get_peers")
+
+	done := make(chan struct{}, len(result.closest))
+	for _, r := range result.closest {
+		if r.token == "" {
+			done <- struct{}{}
+			continue
+		}
+		go func(r responder) {
+			n.query(r.addr, "announce_peer", &krpcArgs{
+				InfoHash: string(infoHash[:]),
+				Port:     int(port),
+				Token:    r.token,
+			})
+			done <- struct{}{}
+		}(r)
+	}
+	for range result.closest {
+		<-done
+	}
+	return result.peers
+}
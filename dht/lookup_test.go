@@ -0,0 +1,98 @@
+package dht
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	bencode "github.com/zeebo/bencode"
+)
+
+// slowNodes answer every query after a delay, counting how many they are
+// answering at once.
+type slowNodes struct {
+	mu          sync.Mutex
+	inflight    int
+	maxInflight int
+	queried     map[[20]byte]bool
+}
+
+func (s *slowNodes) serve(t *testing.T, id [20]byte, delay time.Duration) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			size, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			msg, err := parseMsg(buf[:size])
+			if err != nil || msg.Y != "q" {
+				continue
+			}
+
+			s.mu.Lock()
+			s.inflight++
+			if s.inflight > s.maxInflight {
+				s.maxInflight = s.inflight
+			}
+			s.queried[id] = true
+			s.mu.Unlock()
+
+			go func(t string, addr *net.UDPAddr) {
+				time.Sleep(delay)
+				s.mu.Lock()
+				s.inflight--
+				s.mu.Unlock()
+				resp, _ := bencode.EncodeBytes(krpcMsg{T: t, Y: "r", R: &krpcReturn{ID: string(id[:]), Token: "tok"}})
+				conn.WriteToUDP(resp, addr)
+			}(msg.T, addr)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestLookupAlpha(t *testing.T) {
+	n := newLocalNode(t)
+	s := &slowNodes{queried: make(map[[20]byte]bool)}
+
+	// more nodes than a lookup converges on, the farthest ones are never
+	// asked
+	for i := 0; i < K+4; i++ {
+		id := idAt(n.id, i%4, byte(i))
+		n.table.seen(&contact{id: id, addr: s.serve(t, id, 50*time.Millisecond)})
+	}
+
+	target := n.id
+	result := n.lookup(target, "get_peers")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.maxInflight > alpha {
+		t.Errorf("%d queries in flight at once, want at most %d", s.maxInflight, alpha)
+	}
+	if s.maxInflight < alpha {
+		t.Errorf("at most %d queries in flight, want %d", s.maxInflight, alpha)
+	}
+	if len(result.closest) != K {
+		t.Fatalf("got %d closest nodes, want %d", len(result.closest), K)
+	}
+	closest := n.table.closest(target, K)
+	for i, r := range result.closest {
+		if r.id != closest[i].id {
+			t.Errorf("closest node %d is %x, want %x", i, r.id, closest[i].id)
+		}
+		if r.token != "tok" {
+			t.Errorf("closest node %d has token %q", i, r.token)
+		}
+	}
+	if len(s.queried) != K {
+		t.Errorf("queried %d nodes, want the %d closest", len(s.queried), K)
+	}
+}
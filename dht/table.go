@@ -0,0 +1,150 @@
+package dht
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+)
+
+// K is the size of a bucket and the number of nodes a lookup converges on.
+const K = 8
+
+// a node not heard from in this long may be replaced by a new one
+const staleAfter = 15 * time.Minute
+
+// a node that failed to answer this many queries in a row is dropped
+const maxFailures = 2
+
+type entry struct {
+	*contact
+	lastSeen time.Time
+	failures int
+}
+
+// table is the routing table: one bucket of up to K nodes for every length
+// of the prefix a node id shares with ours.
+type table struct {
+	mu      sync.Mutex
+	self    [20]byte
+	buckets [160][]*entry
+}
+
+func newTable(self [20]byte) *table {
+	return &table{self: self}
+}
+
+// bucketIndex returns the number of leading bits id shares with ours.
+func (tb *table) bucketIndex(id [20]byte) int {
+	for i := 0; i < 20; i++ {
+		x := tb.self[i] ^ id[i]
+		if x == 0 {
+			continue
+		}
+		n := 0
+		for x&0x80 == 0 {
+			x <<= 1
+			n++
+		}
+		return i*8 + n
+	}
+	return 159
+}
+
+// seen records that c answered or sent us something. Full buckets only take
+// new nodes in place of stale ones, long-lived nodes are the most reliable.
+func (tb *table) seen(c *contact) {
+	if c.id == tb.self {
+		return
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	i := tb.bucketIndex(c.id)
+	bucket := tb.buckets[i]
+	for _, e := range bucket {
+		if e.id == c.id {
+			e.addr = c.addr
+			e.lastSeen = time.Now()
+			e.failures = 0
+			return
+		}
+	}
+
+	e := &entry{contact: c, lastSeen: time.Now()}
+	if len(bucket) < K {
+		tb.buckets[i] = append(bucket, e)
+		return
+	}
+	oldest := 0
+	for j, old := range bucket {
+		if old.lastSeen.Before(bucket[oldest].lastSeen) {
+			oldest = j
+		}
+	}
+	if time.Since(bucket[oldest].lastSeen) > staleAfter {
+		bucket[oldest] = e
+	}
+}
+
+// failed records that the node with id did not answer a query.
+func (tb *table) failed(id [20]byte) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	i := tb.bucketIndex(id)
+	bucket := tb.buckets[i]
+	for j, e := range bucket {
+		if e.id == id {
+			e.failures++
+			if e.failures >= maxFailures {
+				tb.buckets[i] = append(bucket[:j], bucket[j+1:]...)
+			}
+			return
+		}
+	}
+}
+
+// closest returns up to n known nodes closest to target.
+func (tb *table) closest(target [20]byte, n int) []*contact {
+	tb.mu.Lock()
+	var contacts []*contact
+	for _, bucket := range tb.buckets {
+		for _, e := range bucket {
+			contacts = append(contacts, e.contact)
+		}
+	}
+	tb.mu.Unlock()
+
+	sortByDistance(contacts, target)
+	if len(contacts) > n {
+		contacts = contacts[:n]
+	}
+	return contacts
+}
+
+func (tb *table) len() int {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	n := 0
+	for _, bucket := range tb.buckets {
+		n += len(bucket)
+	}
+	return n
+}
+
+func distance(a, b [20]byte) [20]byte {
+	var d [20]byte
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+func sortByDistance(contacts []*contact, target [20]byte) {
+	sort.Slice(contacts, func(i, j int) bool {
+		di := distance(contacts[i].id, target)
+		dj := distance(contacts[j].id, target)
+		return bytes.Compare(di[:], dj[:]) < 0
+	})
+}
@@ -0,0 +1,132 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// idAt returns an id sharing exactly prefix leading bits with self, told
+// apart from others of the same bucket by its last byte n, so a prefix of
+// 152 or more needs n = 0.
+func idAt(self [20]byte, prefix int, n byte) [20]byte {
+	id := self
+	id[19] ^= n
+	id[prefix/8] ^= 0x80 >> (prefix % 8)
+	return id
+}
+
+func newContact(id [20]byte, port int) *contact {
+	return &contact{id: id, addr: &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}
+}
+
+func TestBucketIndex(t *testing.T) {
+	self := [20]byte{0x5a, 0xa5}
+	tb := newTable(self)
+	tests := []struct {
+		id   [20]byte
+		want int
+	}{
+		{idAt(self, 0, 0), 0},
+		{idAt(self, 1, 0), 1},
+		{idAt(self, 7, 0), 7},
+		{idAt(self, 8, 0), 8},
+		{idAt(self, 100, 0), 100},
+		{idAt(self, 159, 0), 159},
+		// our own id goes nowhere else
+		{self, 159},
+	}
+	for _, tt := range tests {
+		if got := tb.bucketIndex(tt.id); got != tt.want {
+			t.Errorf("bucketIndex(%x) = %d, want %d", tt.id, got, tt.want)
+		}
+	}
+}
+
+func TestBucketCapacity(t *testing.T) {
+	self := [20]byte{0x5a}
+	tb := newTable(self)
+
+	// a full bucket turns newcomers away
+	for n := byte(0); n < K+2; n++ {
+		tb.seen(newContact(idAt(self, 0, n), 1000+int(n)))
+	}
+	if got := len(tb.buckets[0]); got != K {
+		t.Fatalf("bucket 0 holds %d nodes, want %d", got, K)
+	}
+	newcomer := idAt(self, 0, K+1)
+	for _, e := range tb.buckets[0] {
+		if e.id == newcomer {
+			t.Fatal("full bucket took a new node")
+		}
+	}
+
+	// other buckets fill up on their own
+	tb.seen(newContact(idAt(self, 3, 0), 2000))
+	if len(tb.buckets[3]) != 1 {
+		t.Errorf("bucket 3 holds %d nodes, want 1", len(tb.buckets[3]))
+	}
+	if tb.len() != K+1 {
+		t.Errorf("table holds %d nodes, want %d", tb.len(), K+1)
+	}
+
+	// a stale node makes way
+	tb.buckets[0][2].lastSeen = time.Now().Add(-staleAfter - time.Minute)
+	tb.seen(newContact(newcomer, 3000))
+	if tb.buckets[0][2].id != newcomer {
+		t.Error("stale node kept over a new one")
+	}
+
+	// ourselves, never
+	tb.seen(newContact(self, 4000))
+	if tb.len() != K+1 {
+		t.Error("table took our own id")
+	}
+}
+
+func TestFailed(t *testing.T) {
+	self := [20]byte{}
+	tb := newTable(self)
+	id := idAt(self, 4, 1)
+	tb.seen(newContact(id, 1000))
+
+	for i := 1; i < maxFailures; i++ {
+		tb.failed(id)
+	}
+	if tb.len() != 1 {
+		t.Fatalf("node dropped after %d failures", maxFailures-1)
+	}
+	// an answer clears the failures
+	tb.seen(newContact(id, 1000))
+	tb.failed(id)
+	if tb.len() != 1 {
+		t.Fatal("failures not cleared by an answer")
+	}
+	for i := 1; i < maxFailures; i++ {
+		tb.failed(id)
+	}
+	if tb.len() != 0 {
+		t.Errorf("node kept after %d failures in a row", maxFailures)
+	}
+}
+
+func TestClosest(t *testing.T) {
+	// all in the one bucket of ids starting with a 0 bit
+	tb := newTable([20]byte{0xff})
+	for i := 0; i < K; i++ {
+		tb.seen(newContact([20]byte{byte(i)}, 1000+i))
+	}
+
+	target := [20]byte{0x05}
+	got := tb.closest(target, 4)
+	// 5, then 4 (distance 1), 7 (2), 6 (3)
+	want := []byte{5, 4, 7, 6}
+	if len(got) != len(want) {
+		t.Fatalf("got %d nodes, want %d", len(got), len(want))
+	}
+	for i, c := range got {
+		if c.id[0] != want[i] {
+			t.Errorf("node %d is %x, want %x", i, c.id[0], want[i])
+		}
+	}
+}
@@ -0,0 +1,125 @@
+// Package extension holds the messages of the extension protocol (BEP 10)
+// and of the metadata exchange built on top of it (BEP 9).
+package extension
+
+import (
+	"bytes"
+	"fmt"
+
+	bencode "github.com/zeebo/bencode"
+)
+
+// HandshakeID is the extended message id of the extended handshake.
+const HandshakeID = 0
+
+// names of the extensions we support
+const (
+	UTMetadata = "ut_metadata"
+	UTPex      = "ut_pex"
+)
+
+// MetadataPieceSize is the size of every metadata piece but the last.
+const MetadataPieceSize = 16384
+
+// MaxMetadataSize caps the info dictionary size we accept from a peer.
+const MaxMetadataSize = 8 << 20
+
+// ut_metadata message types
+const (
+	MetadataRequest = 0
+	MetadataData    = 1
+	MetadataReject  = 2
+)
+
+// Handshake is the payload of the extended handshake. M maps extension
+// names to the message ids the sender wants to receive them with.
+// P is the port the sender accepts connections on, Reqq the number of
+// requests it queues and YourIP the receiver's address as the sender sees
+// it, 4 or 16 bytes.
+type Handshake struct {
+	M            map[string]int `bencode:"m"`
+	P            int            `bencode:"p,omitempty"`
+	V            string         `bencode:"v,omitempty"`
+	Reqq         int            `bencode:"reqq,omitempty"`
+	YourIP       string         `bencode:"yourip,omitempty"`
+	MetadataSize int            `bencode:"metadata_size,omitempty"`
+}
+
+func (h *Handshake) Serialize() ([]byte, error) {
+	return bencode.EncodeBytes(h)
+}
+
+func ParseHandshake(payload []byte) (*Handshake, error) {
+	h := Handshake{}
+	err := bencode.DecodeBytes(payload, &h)
+	if err != nil {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// Metadata is a ut_metadata message. Data messages carry the piece after
+// the bencoded dictionary.
+type Metadata struct {
+	Type      int `bencode:"msg_type"`
+	Piece     int `bencode:"piece"`
+	TotalSize int `bencode:"total_size,omitempty"`
+}
+
+func (m *Metadata) Serialize(data []byte) ([]byte, error) {
+	buf, err := bencode.EncodeBytes(m)
+	if err != nil {
+		return nil, err
+	}
+	return append(buf, data...), nil
+}
+
+// ParseMetadata parses a ut_metadata message and returns the piece data that
+// follows the dictionary, if any.
+func ParseMetadata(payload []byte) (*Metadata, []byte, error) {
+	m := Metadata{}
+	d := bencode.NewDecoder(bytes.NewReader(payload))
+	err := d.Decode(&m)
+	if err != nil {
+		return nil, nil, err
+	}
+	// compared before multiplying, a huge piece would overflow
+	if m.Piece < 0 || m.Piece >= MaxMetadataSize/MetadataPieceSize {
+		return nil, nil, fmt.Errorf("metadata piece %d out of range", m.Piece)
+	}
+	return &m, payload[d.BytesParsed():], nil
+}
+
+// flags of a peer in a ut_pex message
+const (
+	PexEncryption = 0x01
+	PexSeed       = 0x02
+	PexUTP        = 0x04
+	PexHolepunch  = 0x08
+	PexOutgoing   = 0x10
+)
+
+// Pex is a ut_pex message: the peers the sender connected to and dropped
+// since its last message, in compact form, with one flags byte per added
+// peer. IPv6 peers go in the fields ending in 6.
+type Pex struct {
+	Added    string `bencode:"added"`
+	AddedF   string `bencode:"added.f"`
+	Dropped  string `bencode:"dropped"`
+	Added6   string `bencode:"added6,omitempty"`
+	Added6F  string `bencode:"added6.f,omitempty"`
+	Dropped6 string `bencode:"dropped6,omitempty"`
+}
+
+func (m *Pex) Serialize() ([]byte, error) {
+	return bencode.EncodeBytes(m)
+}
+
+func ParsePex(payload []byte) (*Pex, error) {
+	m := Pex{}
+	err := bencode.DecodeBytes(payload, &m)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
@@ -0,0 +1,36 @@
+package extension
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseMetadataRange(t *testing.T) {
+	tests := []struct {
+		piece   int
+		wantErr bool
+	}{
+		{0, false},
+		{MaxMetadataSize/MetadataPieceSize - 1, false},
+		{-1, true},
+		{MaxMetadataSize / MetadataPieceSize, true},
+		// its offset overflows to a negative one
+		{1 << 49, true},
+		{1 << 62, true},
+	}
+	for _, tt := range tests {
+		m := Metadata{Type: MetadataData, Piece: tt.piece, TotalSize: 3}
+		payload, err := m.Serialize([]byte("abc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, data, err := ParseMetadata(payload)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("piece %d: got error %v", tt.piece, err)
+			continue
+		}
+		if err == nil && (*got != m || !bytes.Equal(data, []byte("abc"))) {
+			t.Errorf("piece %d: got %+v with %q", tt.piece, got, data)
+		}
+	}
+}
@@ -7,16 +7,39 @@ import (
 
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
+// bits in the reserved bytes announcing the extension protocol (BEP 10) and
+// the fast extension (BEP 6)
+const (
+	extensionByte = 5
+	extensionBit  = 0x10
+	fastByte      = 7
+	fastBit       = 0x04
+)
+
 func New(infoHash, peerID [20]byte) *Handshake {
-	return &Handshake{
+	h := &Handshake{
 		Pstr:     "BitTorrent protocol",
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
+	h.Reserved[extensionByte] |= extensionBit
+	h.Reserved[fastByte] |= fastBit
+	return h
+}
+
+// SupportsExtensions reports whether the extension protocol bit is set.
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[extensionByte]&extensionBit != 0
+}
+
+// SupportsFast reports whether the fast extension bit is set.
+func (h *Handshake) SupportsFast() bool {
+	return h.Reserved[fastByte]&fastBit != 0
 }
 
 func (h *Handshake) Serialize() []byte {
@@ -24,7 +47,7 @@ func (h *Handshake) Serialize() []byte {
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8))
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -48,13 +71,16 @@ func Read(r io.Reader) (*Handshake, error) {
 	if err != nil {
 		return nil, err
 	}
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
 
+	copy(reserved[:], handshakeBuf[pstrlen:pstrlen+8])
 	copy(infoHash[:], handshakeBuf[pstrlen+8:pstrlen+8+20])
 	copy(peerID[:], handshakeBuf[pstrlen+8+20:])
 
 	h := Handshake{
 		Pstr:     string(handshakeBuf[0:pstrlen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
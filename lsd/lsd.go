@@ -0,0 +1,251 @@
+// Package lsd implements Local Service Discovery (BEP 14): torrents are
+// announced to the local network by multicast, and peers announcing the same
+// torrents are picked up.
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aryanA101a/villi/peers"
+	"github.com/aryanA101a/villi/utils"
+)
+
+// multicast groups announces are sent to and received on
+var (
+	GroupV4 = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+	GroupV6 = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+// how often active torrents are announced again
+const announceInterval = 5 * time.Minute
+
+type group struct {
+	addr *net.UDPAddr
+	// listen receives announces sent to the group, send sends ours
+	listen *net.UDPConn
+	send   *net.UDPConn
+}
+
+// Service announces torrents on the local network and reports the peers it
+// hears about.
+type Service struct {
+	port   uint16
+	cookie string
+	groups []*group
+
+	mu       sync.Mutex
+	torrents map[[20]byte]func(peers.Peer)
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// New joins the IPv4 and IPv6 LSD groups, announcing that we accept
+// connections on port. It fails only if neither group can be joined.
+func New(port uint16) (*Service, error) {
+	cookie := make([]byte, 8)
+	_, err := rand.Read(cookie)
+	if err != nil {
+		return nil, err
+	}
+	s := &Service{
+		port:     port,
+		cookie:   hex.EncodeToString(cookie),
+		torrents: make(map[[20]byte]func(peers.Peer)),
+		done:     make(chan struct{}),
+	}
+
+	for _, g := range []struct {
+		network string
+		addr    *net.UDPAddr
+	}{{"udp4", GroupV4}, {"udp6", GroupV6}} {
+		joined, err := joinGroup(g.network, g.addr)
+		if err != nil {
+			log.Println(utils.BoldRed("Could not join LSD group ", g.addr, " (", err, ")\n"))
+			continue
+		}
+		s.groups = append(s.groups, joined)
+	}
+	if len(s.groups) == 0 {
+		return nil, fmt.Errorf("could not join any LSD multicast group")
+	}
+
+	for _, g := range s.groups {
+		go s.serve(g)
+	}
+	go s.run()
+	return s, nil
+}
+
+func joinGroup(network string, addr *net.UDPAddr) (*group, error) {
+	listen, err := net.ListenMulticastUDP(network, nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	send, err := net.ListenUDP(network, nil)
+	if err != nil {
+		listen.Close()
+		return nil, err
+	}
+	return &group{addr: addr, listen: listen, send: send}, nil
+}
+
+// Add starts announcing infoHash; found is called for every peer on the
+// local network that announces it too.
+func (s *Service) Add(infoHash [20]byte, found func(peers.Peer)) {
+	s.mu.Lock()
+	s.torrents[infoHash] = found
+	s.mu.Unlock()
+	s.announce([][20]byte{infoHash})
+}
+
+func (s *Service) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, infoHash)
+}
+
+func (s *Service) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		for _, g := range s.groups {
+			g.listen.Close()
+			g.send.Close()
+		}
+	})
+	return nil
+}
+
+// run announces all active torrents every announceInterval.
+func (s *Service) run() {
+	ticker := time.NewTicker(announceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.mu.Lock()
+			var infoHashes [][20]byte
+			for infoHash := range s.torrents {
+				infoHashes = append(infoHashes, infoHash)
+			}
+			s.mu.Unlock()
+			s.announce(infoHashes)
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *Service) announce(infoHashes [][20]byte) {
+	if len(infoHashes) == 0 {
+		return
+	}
+	for _, g := range s.groups {
+		_, err := g.send.WriteToUDP(s.formatAnnounce(g.addr, infoHashes), g.addr)
+		if err != nil {
+			log.Println(utils.BoldRed("LSD announce to ", g.addr, " failed(", err, ")\n"))
+		}
+	}
+}
+
+func (s *Service) formatAnnounce(addr *net.UDPAddr, infoHashes [][20]byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("BT-SEARCH * HTTP/1.1\r\n")
+	buf.WriteString("Host: " + addr.String() + "\r\n")
+	buf.WriteString("Port: " + strconv.Itoa(int(s.port)) + "\r\n")
+	for _, infoHash := range infoHashes {
+		buf.WriteString("Infohash: " + hex.EncodeToString(infoHash[:]) + "\r\n")
+	}
+	buf.WriteString("cookie: " + s.cookie + "\r\n")
+	buf.WriteString("\r\n\r\n")
+	return buf.Bytes()
+}
+
+func (s *Service) serve(g *group) {
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := g.listen.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+				continue
+			}
+		}
+		port, infoHashes, cookie, err := parseAnnounce(buf[:n])
+		if err != nil || cookie == s.cookie {
+			continue
+		}
+
+		peer := peers.Peer{IP: from.IP, Port: port}
+		for _, infoHash := range infoHashes {
+			s.mu.Lock()
+			found, ok := s.torrents[infoHash]
+			s.mu.Unlock()
+			if ok {
+				found(peer)
+			}
+		}
+	}
+}
+
+// parseAnnounce reads a BT-SEARCH message.
+func parseAnnounce(msg []byte) (port uint16, infoHashes [][20]byte, cookie string, err error) {
+	r := bufio.NewReader(bytes.NewReader(msg))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return 0, nil, "", err
+	}
+	if strings.TrimSpace(line) != "BT-SEARCH * HTTP/1.1" {
+		return 0, nil, "", fmt.Errorf("not an LSD announce")
+	}
+
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if ok {
+			value = strings.TrimSpace(value)
+			switch textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name)) {
+			case "Port":
+				p, perr := strconv.ParseUint(value, 10, 16)
+				if perr != nil || p == 0 {
+					return 0, nil, "", fmt.Errorf("invalid port %q", value)
+				}
+				port = uint16(p)
+			case "Infohash":
+				buf, herr := hex.DecodeString(value)
+				if herr != nil || len(buf) != 20 {
+					continue
+				}
+				var infoHash [20]byte
+				copy(infoHash[:], buf)
+				infoHashes = append(infoHashes, infoHash)
+			case "Cookie":
+				cookie = value
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	if port == 0 || len(infoHashes) == 0 {
+		return 0, nil, "", fmt.Errorf("incomplete LSD announce")
+	}
+	return port, infoHashes, cookie, nil
+}
@@ -6,7 +6,12 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/aryanA101a/villi/mse"
 	"github.com/aryanA101a/villi/torrentfile"
 	"github.com/aryanA101a/villi/ui"
 	"github.com/aryanA101a/villi/utils"
@@ -18,31 +23,79 @@ import (
 
 var p *tea.Program
 
+// how long quitting waits for the download to wind down
+const shutdownTimeout = 10 * time.Second
+
 func main() {
-	
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "verify":
+			os.Exit(runVerify(os.Args[2:]))
+		case "scrape":
+			os.Exit(runScrape(os.Args[2:]))
+		case "tracker":
+			os.Exit(runTracker(os.Args[2:]))
+		case "create":
+			os.Exit(runCreate(os.Args[2:]))
+		}
+	}
+
 	verboseFlag:=flag.Bool("v",false,"Detailed logging")
 	flag.BoolVar(verboseFlag,"verbose",false,"logging")
 
 	helpFlag:=flag.Bool("h",false,"help")
 	flag.BoolVar(helpFlag,"help",false,"help")
+
+	var cfg torrentfile.Config
+	flag.Float64Var(&cfg.SeedRatio, "seed-ratio", 1.0, "Stop seeding at this upload ratio")
+	flag.DurationVar(&cfg.SeedTime, "seed-time", 30*time.Minute, "Stop seeding after this long")
+	flag.BoolVar(&cfg.NoSeed, "no-seed", false, "Exit as soon as the download is complete")
+	flag.BoolVar(&cfg.NoDHT, "no-dht", false, "Do not look for peers in the DHT")
+	flag.BoolVar(&cfg.NoLSD, "no-lsd", false, "Do not look for peers on the local network")
+	dhtBootstrapFlag := flag.String("dht-bootstrap", "", "Comma separated host:port list of DHT nodes to join through")
+	flag.BoolVar(&cfg.NoUTP, "no-utp", false, "Connect to peers over TCP only")
+	encryptionFlag := flag.String("encryption", "preferred", "Encrypt peer connections: disabled, preferred or required")
+
 	flag.Usage=func() {
 		fmt.Print(usageText)
 	}
-	flag.Parse()
+	args := parseArgs(flag.CommandLine, os.Args[1:])
 var inPath,outPath string
 	if(*helpFlag){
 		flag.Usage()
 		return
 	}
+	if len(args) != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	inPath = args[0]
+	outPath = args[1]
+	if *dhtBootstrapFlag != "" {
+		cfg.DHTBootstrap = strings.Split(*dhtBootstrapFlag, ",")
+	}
+	policy, err := mse.ParsePolicy(*encryptionFlag)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+	cfg.Encryption = policy
+	stop := make(chan struct{})
+	cfg.Stop = stop
+
 	 if *verboseFlag {
-		inPath = os.Args[2]
-		outPath = os.Args[3]
 		ui.UpdateUI = func(x interface{}) {}
-		start(inPath, outPath)
+		// the first interrupt stops gracefully, a second one kills
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		go func() {
+			<-sigs
+			signal.Stop(sigs)
+			close(stop)
+		}()
+		start(inPath, outPath, cfg)
 
 	} else {
-		inPath = os.Args[1]
-		outPath = os.Args[2]
 		log.SetOutput(ioutil.Discard)
 
 		m := model{
@@ -62,8 +115,13 @@ var inPath,outPath string
 		// // Start Bubble Tea
 		p = tea.NewProgram(m)
 
-		// Start the download
-		go start(inPath, outPath)
+		// Start the download, and leave the UI once seeding is done
+		finished := make(chan struct{})
+		go func() {
+			start(inPath, outPath, cfg)
+			close(finished)
+			p.Send(doneMsg{})
+		}()
 
 		ui.UpdateUI = func(x interface{}) {
 			switch x.(type) {
@@ -85,6 +143,12 @@ var inPath,outPath string
 			case ui.FileName:
 				p.Send(x)
 				return
+			case ui.Uploaded:
+				p.Send(x)
+				return
+			case ui.Trackers:
+				p.Send(x)
+				return
 			default:
 				return
 
@@ -95,32 +159,88 @@ var inPath,outPath string
 			log.Println("error running program:", err)
 			os.Exit(1)
 		}
+		// the UI was left early, give the trackers a moment to hear we stop
+		close(stop)
+		select {
+		case <-finished:
+		case <-time.After(shutdownTimeout):
+		}
 	}
 
 }
 
-func start(inPath string, outPath string) {
-	tf, err := torrentfile.Open(inPath, outPath)
+// parseArgs parses fs from args, allowing flags before, between and after
+// the positional arguments, and returns the positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func start(inPath string, outPath string, cfg torrentfile.Config) {
+	var tf torrentfile.TorrentFile
+	var err error
+	if torrentfile.IsMagnet(inPath) {
+		tf, err = torrentfile.OpenMagnet(inPath)
+	} else {
+		tf, err = torrentfile.Open(inPath, outPath)
+	}
 	if err != nil {
 		log.Fatal(utils.BoldRed(err))
 	}
 	ui.UpdateUI(ui.FileName(tf.Name))
 	ui.UpdateUI(ui.Status("contacting peers..."))
-	ui.UpdateUI(ui.FileSize(utils.ConvertToHumanReadable(tf.Length)))
+	if tf.Length > 0 {
+		ui.UpdateUI(ui.FileSize(utils.ConvertToHumanReadable(tf.Length)))
+	}
 
-	err = tf.DownloadToFile(outPath)
+	err = tf.DownloadToFile(outPath, cfg)
 	if err != nil {
 		log.Fatal(utils.BoldRed(err))
 	}
 }
 
-var usageText=`Usage: villi [options] torrent_file output_directory
+var usageText=`Usage: villi [options] torrent_file|magnet_link output_directory
+       villi verify [options] torrent_file data_directory
+       villi scrape torrent_file|magnet_link
+       villi tracker [options]
+       villi create [options] path
+
+Commands:
+  verify           Check downloaded data against the torrent's piece hashes
+  scrape           Show the seeders and leechers each tracker knows of
+  tracker          Run a tracker over HTTP and UDP
+  create           Make a torrent of a file or directory
 
 Options:
   -v, --verbose    Enable verbose logging
   -h, --help       Show help message and exit
+  --seed-ratio     Stop seeding once this much of the torrent was uploaded (default 1.0, 0 for no limit)
+  --seed-time      Stop seeding after this long (default 30m, 0 for no limit)
+  --no-seed        Exit as soon as the download is complete
+  --no-dht         Do not look for peers in the DHT
+  --dht-bootstrap  Comma separated host:port list of DHT nodes to join through
+                   (default router.bittorrent.com:6881 and other well-known routers)
+  --no-lsd         Do not look for peers on the local network
+  --encryption     Encrypt peer connections: disabled, preferred or required
+                   (default preferred)
+  --no-utp         Connect to peers over TCP only
 
 Examples:
   villi file.torrent /downloads/         Download file.torrent and save to /downloads/
   villi file.torrent /downloads/ -v      Download file.torrent and save to /downloads/ with verbose logging
+  villi 'magnet:?xt=urn:btih:...' /downloads/
+                                         Fetch the torrent behind a magnet link and download it
+  villi verify file.torrent /downloads/  Report how much of file.torrent is in /downloads/
+  villi scrape file.torrent              Show how healthy the swarm of file.torrent is
+  villi tracker --state swarms.benc      Run a tracker on port 6969 that survives restarts
+  villi create --tracker udp://tracker.example:6969/announce build/
+                                         Make build.torrent of the directory build/
 `
\ No newline at end of file
@@ -26,6 +26,20 @@ const (
 	MsgPiece messageID = 7
 
 	MsgCancel messageID = 8
+
+	// fast extension (BEP 6)
+	MsgSuggest messageID = 13
+
+	MsgHaveAll messageID = 14
+
+	MsgHaveNone messageID = 15
+
+	MsgReject messageID = 16
+
+	MsgAllowedFast messageID = 17
+
+	// extension protocol (BEP 10)
+	MsgExtended messageID = 20
 )
 
 type Message struct {
@@ -41,6 +55,22 @@ func FormatRequest(index, begin, length int) *Message {
 	return &Message{ID: MsgRequest, Payload: payload}
 }
 
+func FormatCancel(index, begin, length int) *Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return &Message{ID: MsgCancel, Payload: payload}
+}
+
+func FormatReject(index, begin, length int) *Message {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	binary.BigEndian.PutUint32(payload[8:12], uint32(length))
+	return &Message{ID: MsgReject, Payload: payload}
+}
+
 func FormatHave(index int) *Message {
 	payload := make([]byte, 4)
 	binary.BigEndian.PutUint32(payload, uint32(index))
@@ -50,6 +80,34 @@ func FormatHave(index int) *Message {
 	}
 }
 
+func FormatAllowedFast(index int) *Message {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, uint32(index))
+	return &Message{ID: MsgAllowedFast, Payload: payload}
+}
+
+func FormatPiece(index, begin int, block []byte) *Message {
+	payload := make([]byte, 8+len(block))
+	binary.BigEndian.PutUint32(payload[0:4], uint32(index))
+	binary.BigEndian.PutUint32(payload[4:8], uint32(begin))
+	copy(payload[8:], block)
+	return &Message{ID: MsgPiece, Payload: payload}
+}
+
+// ParseRequest parses the payload of a request, cancel or reject message.
+func ParseRequest(msg *Message) (index, begin, length int, err error) {
+	if msg.ID != MsgRequest && msg.ID != MsgCancel && msg.ID != MsgReject {
+		return 0, 0, 0, fmt.Errorf("expected request (ID %d), cancel (ID %d) or reject (ID %d), got ID %d", MsgRequest, MsgCancel, MsgReject, msg.ID)
+	}
+	if len(msg.Payload) != 12 {
+		return 0, 0, 0, fmt.Errorf("expected payload length 12, got length %d", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	length = int(binary.BigEndian.Uint32(msg.Payload[8:12]))
+	return index, begin, length, nil
+}
+
 func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	if msg.ID != MsgPiece {
 		return 0, fmt.Errorf("expected piece (ID %d), got ID %d", MsgPiece, msg.ID)
@@ -73,9 +131,44 @@ func ParsePiece(index int, buf []byte, msg *Message) (int, error) {
 	return len(data), nil
 }
 
+// ParseBlock splits a piece message into its index, offset and block data.
+func ParseBlock(msg *Message) (index, begin int, block []byte, err error) {
+	if msg.ID != MsgPiece {
+		return 0, 0, nil, fmt.Errorf("expected piece (ID %d), got ID %d", MsgPiece, msg.ID)
+	}
+	if len(msg.Payload) < 8 {
+		return 0, 0, nil, fmt.Errorf("payload too short. %d < 8", len(msg.Payload))
+	}
+	index = int(binary.BigEndian.Uint32(msg.Payload[0:4]))
+	begin = int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	return index, begin, msg.Payload[8:], nil
+}
+
+// FormatExtended builds an extension protocol message; id 0 is the extended
+// handshake, other ids are the ones the receiving peer assigned.
+func FormatExtended(id uint8, payload []byte) *Message {
+	buf := make([]byte, 1+len(payload))
+	buf[0] = id
+	copy(buf[1:], payload)
+	return &Message{ID: MsgExtended, Payload: buf}
+}
+
+// ParseExtended splits an extension protocol message into its id and payload.
+func ParseExtended(msg *Message) (uint8, []byte, error) {
+	if msg.ID != MsgExtended {
+		return 0, nil, fmt.Errorf("expected extended (ID %d), got ID %d", MsgExtended, msg.ID)
+	}
+	if len(msg.Payload) < 1 {
+		return 0, nil, fmt.Errorf("payload too short. %d < 1", len(msg.Payload))
+	}
+	return msg.Payload[0], msg.Payload[1:], nil
+}
+
+// ParseHave parses the piece index of a have, suggest or allowed fast
+// message.
 func ParseHave(msg *Message) (int, error) {
-	if msg.ID != MsgHave {
-		return 0, fmt.Errorf("expected have (ID %d), got ID %d", MsgHave, msg.ID)
+	if msg.ID != MsgHave && msg.ID != MsgSuggest && msg.ID != MsgAllowedFast {
+		return 0, fmt.Errorf("expected have (ID %d), suggest (ID %d) or allowed fast (ID %d), got ID %d", MsgHave, MsgSuggest, MsgAllowedFast, msg.ID)
 	}
 	if len(msg.Payload) != 4 {
 		return 0, fmt.Errorf("expected payload length 4, got length %d", len(msg.Payload))
@@ -96,6 +189,12 @@ func (m *Message) Serialize() []byte {
 	return buf
 }
 
+// longest message Read accepts, enough for a piece message of the largest
+// block we serve (128 KiB) and for the id byte and 256 KiB bitfield of a
+// torrent of 2M pieces. Anything longer comes from a broken or hostile peer
+// and is not allocated.
+const maxLength = 256*1024 + 1
+
 func Read(r io.Reader) (*Message, error) {
 	lengthBuf := make([]byte, 4)
 	_, err := io.ReadFull(r, lengthBuf)
@@ -107,6 +206,9 @@ func Read(r io.Reader) (*Message, error) {
 	if length == 0 {
 		return nil, nil
 	}
+	if length > maxLength {
+		return nil, fmt.Errorf("message of %d bytes is longer than %d", length, maxLength)
+	}
 
 	messageBuf := make([]byte, length)
 	_, err = io.ReadFull(r, messageBuf)
@@ -145,6 +247,18 @@ func (m *Message) name() string {
 		return "Piece"
 	case MsgCancel:
 		return "Cancel"
+	case MsgSuggest:
+		return "Suggest"
+	case MsgHaveAll:
+		return "HaveAll"
+	case MsgHaveNone:
+		return "HaveNone"
+	case MsgReject:
+		return "Reject"
+	case MsgAllowedFast:
+		return "AllowedFast"
+	case MsgExtended:
+		return "Extended"
 	default:
 		return fmt.Sprintf("Unknown#%d", m.ID)
 	}
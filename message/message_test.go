@@ -0,0 +1,56 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"testing"
+)
+
+func TestReadRoundTrip(t *testing.T) {
+	msgs := []*Message{
+		nil,
+		{ID: MsgUnchoke},
+		FormatHave(7),
+		FormatRequest(1, 16384, 16384),
+		FormatPiece(2, 0, bytes.Repeat([]byte{0xaa}, 128*1024)),
+	}
+	var buf bytes.Buffer
+	for _, m := range msgs {
+		buf.Write(m.Serialize())
+	}
+	for i, want := range msgs {
+		got, err := Read(&buf)
+		if err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+		if want == nil {
+			if got != nil {
+				t.Errorf("message %d: got %v for a keep-alive", i, got)
+			}
+			continue
+		}
+		if got == nil || got.ID != want.ID || !bytes.Equal(got.Payload, want.Payload) {
+			t.Errorf("message %d: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestReadTooLong(t *testing.T) {
+	for _, length := range []uint32{maxLength + 1, 1 << 24, 0xffffffff} {
+		// only the length prefix, the rest is never read
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint32(buf, length)
+		_, err := Read(bytes.NewReader(buf))
+		if err == nil || !strings.Contains(err.Error(), "longer than") {
+			t.Errorf("length %d: got error %v", length, err)
+		}
+	}
+
+	// the largest message, the bitfield of 2M pieces, goes through
+	m := &Message{ID: MsgBitfield, Payload: make([]byte, 2<<20/8)}
+	got, err := Read(bytes.NewReader(m.Serialize()))
+	if err != nil || len(got.Payload) != 2<<20/8 {
+		t.Errorf("bitfield of 2M pieces: %v", err)
+	}
+}
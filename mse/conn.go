@@ -0,0 +1,54 @@
+package mse
+
+import (
+	"crypto/rc4"
+	"io"
+	"net"
+	"sync"
+)
+
+// Conn is a peer connection after the MSE handshake. Depending on what was
+// negotiated the stream is RC4 encrypted or plaintext. Like any net.Conn it
+// may be read and written by different goroutines.
+type Conn struct {
+	net.Conn
+	// initial is the decrypted initial payload of an inbound handshake, read
+	// before anything else
+	initial []byte
+	// r reads what is left of the handshake's buffered bytes before the
+	// connection itself
+	r   io.Reader
+	dec *rc4.Cipher
+
+	wmu sync.Mutex
+	enc *rc4.Cipher
+}
+
+// Encrypted reports whether RC4 was selected for the payload stream.
+func (c *Conn) Encrypted() bool {
+	return c.enc != nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	if len(c.initial) > 0 {
+		n := copy(b, c.initial)
+		c.initial = c.initial[n:]
+		return n, nil
+	}
+	n, err := c.r.Read(b)
+	if c.dec != nil {
+		c.dec.XORKeyStream(b[:n], b[:n])
+	}
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	if c.enc == nil {
+		return c.Conn.Write(b)
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	buf := make([]byte, len(b))
+	c.enc.XORKeyStream(buf, b)
+	return c.Conn.Write(buf)
+}
@@ -0,0 +1,348 @@
+// Package mse implements Message Stream Encryption, also known as Protocol
+// Encryption: a Diffie-Hellman key exchange ahead of the BitTorrent
+// handshake, after which both sides agree on an RC4 encrypted or plaintext
+// stream.
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rc4"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"time"
+)
+
+// Policy is how willing we are to encrypt peer connections.
+type Policy int
+
+const (
+	// Preferred encrypts when possible but talks plaintext to peers that
+	// cannot
+	Preferred Policy = iota
+	// Disabled never encrypts
+	Disabled
+	// Required refuses peers that do not encrypt
+	Required
+)
+
+func (p Policy) String() string {
+	switch p {
+	case Disabled:
+		return "disabled"
+	case Required:
+		return "required"
+	default:
+		return "preferred"
+	}
+}
+
+// ParsePolicy parses "disabled", "preferred" or "required".
+func ParsePolicy(s string) (Policy, error) {
+	switch s {
+	case "disabled":
+		return Disabled, nil
+	case "preferred":
+		return Preferred, nil
+	case "required":
+		return Required, nil
+	}
+	return Preferred, fmt.Errorf("unknown encryption policy %q", s)
+}
+
+// crypto methods offered and selected during the handshake
+const (
+	cryptoPlaintext = 0x01
+	cryptoRC4       = 0x02
+)
+
+// Diffie-Hellman parameters of the specification
+var (
+	prime, _  = new(big.Int).SetString("FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD129024E088A67CC74020BBEA63B139B22514A08798E3404DDEF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245E485B576625E7EC6F44C42E9A63A36210000000000090563", 16)
+	generator = big.NewInt(2)
+)
+
+const (
+	keyLen = 96
+	// longest padding either side may send
+	maxPadLen = 512
+	// longest initial payload we accept, a BitTorrent handshake is 68 bytes
+	maxIALen = 1024
+	// how long the whole handshake may take
+	handshakeTimeout = 10 * time.Second
+)
+
+// verification constant, eight zero bytes
+var vc = make([]byte, 8)
+
+func hash(parts ...[]byte) []byte {
+	h := sha1.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// newKeys returns a private key and the public key sent to the other side.
+func newKeys() (*big.Int, []byte, error) {
+	buf := make([]byte, 20)
+	_, err := rand.Read(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	private := new(big.Int).SetBytes(buf)
+	public := make([]byte, keyLen)
+	new(big.Int).Exp(generator, private, prime).FillBytes(public)
+	return private, public, nil
+}
+
+func secret(private *big.Int, public []byte) []byte {
+	s := make([]byte, keyLen)
+	new(big.Int).Exp(new(big.Int).SetBytes(public), private, prime).FillBytes(s)
+	return s
+}
+
+// newCipher returns the RC4 stream keyed with key, past the first 1024 bytes
+// the specification discards.
+func newCipher(key []byte) *rc4.Cipher {
+	c, _ := rc4.NewCipher(key)
+	discard := make([]byte, 1024)
+	c.XORKeyStream(discard, discard)
+	return c
+}
+
+// randomPad returns up to maxPadLen random bytes.
+func randomPad() []byte {
+	pad := make([]byte, mrand.Intn(maxPadLen+1))
+	rand.Read(pad)
+	return pad
+}
+
+// syncTo reads up to and including pattern, which has to start within max
+// bytes.
+func syncTo(r *bufio.Reader, pattern []byte, max int) error {
+	window := make([]byte, 0, max+len(pattern))
+	for len(window) < cap(window) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		window = append(window, b)
+		if bytes.HasSuffix(window, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("could not synchronize the encrypted stream")
+}
+
+func readDecrypted(r io.Reader, c *rc4.Cipher, n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	c.XORKeyStream(buf, buf)
+	return buf, nil
+}
+
+// Initiate runs the handshake on an outbound connection to a peer of
+// infoHash. With Preferred the peer may choose plaintext, with Required it
+// has to encrypt.
+func Initiate(conn net.Conn, infoHash [20]byte, policy Policy) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	private, public, err := newKeys()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(public, randomPad()...))
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	peerPublic := make([]byte, keyLen)
+	_, err = io.ReadFull(r, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	s := secret(private, peerPublic)
+	enc := newCipher(hash([]byte("keyA"), s, infoHash[:]))
+	dec := newCipher(hash([]byte("keyB"), s, infoHash[:]))
+
+	provide := uint32(cryptoRC4)
+	if policy != Required {
+		provide |= cryptoPlaintext
+	}
+	var msg bytes.Buffer
+	msg.Write(hash([]byte("req1"), s))
+	req2 := hash([]byte("req2"), infoHash[:])
+	req3 := hash([]byte("req3"), s)
+	for i := range req2 {
+		msg.WriteByte(req2[i] ^ req3[i])
+	}
+	// no padding and no initial payload, the BitTorrent handshake follows
+	// on the negotiated stream
+	plain := make([]byte, 8+4+2+2)
+	binary.BigEndian.PutUint32(plain[8:], provide)
+	enc.XORKeyStream(plain, plain)
+	msg.Write(plain)
+	_, err = conn.Write(msg.Bytes())
+	if err != nil {
+		return nil, err
+	}
+
+	// the peer's padding ends where the encrypted verification constant
+	// starts
+	pattern := make([]byte, len(vc))
+	dec.XORKeyStream(pattern, vc)
+	err = syncTo(r, pattern, maxPadLen)
+	if err != nil {
+		return nil, err
+	}
+	buf, err := readDecrypted(r, dec, 4+2)
+	if err != nil {
+		return nil, err
+	}
+	selected := binary.BigEndian.Uint32(buf)
+	padLen := int(binary.BigEndian.Uint16(buf[4:]))
+	if padLen > maxPadLen {
+		return nil, fmt.Errorf("padding of %d bytes", padLen)
+	}
+	_, err = readDecrypted(r, dec, padLen)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case selected == cryptoRC4:
+		return &Conn{Conn: conn, r: r, dec: dec, enc: enc}, nil
+	case selected == cryptoPlaintext && provide&cryptoPlaintext != 0:
+		return &Conn{Conn: conn, r: r}, nil
+	}
+	return nil, fmt.Errorf("peer selected unsupported crypto method %d", selected)
+}
+
+// Accept tells an encrypted inbound connection from a plaintext one and, if
+// encrypted, runs the handshake. infoHashes lists the torrents the peer may
+// ask for.
+func Accept(conn net.Conn, policy Policy, infoHashes func() [][20]byte) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+
+	r := bufio.NewReader(conn)
+	first, err := r.Peek(20)
+	if err != nil {
+		return nil, err
+	}
+	if first[0] == 19 && string(first[1:]) == "BitTorrent protocol" {
+		if policy == Required {
+			return nil, fmt.Errorf("peer does not encrypt")
+		}
+		return &Conn{Conn: conn, r: r}, nil
+	}
+	if policy == Disabled {
+		return nil, fmt.Errorf("peer wants encryption")
+	}
+
+	peerPublic := make([]byte, keyLen)
+	_, err = io.ReadFull(r, peerPublic)
+	if err != nil {
+		return nil, err
+	}
+	private, public, err := newKeys()
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.Write(append(public, randomPad()...))
+	if err != nil {
+		return nil, err
+	}
+	s := secret(private, peerPublic)
+
+	err = syncTo(r, hash([]byte("req1"), s), maxPadLen)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 20)
+	_, err = io.ReadFull(r, buf)
+	if err != nil {
+		return nil, err
+	}
+	req3 := hash([]byte("req3"), s)
+	for i := range buf {
+		buf[i] ^= req3[i]
+	}
+	var infoHash [20]byte
+	found := false
+	for _, ih := range infoHashes() {
+		if bytes.Equal(buf, hash([]byte("req2"), ih[:])) {
+			infoHash = ih
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("peer asked for an unknown torrent")
+	}
+	dec := newCipher(hash([]byte("keyA"), s, infoHash[:]))
+	enc := newCipher(hash([]byte("keyB"), s, infoHash[:]))
+
+	buf, err = readDecrypted(r, dec, 8+4+2)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(buf[:8], vc) {
+		return nil, fmt.Errorf("invalid verification constant")
+	}
+	provide := binary.BigEndian.Uint32(buf[8:])
+	padLen := int(binary.BigEndian.Uint16(buf[12:]))
+	if padLen > maxPadLen {
+		return nil, fmt.Errorf("padding of %d bytes", padLen)
+	}
+	_, err = readDecrypted(r, dec, padLen)
+	if err != nil {
+		return nil, err
+	}
+	buf, err = readDecrypted(r, dec, 2)
+	if err != nil {
+		return nil, err
+	}
+	iaLen := int(binary.BigEndian.Uint16(buf))
+	if iaLen > maxIALen {
+		return nil, fmt.Errorf("initial payload of %d bytes", iaLen)
+	}
+	ia, err := readDecrypted(r, dec, iaLen)
+	if err != nil {
+		return nil, err
+	}
+
+	var selected uint32
+	switch {
+	case provide&cryptoRC4 != 0:
+		selected = cryptoRC4
+	case provide&cryptoPlaintext != 0 && policy != Required:
+		selected = cryptoPlaintext
+	default:
+		return nil, fmt.Errorf("no acceptable crypto method in %d", provide)
+	}
+	reply := make([]byte, 8+4+2)
+	binary.BigEndian.PutUint32(reply[8:], selected)
+	enc.XORKeyStream(reply, reply)
+	_, err = conn.Write(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	if selected == cryptoPlaintext {
+		return &Conn{Conn: conn, initial: ia, r: r}, nil
+	}
+	return &Conn{Conn: conn, initial: ia, r: r, dec: dec, enc: enc}, nil
+}
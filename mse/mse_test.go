@@ -0,0 +1,366 @@
+package mse
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rc4"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+var testInfoHash = [20]byte{0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa,
+	0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa, 0xaa}
+
+func testInfoHashes() [][20]byte {
+	return [][20]byte{{1}, testInfoHash}
+}
+
+func TestKeys(t *testing.T) {
+	privateA, publicA, err := newKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateB, publicB, err := newKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(secret(privateA, publicB), secret(privateB, publicA)) {
+		t.Fatal("the two sides derived different secrets")
+	}
+
+	// keystreams past the discarded 1024 bytes for a secret of 1, 2, ... 96
+	s := make([]byte, keyLen)
+	for i := range s {
+		s[i] = byte(i + 1)
+	}
+	for _, tt := range []struct{ name, want string }{
+		{"keyA", "db49e3373d96a1c765a42a424a06b03f"},
+		{"keyB", "3b7069405169347f5e6874f6dc7a62c9"},
+	} {
+		got := make([]byte, 16)
+		newCipher(hash([]byte(tt.name), s, testInfoHash[:])).XORKeyStream(got, got)
+		if hex.EncodeToString(got) != tt.want {
+			t.Errorf("%s keystream starts %x, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// handshake runs Initiate and Accept with the given policies on both ends
+// of a pipe.
+func handshake(initiator, acceptor Policy) (in, out *Conn, inErr, outErr error) {
+	a, b := net.Pipe()
+	accepted := make(chan struct{})
+	go func() {
+		defer close(accepted)
+		in, inErr = Accept(b, acceptor, testInfoHashes)
+		if inErr != nil {
+			b.Close()
+		}
+	}()
+	out, outErr = Initiate(a, testInfoHash, initiator)
+	if outErr != nil {
+		a.Close()
+	}
+	<-accepted
+	return in, out, inErr, outErr
+}
+
+// checkStream sends data both ways over an established connection.
+func checkStream(t *testing.T, in, out *Conn) {
+	t.Helper()
+	for _, dir := range []struct {
+		name     string
+		from, to *Conn
+	}{{"out", out, in}, {"in", in, out}} {
+		data := bytes.Repeat([]byte("0123456789"), 5000)
+		go dir.from.Write(data)
+		got := make([]byte, len(data))
+		_, err := io.ReadFull(dir.to, got)
+		if err != nil {
+			t.Fatalf("%s: %v", dir.name, err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("%s: data garbled", dir.name)
+		}
+	}
+}
+
+func TestInitiateAccept(t *testing.T) {
+	tests := []struct {
+		initiator, acceptor Policy
+	}{
+		{Preferred, Preferred},
+		{Preferred, Required},
+		{Required, Preferred},
+		{Required, Required},
+	}
+	for _, tt := range tests {
+		in, out, inErr, outErr := handshake(tt.initiator, tt.acceptor)
+		if inErr != nil || outErr != nil {
+			t.Errorf("%s to %s: %v, %v", tt.initiator, tt.acceptor, outErr, inErr)
+			continue
+		}
+		// our Initiate offers RC4, which Accept always takes
+		if !in.Encrypted() || !out.Encrypted() {
+			t.Errorf("%s to %s: not encrypted", tt.initiator, tt.acceptor)
+		}
+		checkStream(t, in, out)
+		in.Close()
+		out.Close()
+	}
+
+	// a peer that does not encrypt fails the handshake, the dialer retries
+	// in plaintext
+	_, _, inErr, outErr := handshake(Preferred, Disabled)
+	if inErr == nil || outErr == nil {
+		t.Errorf("encrypted handshake to a peer with encryption disabled: %v, %v", outErr, inErr)
+	}
+}
+
+func TestAcceptPlaintextPeer(t *testing.T) {
+	bt := append([]byte("\x13BitTorrent protocol"), make([]byte, 48)...)
+	for _, policy := range []Policy{Preferred, Disabled, Required} {
+		a, b := net.Pipe()
+		go a.Write(bt)
+		c, err := Accept(b, policy, testInfoHashes)
+		if policy == Required {
+			if err == nil || !strings.Contains(err.Error(), "does not encrypt") {
+				t.Errorf("%s: accepted a plaintext peer, error %v", policy, err)
+			}
+			a.Close()
+			b.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", policy, err)
+		}
+		if c.Encrypted() {
+			t.Errorf("%s: plaintext peer taken as encrypted", policy)
+		}
+		// the peeked handshake is still there to read
+		got := make([]byte, len(bt))
+		_, err = io.ReadFull(c, got)
+		if err != nil || !bytes.Equal(got, bt) {
+			t.Errorf("%s: read back %q, %v", policy, got, err)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+// rawInitiator is the initiating side of the handshake with everything
+// Initiate leaves out: the crypto methods provided, padding and an initial
+// payload.
+type rawInitiator struct {
+	provide    uint32
+	padA, padC []byte
+	ia         []byte
+}
+
+// run returns the method the peer selected and the cipher of what we send.
+func (ri rawInitiator) run(conn net.Conn) (selected uint32, enc *rc4.Cipher, err error) {
+	private, public, err := newKeys()
+	if err != nil {
+		return 0, nil, err
+	}
+	_, err = conn.Write(append(public, ri.padA...))
+	if err != nil {
+		return 0, nil, err
+	}
+	r := bufio.NewReader(conn)
+	peerPublic := make([]byte, keyLen)
+	_, err = io.ReadFull(r, peerPublic)
+	if err != nil {
+		return 0, nil, err
+	}
+	s := secret(private, peerPublic)
+	enc = newCipher(hash([]byte("keyA"), s, testInfoHash[:]))
+	dec := newCipher(hash([]byte("keyB"), s, testInfoHash[:]))
+
+	var msg bytes.Buffer
+	msg.Write(hash([]byte("req1"), s))
+	req2 := hash([]byte("req2"), testInfoHash[:])
+	req3 := hash([]byte("req3"), s)
+	for i := range req2 {
+		msg.WriteByte(req2[i] ^ req3[i])
+	}
+	plain := make([]byte, 8+4+2)
+	binary.BigEndian.PutUint32(plain[8:], ri.provide)
+	binary.BigEndian.PutUint16(plain[12:], uint16(len(ri.padC)))
+	plain = append(plain, ri.padC...)
+	plain = append(plain, byte(len(ri.ia)>>8), byte(len(ri.ia)))
+	plain = append(plain, ri.ia...)
+	enc.XORKeyStream(plain, plain)
+	msg.Write(plain)
+	_, err = conn.Write(msg.Bytes())
+	if err != nil {
+		return 0, nil, err
+	}
+
+	pattern := make([]byte, len(vc))
+	dec.XORKeyStream(pattern, vc)
+	err = syncTo(r, pattern, maxPadLen)
+	if err != nil {
+		return 0, nil, err
+	}
+	buf, err := readDecrypted(r, dec, 4+2)
+	if err != nil {
+		return 0, nil, err
+	}
+	_, err = readDecrypted(r, dec, int(binary.BigEndian.Uint16(buf[4:])))
+	return binary.BigEndian.Uint32(buf), enc, err
+}
+
+func TestAcceptSelection(t *testing.T) {
+	tests := []struct {
+		name   string
+		ri     rawInitiator
+		policy Policy
+		// want is the method selected, 0 for a failed handshake
+		want uint32
+	}{
+		{"both", rawInitiator{provide: cryptoRC4 | cryptoPlaintext}, Preferred, cryptoRC4},
+		{"plaintext", rawInitiator{provide: cryptoPlaintext}, Preferred, cryptoPlaintext},
+		{"plaintext required", rawInitiator{provide: cryptoPlaintext}, Required, 0},
+		{"unknown method", rawInitiator{provide: 0x04}, Preferred, 0},
+		{"padding", rawInitiator{provide: cryptoRC4, padA: make([]byte, maxPadLen), padC: make([]byte, maxPadLen)}, Preferred, cryptoRC4},
+		// req1 has to start within 512 bytes
+		{"too much padding", rawInitiator{provide: cryptoRC4, padA: make([]byte, maxPadLen+1)}, Preferred, 0},
+		{"initial payload", rawInitiator{provide: cryptoRC4, ia: []byte("hello")}, Preferred, cryptoRC4},
+		{"plaintext initial payload", rawInitiator{provide: cryptoPlaintext, ia: []byte("hello")}, Preferred, cryptoPlaintext},
+		{"too long initial payload", rawInitiator{provide: cryptoRC4, ia: make([]byte, maxIALen+1)}, Preferred, 0},
+	}
+	for _, tt := range tests {
+		a, b := net.Pipe()
+		type result struct {
+			c   *Conn
+			err error
+		}
+		accepted := make(chan result, 1)
+		go func() {
+			c, err := Accept(b, tt.policy, testInfoHashes)
+			if err != nil {
+				b.Close()
+			}
+			accepted <- result{c, err}
+		}()
+		selected, enc, err := tt.ri.run(a)
+		res := <-accepted
+		if tt.want == 0 {
+			if res.err == nil {
+				t.Errorf("%s: accepted", tt.name)
+			}
+			a.Close()
+			continue
+		}
+		if err != nil || res.err != nil {
+			t.Fatalf("%s: %v, %v", tt.name, err, res.err)
+		}
+		if selected != tt.want || res.c.Encrypted() != (tt.want == cryptoRC4) {
+			t.Errorf("%s: selected %d, encrypted %v", tt.name, selected, res.c.Encrypted())
+		}
+
+		// the initial payload comes first, then the stream
+		go func() {
+			data := []byte("world")
+			if selected == cryptoRC4 {
+				enc.XORKeyStream(data, data)
+			}
+			a.Write(data)
+		}()
+		want := string(tt.ri.ia) + "world"
+		got := make([]byte, len(want))
+		_, err = io.ReadFull(res.c, got)
+		if err != nil || string(got) != want {
+			t.Errorf("%s: read %q, %v, want %q", tt.name, got, err, want)
+		}
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestAcceptUnknownTorrent(t *testing.T) {
+	a, b := net.Pipe()
+	defer a.Close()
+	go Initiate(a, [20]byte{2}, Preferred)
+	_, err := Accept(b, Preferred, testInfoHashes)
+	if err == nil || !strings.Contains(err.Error(), "unknown torrent") {
+		t.Errorf("got error %v", err)
+	}
+	b.Close()
+}
+
+// rawAccept is the accepting side of the handshake, selecting the method it
+// is told to after padding of padLen bytes in both places.
+func rawAccept(conn net.Conn, selected uint32, padLen int) error {
+	r := bufio.NewReader(conn)
+	peerPublic := make([]byte, keyLen)
+	_, err := io.ReadFull(r, peerPublic)
+	if err != nil {
+		return err
+	}
+	private, public, err := newKeys()
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append(public, make([]byte, padLen)...))
+	if err != nil {
+		return err
+	}
+	s := secret(private, peerPublic)
+	err = syncTo(r, hash([]byte("req1"), s), maxPadLen)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(r, make([]byte, 20))
+	if err != nil {
+		return err
+	}
+	dec := newCipher(hash([]byte("keyA"), s, testInfoHash[:]))
+	enc := newCipher(hash([]byte("keyB"), s, testInfoHash[:]))
+	// Initiate sends neither padding nor an initial payload
+	_, err = readDecrypted(r, dec, 8+4+2+2)
+	if err != nil {
+		return err
+	}
+
+	reply := make([]byte, 8+4+2+padLen)
+	binary.BigEndian.PutUint32(reply[8:], selected)
+	binary.BigEndian.PutUint16(reply[12:], uint16(padLen))
+	enc.XORKeyStream(reply, reply)
+	_, err = conn.Write(reply)
+	return err
+}
+
+func TestInitiateSelection(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   Policy
+		selected uint32
+		padLen   int
+		wantErr  bool
+	}{
+		{"rc4", Preferred, cryptoRC4, 0, false},
+		{"plaintext", Preferred, cryptoPlaintext, 0, false},
+		{"plaintext required", Required, cryptoPlaintext, 0, true},
+		{"both", Preferred, cryptoRC4 | cryptoPlaintext, 0, true},
+		// the verification constant is found after the most padding allowed
+		{"padding", Preferred, cryptoRC4, maxPadLen, false},
+	}
+	for _, tt := range tests {
+		a, b := net.Pipe()
+		go rawAccept(b, tt.selected, tt.padLen)
+		c, err := Initiate(a, testInfoHash, tt.policy)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v", tt.name, err)
+		} else if err == nil && c.Encrypted() != (tt.selected == cryptoRC4) {
+			t.Errorf("%s: encrypted is %v", tt.name, c.Encrypted())
+		}
+		a.Close()
+		b.Close()
+	}
+}
@@ -0,0 +1,145 @@
+package p2p
+
+import (
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// number of peers unchoked for their rate, on top of the optimistic unchoke
+const regularUnchokeSlots = 3
+
+const chokeInterval = 10 * time.Second
+
+// the optimistic unchoke moves to another peer every third round (30 seconds)
+const optimisticUnchokeRounds = 3
+
+// rateSample remembers a peer's byte counters from the previous round.
+type rateSample struct {
+	downloaded uint64
+	uploaded   uint64
+	rate       float64
+}
+
+// runChoker decides every chokeInterval which peers get unchoked: the
+// regularUnchokeSlots interested peers we download from fastest (upload to
+// fastest once we are seeding), plus one rotating optimistic unchoke so new
+// peers get a chance to prove themselves.
+func (t *Torrent) runChoker() {
+	ticker := time.NewTicker(chokeInterval)
+	defer ticker.Stop()
+
+	samples := make(map[*peerConn]*rateSample)
+	var optimistic *peerConn
+	round := 0
+
+	for {
+		rotate := false
+		select {
+		case <-ticker.C:
+			round++
+			rotate = round%optimisticUnchokeRounds == 0
+			t.updateRates(samples)
+		case <-t.rechoke:
+		case <-t.done:
+			return
+		}
+		optimistic = t.chokeRound(samples, optimistic, rotate)
+	}
+}
+
+func (t *Torrent) updateRates(samples map[*peerConn]*rateSample) {
+	seeding := t.isComplete()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for pc := range samples {
+		if _, ok := t.conns[pc]; !ok {
+			delete(samples, pc)
+		}
+	}
+	for pc := range t.conns {
+		s, ok := samples[pc]
+		if !ok {
+			s = &rateSample{}
+			samples[pc] = s
+		}
+		downloaded := atomic.LoadUint64(&pc.downloaded)
+		uploaded := atomic.LoadUint64(&pc.uploaded)
+		if seeding {
+			s.rate = float64(uploaded-s.uploaded) / chokeInterval.Seconds()
+		} else {
+			s.rate = float64(downloaded-s.downloaded) / chokeInterval.Seconds()
+		}
+		s.downloaded = downloaded
+		s.uploaded = uploaded
+	}
+}
+
+func (t *Torrent) chokeRound(samples map[*peerConn]*rateSample, optimistic *peerConn, rotate bool) *peerConn {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var interested []*peerConn
+	for pc := range t.conns {
+		if pc.peerInterested {
+			interested = append(interested, pc)
+		}
+	}
+	rate := func(pc *peerConn) float64 {
+		if s, ok := samples[pc]; ok {
+			return s.rate
+		}
+		return 0
+	}
+	sort.Slice(interested, func(i, j int) bool {
+		return rate(interested[i]) > rate(interested[j])
+	})
+
+	unchoke := make(map[*peerConn]bool)
+	for i := 0; i < len(interested) && i < regularUnchokeSlots; i++ {
+		unchoke[interested[i]] = true
+	}
+
+	if _, ok := t.conns[optimistic]; !ok || !optimistic.peerInterested || unchoke[optimistic] {
+		rotate = true
+	}
+	if rotate {
+		optimistic = nil
+		var choked []*peerConn
+		for _, pc := range interested {
+			if !unchoke[pc] {
+				choked = append(choked, pc)
+			}
+		}
+		if len(choked) > 0 {
+			optimistic = choked[rand.Intn(len(choked))]
+		}
+	}
+	if optimistic != nil {
+		unchoke[optimistic] = true
+	}
+
+	for pc := range t.conns {
+		want := unchoke[pc]
+		if pc.unchokeWanted == want {
+			continue
+		}
+		pc.unchokeWanted = want
+		select {
+		case pc.chokeUpdate <- struct{}{}:
+		default:
+		}
+	}
+	return optimistic
+}
+
+// signalRechoke asks the choker for an extra round, e.g. because a peer
+// became interested and might fill a free slot.
+func (t *Torrent) signalRechoke() {
+	select {
+	case t.rechoke <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,162 @@
+package p2p
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/aryanA101a/villi/bitfield"
+	"github.com/aryanA101a/villi/message"
+)
+
+// number of pieces a peer may request from us while choked (BEP 6)
+const allowedFastCount = 10
+
+// allowedFastSet computes the pieces a peer at ip may request while choked,
+// the canonical way of BEP 6 so every client hands out the same set. Only
+// IPv4 peers get one.
+func allowedFastSet(ip net.IP, infoHash [20]byte, numPieces int) []int {
+	ip = ip.To4()
+	if ip == nil || numPieces == 0 {
+		return nil
+	}
+	k := allowedFastCount
+	if k > numPieces {
+		k = numPieces
+	}
+
+	x := make([]byte, 0, 24)
+	x = append(x, ip[0], ip[1], ip[2], 0)
+	x = append(x, infoHash[:]...)
+	seen := make(map[int]bool)
+	var set []int
+	for len(set) < k {
+		h := sha1.Sum(x)
+		x = h[:]
+		for i := 0; i < 5 && len(set) < k; i++ {
+			index := int(binary.BigEndian.Uint32(x[i*4:]) % uint32(numPieces))
+			if !seen[index] {
+				seen[index] = true
+				set = append(set, index)
+			}
+		}
+	}
+	return set
+}
+
+// sendHaves announces our pieces, with have all or have none where the fast
+// extension allows it, followed by the pieces the peer may request while we
+// choke it.
+func (pc *peerConn) sendHaves() error {
+	bf := pc.t.bitfield()
+	empty := true
+	for _, b := range bf {
+		if b != 0 {
+			empty = false
+			break
+		}
+	}
+
+	var err error
+	switch {
+	case pc.c.SupportsFast() && empty:
+		err = pc.c.SendHaveNone()
+	case pc.c.SupportsFast() && pc.t.isComplete():
+		err = pc.c.SendHaveAll()
+	case !empty:
+		err = pc.c.SendBitfield(bf)
+	}
+	if err != nil || !pc.c.SupportsFast() {
+		return err
+	}
+
+	pc.offeredFast = make(bitfield.Bitfield, len(bf))
+	for _, index := range allowedFastSet(pc.c.Peer().IP, pc.t.InfoHash, len(pc.t.PieceHashes)) {
+		pc.offeredFast.SetPiece(index)
+		err := pc.c.SendAllowedFast(index)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handleFast handles the messages of the fast extension.
+func (pc *peerConn) handleFast(msg *message.Message) error {
+	if !pc.c.SupportsFast() {
+		return fmt.Errorf("got %s without the fast extension", msg)
+	}
+
+	switch msg.ID {
+	case message.MsgHaveAll, message.MsgHaveNone:
+		bf := make(bitfield.Bitfield, len(pc.t.Bitfield))
+		if msg.ID == message.MsgHaveAll {
+			for index := range pc.t.PieceHashes {
+				bf.SetPiece(index)
+			}
+		}
+		pc.setBitfield(bf)
+		return pc.updateInterest()
+	case message.MsgReject:
+		index, begin, length, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		req := blockRequest{index, begin, length}
+		if pc.removePending(req) {
+			pc.t.picker.unrequest(pc, []blockRequest{req})
+		}
+	case message.MsgAllowedFast:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		if pc.allowedFast == nil {
+			pc.allowedFast = make(bitfield.Bitfield, len(pc.t.Bitfield))
+		}
+		pc.allowedFast.SetPiece(index)
+		pc.wake = nil
+	case message.MsgSuggest:
+		// suggestions are advisory, the picker goes by rarity
+		_, err := message.ParseHave(msg)
+		return err
+	}
+	return nil
+}
+
+// rejectRequests answers the requests the peer queued with us with rejects,
+// except the allowed fast ones when keepFast is set.
+func (pc *peerConn) rejectRequests(keepFast bool) error {
+	var kept []blockRequest
+	for _, req := range pc.requests {
+		if keepFast && pc.offeredFast.HasPiece(req.index) {
+			kept = append(kept, req)
+			continue
+		}
+		if pc.c.SupportsFast() {
+			err := pc.c.SendReject(req.index, req.begin, req.length)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	pc.requests = kept
+	return nil
+}
+
+// requestable returns the pieces of the peer we may request right now: all
+// of them when it unchoked us, the allowed fast ones otherwise.
+func (pc *peerConn) requestable() bitfield.Bitfield {
+	if !pc.c.Choked {
+		return pc.c.Bitfield
+	}
+	if pc.allowedFast == nil {
+		return nil
+	}
+	bf := make(bitfield.Bitfield, len(pc.c.Bitfield))
+	for i := range bf {
+		bf[i] = pc.c.Bitfield[i] & pc.allowedFast[i]
+	}
+	return bf
+}
@@ -0,0 +1,145 @@
+package p2p
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/aryanA101a/villi/client"
+	"github.com/aryanA101a/villi/mse"
+	"github.com/aryanA101a/villi/utils"
+	"github.com/aryanA101a/villi/utp"
+)
+
+// number of ports after the requested one that Listen falls back to
+const listenPortRange = 8
+
+// Listener accepts inbound peer connections and hands them to the torrent
+// whose info hash they ask for.
+type Listener struct {
+	// Encryption is the MSE policy for inbound peers, set before Serve
+	Encryption mse.Policy
+
+	ln net.Listener
+	// utp shares the port over UDP, nil if it could not be opened
+	utp      *utp.Socket
+	port     uint16
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+}
+
+// Listen opens a TCP listener on port, or on one of the following ports if
+// it is taken. With withUTP it also accepts uTP connections on the same UDP
+// port, when that is free.
+func Listen(port uint16, withUTP bool) (*Listener, error) {
+	var err error
+	for p := port; p <= port+listenPortRange; p++ {
+		var ln net.Listener
+		ln, err = net.Listen("tcp", fmt.Sprintf(":%d", p))
+		if err != nil {
+			continue
+		}
+		l := &Listener{
+			ln:       ln,
+			port:     p,
+			torrents: make(map[[20]byte]*Torrent),
+		}
+		if withUTP {
+			l.utp, err = utp.Listen(fmt.Sprintf(":%d", p))
+			if err != nil {
+				log.Print(utils.BoldRed("Could not listen for uTP connections: ", err), "\n\n")
+			}
+		}
+		return l, nil
+	}
+	return nil, err
+}
+
+// UTP returns the socket uTP connections are accepted on, nil if there is
+// none. Outbound uTP connections are made from it too.
+func (l *Listener) UTP() *utp.Socket {
+	return l.utp
+}
+
+// Port returns the port the listener actually got.
+func (l *Listener) Port() uint16 {
+	return l.port
+}
+
+func (l *Listener) Add(t *Torrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.torrents[t.InfoHash] = t
+}
+
+func (l *Listener) Remove(t *Torrent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.torrents, t.InfoHash)
+}
+
+func (l *Listener) torrent(infoHash [20]byte) *Torrent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.torrents[infoHash]
+}
+
+func (l *Listener) infoHashes() [][20]byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	infoHashes := make([][20]byte, 0, len(l.torrents))
+	for infoHash := range l.torrents {
+		infoHashes = append(infoHashes, infoHash)
+	}
+	return infoHashes
+}
+
+// Serve accepts connections until the listener is closed.
+func (l *Listener) Serve() error {
+	if l.utp != nil {
+		go serve(l.utp, l.handle)
+	}
+	return serve(l.ln, l.handle)
+}
+
+func serve(ln net.Listener, handle func(net.Conn)) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go handle(conn)
+	}
+}
+
+func (l *Listener) handle(conn net.Conn) {
+	ec, err := mse.Accept(conn, l.Encryption, l.infoHashes)
+	if err != nil {
+		log.Print(utils.BoldRed("Rejected inbound connection from ", conn.RemoteAddr(), ": ", err), "\n\n")
+		conn.Close()
+		return
+	}
+
+	var t *Torrent
+	c, err := client.Accept(ec, func(infoHash [20]byte) ([20]byte, bool) {
+		t = l.torrent(infoHash)
+		if t == nil {
+			return [20]byte{}, false
+		}
+		return t.PeerID, true
+	})
+	if err != nil {
+		log.Print(utils.BoldRed("Rejected inbound connection from ", conn.RemoteAddr(), ": ", err), "\n\n")
+		conn.Close()
+		return
+	}
+	t.runPeer(c, false)
+}
+
+func (l *Listener) Close() error {
+	if l.utp != nil {
+		l.utp.Close()
+	}
+	return l.ln.Close()
+}
@@ -0,0 +1,249 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aryanA101a/villi/client"
+	"github.com/aryanA101a/villi/extension"
+	"github.com/aryanA101a/villi/message"
+	"github.com/aryanA101a/villi/peers"
+	"github.com/aryanA101a/villi/utils"
+)
+
+// how long a peer gets to hand over the whole info dictionary
+const metadataTimeout = 30 * time.Second
+
+// client version sent in the extended handshake
+const clientVersion = "villi"
+
+// FetchMetadata downloads the info dictionary of infoHash from the first peer
+// of peerList that has it (BEP 9) and checks it against the info hash.
+func FetchMetadata(peerList []peers.Peer, peerID, infoHash [20]byte, dialer client.Dialer) ([]byte, error) {
+	if len(peerList) == 0 {
+		return nil, fmt.Errorf("no peers to fetch metadata from")
+	}
+
+	results := make(chan []byte)
+	failed := make(chan struct{}, len(peerList))
+	done := make(chan struct{})
+	defer close(done)
+
+	for _, peer := range peerList {
+		go func(peer peers.Peer) {
+			info, err := fetchMetadataFrom(peer, peerID, infoHash, dialer, done)
+			if err != nil {
+				log.Print(utils.BoldRed("Could not get metadata from ", peer.IP, ": ", err), "\n\n")
+				failed <- struct{}{}
+				return
+			}
+			select {
+			case results <- info:
+			case <-done:
+			}
+		}(peer)
+	}
+
+	for range peerList {
+		select {
+		case info := <-results:
+			return info, nil
+		case <-failed:
+		}
+	}
+	return nil, fmt.Errorf("no peer sent the metadata")
+}
+
+func fetchMetadataFrom(peer peers.Peer, peerID, infoHash [20]byte, dialer client.Dialer, done <-chan struct{}) ([]byte, error) {
+	c, err := dialer.Dial(peer, peerID, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Conn.Close()
+	if !c.SupportsExtensions() {
+		return nil, fmt.Errorf("peer does not support extensions")
+	}
+
+	// give up as soon as another peer delivered
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-done:
+			c.Conn.Close()
+		case <-finished:
+		}
+	}()
+
+	c.Conn.SetDeadline(time.Now().Add(metadataTimeout))
+
+	var info []byte
+	var got []bool
+	received := 0
+	verified := false
+	c.RegisterExtension(extension.UTMetadata, func(payload []byte) error {
+		if info == nil {
+			return nil
+		}
+		m, data, err := extension.ParseMetadata(payload)
+		if err != nil {
+			return err
+		}
+		if m.Type == extension.MetadataReject {
+			return fmt.Errorf("peer rejected metadata piece %d", m.Piece)
+		}
+		if m.Type != extension.MetadataData || m.Piece >= len(got) || got[m.Piece] {
+			return nil
+		}
+
+		begin := m.Piece * extension.MetadataPieceSize
+		end := begin + extension.MetadataPieceSize
+		if end > len(info) {
+			end = len(info)
+		}
+		if len(data) != end-begin {
+			return fmt.Errorf("metadata piece %d has length %d, expected %d", m.Piece, len(data), end-begin)
+		}
+		copy(info[begin:], data)
+		got[m.Piece] = true
+		received++
+
+		if received == len(got) {
+			hash := sha1.Sum(info)
+			if !bytes.Equal(hash[:], infoHash[:]) {
+				return fmt.Errorf("metadata does not match infohash %x", infoHash)
+			}
+			verified = true
+		}
+		return nil
+	})
+	err = c.SendExtendedHandshake(extension.Handshake{V: clientVersion})
+	if err != nil {
+		return nil, err
+	}
+
+	for !verified {
+		msg, err := c.Read()
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.MsgExtended {
+			continue
+		}
+		hs, err := c.HandleExtended(msg)
+		if err != nil {
+			return nil, err
+		}
+		if hs == nil || info != nil {
+			continue
+		}
+
+		if c.PeerExtension(extension.UTMetadata) == 0 {
+			return nil, fmt.Errorf("peer does not support %s", extension.UTMetadata)
+		}
+		if hs.MetadataSize <= 0 || hs.MetadataSize > extension.MaxMetadataSize {
+			return nil, fmt.Errorf("invalid metadata size %d", hs.MetadataSize)
+		}
+		info = make([]byte, hs.MetadataSize)
+		got = make([]bool, (hs.MetadataSize+extension.MetadataPieceSize-1)/extension.MetadataPieceSize)
+		for piece := range got {
+			req := extension.Metadata{Type: extension.MetadataRequest, Piece: piece}
+			payload, err := req.Serialize(nil)
+			if err != nil {
+				return nil, err
+			}
+			err = c.SendExtension(extension.UTMetadata, payload)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return info, nil
+}
+
+// sendExtendedHandshake registers the extensions we support for this
+// torrent and tells the peer about them, along with the size of the info
+// dictionary if we can serve it.
+func (pc *peerConn) sendExtendedHandshake() error {
+	if !pc.t.Private {
+		pc.c.RegisterExtension(extension.UTPex, pc.handlePex)
+	}
+	if pc.t.Info != nil {
+		pc.c.RegisterExtension(extension.UTMetadata, pc.handleMetadata)
+	}
+
+	hs := extension.Handshake{
+		P:            int(pc.t.Port),
+		V:            clientVersion,
+		Reqq:         maxRequestQueue,
+		MetadataSize: len(pc.t.Info),
+	}
+	if ip := pc.c.Peer().IP.To4(); ip != nil {
+		hs.YourIP = string(ip)
+	} else if ip := pc.c.Peer().IP.To16(); ip != nil {
+		hs.YourIP = string(ip)
+	}
+	return pc.c.SendExtendedHandshake(hs)
+}
+
+func (pc *peerConn) handleExtended(msg *message.Message) error {
+	hs, err := pc.c.HandleExtended(msg)
+	if err != nil || hs == nil {
+		return err
+	}
+
+	if hs.Reqq > 0 && hs.Reqq < pc.backlog {
+		pc.backlog = hs.Reqq
+	}
+	if !pc.outbound && hs.P > 0 && hs.P <= 65535 {
+		pc.t.mu.Lock()
+		pc.listenPort = uint16(hs.P)
+		pc.t.mu.Unlock()
+	}
+	// tell the peer about the swarm right away, then once a minute
+	return pc.sendPex()
+}
+
+// handleMetadata answers ut_metadata requests.
+func (pc *peerConn) handleMetadata(payload []byte) error {
+	m, _, err := extension.ParseMetadata(payload)
+	if err != nil {
+		return err
+	}
+	if m.Type == extension.MetadataRequest {
+		return pc.serveMetadata(m.Piece)
+	}
+	return nil
+}
+
+// serveMetadata answers a ut_metadata request with a piece of the info
+// dictionary, or rejects it if we do not have that piece.
+func (pc *peerConn) serveMetadata(piece int) error {
+	if pc.c.PeerExtension(extension.UTMetadata) == 0 {
+		return nil
+	}
+
+	info := pc.t.Info
+	res := extension.Metadata{Type: extension.MetadataReject, Piece: piece}
+	var data []byte
+	// checked by count, the offset of a huge piece would overflow
+	if piece >= 0 && piece < (len(info)+extension.MetadataPieceSize-1)/extension.MetadataPieceSize {
+		begin := piece * extension.MetadataPieceSize
+		end := begin + extension.MetadataPieceSize
+		if end > len(info) {
+			end = len(info)
+		}
+		res.Type = extension.MetadataData
+		res.TotalSize = len(info)
+		data = info[begin:end]
+	}
+
+	payload, err := res.Serialize(data)
+	if err != nil {
+		return err
+	}
+	return pc.c.SendExtension(extension.UTMetadata, payload)
+}
@@ -0,0 +1,69 @@
+package p2p
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/aryanA101a/villi/client"
+	"github.com/aryanA101a/villi/extension"
+	"github.com/aryanA101a/villi/message"
+	bencode "github.com/zeebo/bencode"
+)
+
+func TestServeMetadata(t *testing.T) {
+	info := bytes.Repeat([]byte{'d'}, extension.MetadataPieceSize+100)
+	conn, peer := net.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	pc := &peerConn{t: &Torrent{Info: info}, c: &client.Client{Conn: conn}}
+
+	// the peer takes ut_metadata messages as id 3
+	hs := extension.Handshake{M: map[string]int{extension.UTMetadata: 3}}
+	payload, err := hs.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = pc.c.HandleExtended(message.FormatExtended(extension.HandshakeID, payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		piece    int
+		wantType int
+		wantData []byte
+	}{
+		{0, extension.MetadataData, info[:extension.MetadataPieceSize]},
+		{1, extension.MetadataData, info[extension.MetadataPieceSize:]},
+		{2, extension.MetadataReject, nil},
+		{-1, extension.MetadataReject, nil},
+		// its offset overflows to a negative one
+		{1 << 49, extension.MetadataReject, nil},
+	}
+	for _, tt := range tests {
+		errs := make(chan error, 1)
+		go func() { errs <- pc.serveMetadata(tt.piece) }()
+		msg, err := message.Read(peer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatalf("piece %d: %v", tt.piece, err)
+		}
+		id, payload, err := message.ParseExtended(msg)
+		if err != nil || id != 3 {
+			t.Fatalf("piece %d: got extended message %d, %v", tt.piece, id, err)
+		}
+		var m extension.Metadata
+		d := bencode.NewDecoder(bytes.NewReader(payload))
+		err = d.Decode(&m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := payload[d.BytesParsed():]
+		if m.Type != tt.wantType || m.Piece != tt.piece || !bytes.Equal(data, tt.wantData) {
+			t.Errorf("piece %d: got %+v with %d bytes", tt.piece, m, len(data))
+		}
+	}
+}
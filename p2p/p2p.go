@@ -6,11 +6,13 @@ import (
 	"fmt"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/aryanA101a/villi/bitfield"
 	"github.com/aryanA101a/villi/client"
-	"github.com/aryanA101a/villi/message"
 	"github.com/aryanA101a/villi/peers"
+	"github.com/aryanA101a/villi/storage"
 	"github.com/aryanA101a/villi/ui"
 	"github.com/aryanA101a/villi/utils"
 )
@@ -19,6 +21,16 @@ const MaxBlockSize = 16384
 
 const MaxBacklog = 5
 
+// MaxPeers is the number of connections kept per torrent, inbound and
+// outbound together
+const MaxPeers = 50
+
+// how often the resume file is rewritten while downloading
+const resumeInterval = 5 * time.Second
+
+// how long Download waits for a peer when it has none before giving up
+const peerWaitTimeout = 30 * time.Second
+
 type Torrent struct {
 	Peers          []peers.Peer
 	PeerID         [20]byte
@@ -28,6 +40,42 @@ type Torrent struct {
 	Length         uint64
 	Name           string
 	ConnectedPeers int
+	Storage        *storage.Storage
+	Bitfield       bitfield.Bitfield
+	ResumePath     string
+	// Info is the bencoded info dictionary, served to peers that fetch it
+	// with ut_metadata
+	Info []byte
+	// Private torrents do not exchange peers with other peers
+	Private bool
+	// Port is where we accept connections, told to peers so they can pass
+	// it on
+	Port uint16
+	// Dialer connects to the peers we dial
+	Dialer client.Dialer
+
+	initOnce sync.Once
+	stopOnce sync.Once
+	// mu guards ConnectedPeers, Bitfield, conns, connecting, candidates,
+	// known and started, as well as the choking state of each peerConn
+	mu         sync.Mutex
+	conns      map[*peerConn]struct{}
+	connecting int
+	// candidates are peers we know of but did not try yet, known all peers
+	// ever added
+	candidates []peers.Peer
+	known      map[string]struct{}
+	// started is set once Download dials out
+	started      bool
+	picker       *piecePicker
+	results      chan *pieceResult
+	disconnected chan struct{}
+	rechoke      chan struct{}
+	done         chan struct{}
+	// completed is closed once Download verified the last piece
+	completed  chan struct{}
+	uploaded   uint64
+	downloaded uint64
 }
 
 type pieceWork struct {
@@ -41,211 +89,389 @@ type pieceResult struct {
 	buf   []byte
 }
 
-type pieceProgress struct {
-	index      int
-	client     *client.Client
-	buf        []byte
-	downloaded int
-	requested  int
-	backlog    int
+func (t *Torrent) init() {
+	t.initOnce.Do(func() {
+		t.conns = make(map[*peerConn]struct{})
+		t.known = make(map[string]struct{})
+		t.results = make(chan *pieceResult)
+		t.disconnected = make(chan struct{}, 1)
+		t.rechoke = make(chan struct{}, 1)
+		t.done = make(chan struct{})
+		t.completed = make(chan struct{})
+		if t.Bitfield == nil {
+			t.Bitfield = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+		}
+		t.picker = newPiecePicker(t, t.Bitfield)
+		go t.runChoker()
+	})
 }
 
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.Read() //blocking call
-	if err != nil {
-		return err
-	}
-	if msg == nil {
-		return nil
-	}
-
-	switch msg.ID {
-	case message.MsgUnchoke:
-		state.client.Choked = false
-	case message.MsgChoke:
-		state.client.Choked = true
-	case message.MsgHave:
-		index, err := message.ParseHave(msg)
-		if err != nil {
-			return err
-		}
-		state.client.Bitfield.SetPiece(index)
-	case message.MsgPiece:
-		n, err := message.ParsePiece(state.index, state.buf, msg)
-		if err != nil {
-			return err
-		}
-		state.downloaded += n
-		state.backlog--
+func checkIntegrity(pw *pieceWork, buf []byte) error {
+	hash := sha1.Sum(buf)
+	if !bytes.Equal(hash[:], pw.hash[:]) {
+		return fmt.Errorf("Index %d failed integrity check", pw.index)
 	}
 	return nil
 }
 
-func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
-	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
+func (t *Torrent) calculateBoundsForPiece(index uint) (begin uint64, end uint64) {
+	begin = uint64(index) * uint64(t.PieceLength)
+	end = begin + uint64(t.PieceLength)
+	if end > t.Length {
+		end = t.Length
 	}
+	return begin, end
+}
 
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{})
-
-	for state.downloaded < pw.length {
-		if !state.client.Choked {
-			for state.backlog < MaxBacklog && state.requested < pw.length {
-				blockSize := MaxBlockSize
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
-				}
-
-				err := c.SendRequest(pw.index, state.requested, blockSize)
-				if err != nil {
-					return nil, err
-				}
-				state.backlog++
-				state.requested += blockSize
+func (t *Torrent) calculatePieceSize(index uint) int {
+	begin, end := t.calculateBoundsForPiece(index)
+	return int(end - begin)
+}
 
-			}
-		}
-		err := state.readMessage()
-		if err != nil {
-			return nil, err
+// AddPeers hands the torrent more peers to connect to, e.g. from a tracker
+// or from other peers. Peers seen before are ignored.
+func (t *Torrent) AddPeers(list []peers.Peer) {
+	t.init()
+	t.mu.Lock()
+	for _, peer := range list {
+		if _, ok := t.known[peer.String()]; ok {
+			continue
 		}
-
+		t.known[peer.String()] = struct{}{}
+		t.candidates = append(t.candidates, peer)
 	}
-	return state.buf, nil
+	t.mu.Unlock()
+	t.fillConns()
 }
 
-func checkIntegrity(pw *pieceWork, buf []byte) error {
-	hash := sha1.Sum(buf)
-	if !bytes.Equal(hash[:], pw.hash[:]) {
-		return fmt.Errorf("Index %d failed integrity check", pw.index)
+// fillConns dials candidates until MaxPeers connections are open or being
+// opened.
+func (t *Torrent) fillConns() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.started {
+		return
+	}
+	select {
+	case <-t.done:
+		return
+	default:
+	}
+	for len(t.candidates) > 0 && len(t.conns)+t.connecting < MaxPeers {
+		peer := t.candidates[0]
+		t.candidates = t.candidates[1:]
+		t.connecting++
+		go t.connect(peer)
 	}
-	return nil
 }
 
-func (t *Torrent) startDownloadWorker(connectedPeersLock *sync.Mutex, peer peers.Peer, workQuene chan *pieceWork, results chan *pieceResult,timeout chan bool) {
+// connect dials a peer and runs the connection until it ends.
+func (t *Torrent) connect(peer peers.Peer) {
+	c, err := t.Dialer.Dial(peer, t.PeerID, t.InfoHash)
 
-	var c *client.Client
+	t.mu.Lock()
+	t.connecting--
+	t.mu.Unlock()
 
-	c, err := client.New(peer, t.PeerID, t.InfoHash)
 	if err != nil {
-		log.Print(utils.BoldRed("Could not handshake with ",peer.IP," Disconnecting", ))
-		log.Print(utils.BoldRed(err.Error()),"\n\n")
+		log.Print(utils.BoldRed("Could not handshake with ", peer.IP, " Disconnecting"))
+		log.Print(utils.BoldRed(err.Error()), "\n\n")
+		t.fillConns()
+		t.signalDisconnect()
+		return
+	}
+	t.runPeer(c, true)
+}
 
+// runPeer registers a connection that completed its handshake and serves it
+// until it ends.
+func (t *Torrent) runPeer(c *client.Client, outbound bool) {
+	t.init()
+	defer c.Conn.Close()
+
+	pc := newPeerConn(t, c, outbound)
+	if !t.register(pc) {
+		log.Print(utils.BoldRed("Too many peers, dropping ", c.Peer().IP), "\n\n")
 		return
+	}
+	defer t.unregister(pc)
+
+	transport := "TCP"
+	if c.OverUTP() {
+		transport = "uTP"
+	}
+	if c.Encrypted() {
+		transport += ", encrypted"
+	}
+	log.Println(utils.Bold("Completed handshake with ", c.Peer().IP, " (", transport, ")"))
 
+	err := pc.run()
+	if err != nil {
+		log.Print(utils.BoldRed("Disconnecting ", c.Peer().IP, ": ", err), "\n\n")
 	}
+}
 
-	connectedPeersLock.Lock()
+func (t *Torrent) register(pc *peerConn) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.conns) >= MaxPeers {
+		return false
+	}
+	if pc.c.Bitfield == nil {
+		pc.c.Bitfield = make(bitfield.Bitfield, len(t.Bitfield))
+	}
+	t.conns[pc] = struct{}{}
 	t.ConnectedPeers++
-	connectedPeersLock.Unlock()
+	t.picker.addBitfield(pc.c.Bitfield)
+	t.signalRechoke()
+	return true
+}
 
-	defer c.Conn.Close()
-	defer func() {
+func (t *Torrent) unregister(pc *peerConn) {
+	t.picker.unrequest(pc, pc.pending)
 
-		connectedPeersLock.Lock()
-		if t.ConnectedPeers != 0 {
-			t.ConnectedPeers--
-		}
-		connectedPeersLock.Unlock()
+	t.mu.Lock()
+	delete(t.conns, pc)
+	t.ConnectedPeers--
+	t.mu.Unlock()
+	t.picker.removeBitfield(pc.c.Bitfield)
 
-		if t.ConnectedPeers==0{
-			timeout<-true
-		}
-	}()
+	t.signalRechoke()
+	t.fillConns()
+	t.signalDisconnect()
+}
+
+// signalDisconnect wakes up Download so it can notice that no peer is left.
+func (t *Torrent) signalDisconnect() {
+	select {
+	case t.disconnected <- struct{}{}:
+	default:
+	}
+}
 
-	log.Println(utils.Bold("Completed handshake with ",peer.IP ))
+func (t *Torrent) connectedPeers() (connected int, connecting int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ConnectedPeers, t.connecting
+}
 
-	c.SendUnchoke()
-	c.SendInterested()
+func (t *Torrent) hasPiece(index int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Bitfield.HasPiece(index)
+}
 
-	for pw := range workQuene {
-		if !c.Bitfield.HasPiece(pw.index) {
-			workQuene <- pw
-			return
+// isComplete reports whether we have every piece.
+func (t *Torrent) isComplete() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for index := range t.PieceHashes {
+		if !t.Bitfield.HasPiece(index) {
+			return false
 		}
+	}
+	return true
+}
 
-		buf, err := attemptDownloadPiece(c, pw)
-		if err != nil {
-			log.Print(utils.BoldRed("Existing ", err),"\n\n")
-			workQuene <- pw
-			return
-		}
+// bitfield returns a copy of the pieces we have.
+func (t *Torrent) bitfield() bitfield.Bitfield {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bf := make(bitfield.Bitfield, len(t.Bitfield))
+	copy(bf, t.Bitfield)
+	return bf
+}
 
-		err = checkIntegrity(pw, buf)
-		if err != nil {
-			log.Print(utils.BoldRed("Piece #", pw.index,"failed integrity check\n\n"))
-			workQuene <- pw
-			continue
+// broadcastHave tells every connected peer that we have a new piece.
+func (t *Torrent) broadcastHave(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for pc := range t.conns {
+		select {
+		case pc.haves <- index:
+		default:
 		}
-
-		c.SendHave(pw.index)
-		results <- &pieceResult{pw.index, buf}
 	}
+}
 
+// Uploaded returns the number of bytes served to other peers.
+func (t *Torrent) Uploaded() uint64 {
+	return atomic.LoadUint64(&t.uploaded)
 }
 
-func (t *Torrent) calculateBoundsForPiece(index uint) (begin uint64, end uint64) {
-	begin = uint64(index * t.PieceLength)
-	end = begin + uint64(t.PieceLength)
-	if end > t.Length {
-		end = t.Length
+// Downloaded returns the number of piece bytes received from peers.
+func (t *Torrent) Downloaded() uint64 {
+	return atomic.LoadUint64(&t.downloaded)
+}
+
+// Left returns the number of bytes of the pieces we do not have yet.
+func (t *Torrent) Left() uint64 {
+	t.init()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var left uint64
+	for index := range t.PieceHashes {
+		if !t.Bitfield.HasPiece(index) {
+			left += uint64(t.calculatePieceSize(uint(index)))
+		}
 	}
-	return begin, end
+	return left
 }
 
-func (t *Torrent) calculatePieceSize(index uint) int {
-	begin, end := t.calculateBoundsForPiece(index)
-	return int(end - begin)
+// Completed is closed once Download verified the last piece. It stays open
+// if every piece was on disk to begin with.
+func (t *Torrent) Completed() <-chan struct{} {
+	t.init()
+	return t.completed
 }
 
-func (t *Torrent) Download() ([]byte, error) {
+func (t *Torrent) Download() error {
+	t.init()
 	log.Println(utils.Bold("Starting download for", t.Name))
-	// timeout := make(chan bool, 1)
-	workQuene := make(chan *pieceWork, len(t.PieceHashes))
-	results := make(chan *pieceResult)
-	timeout := make(chan bool)
 
-	for index, hash := range t.PieceHashes {
-		length := t.calculatePieceSize(uint(index))
-		workQuene <- &pieceWork{index, hash, length}
+	// dial every peer we know of, and those found later on, even when there
+	// is nothing left to download, so seeders reach out to leechers too
+	t.mu.Lock()
+	t.started = true
+	t.mu.Unlock()
+	t.AddPeers(t.Peers)
+
+	donePieces := 0
+	var downloaded uint64
+	for index := range t.PieceHashes {
+		if t.hasPiece(index) {
+			donePieces++
+			downloaded += uint64(t.calculatePieceSize(uint(index)))
+		}
+	}
+	if donePieces == len(t.PieceHashes) {
+		log.Println(utils.Bold("All pieces of ", t.Name, " are already on disk"))
+		ui.UpdateUI(ui.Progress{Ratio: 1, Downloaded: downloaded})
+		return nil
 	}
-	var connectedPeersLock sync.Mutex
-	for _, peer := range t.Peers {
-		go t.startDownloadWorker(&connectedPeersLock, peer, workQuene, results,timeout)
+	if donePieces > 0 {
+		log.Println(utils.Bold("Resuming with ", donePieces, " of ", len(t.PieceHashes), " pieces on disk"))
+		ui.UpdateUI(ui.Progress{
+			Ratio:      float64(donePieces) / float64(len(t.PieceHashes)),
+			Downloaded: downloaded,
+		})
 	}
 
-	buf := make([]byte, t.Length)
-	donePieces := 0
+	lastSave := time.Now()
+	defer t.saveResume()
+
+	// peers may still turn up through LSD, the DHT or PEX, so we give up
+	// only once we have been without any for peerWaitTimeout
+	peerWait := time.NewTimer(peerWaitTimeout)
+	defer peerWait.Stop()
+
 	for donePieces < len(t.PieceHashes) {
 
 		var res *pieceResult
 		select {
-		case r := <-results:
+		case r := <-t.results:
 			res = r
-		case <-timeout:
-			return nil,fmt.Errorf("all peers disconnected")
+		case <-t.disconnected:
+			if connected, connecting := t.connectedPeers(); connected == 0 && connecting == 0 {
+				if !peerWait.Stop() {
+					select {
+					case <-peerWait.C:
+					default:
+					}
+				}
+				peerWait.Reset(peerWaitTimeout)
+			}
+			continue
+		case <-peerWait.C:
+			if connected, connecting := t.connectedPeers(); connected == 0 && connecting == 0 {
+				return fmt.Errorf("no peers to download from")
+			}
+			continue
+		case <-t.done:
+			return fmt.Errorf("download stopped")
 		}
 
-		begin, end := t.calculateBoundsForPiece(uint(res.index))
-		copy(buf[begin:end], res.buf)
+		err := t.Storage.WritePiece(res.index, res.buf)
+		if err != nil {
+			return err
+		}
+		t.mu.Lock()
+		t.Bitfield.SetPiece(res.index)
+		t.mu.Unlock()
+		t.broadcastHave(res.index)
 		donePieces++
+		downloaded += uint64(len(res.buf))
 
-		ratio := float64(donePieces) / float64(len(t.PieceHashes))
-		downloaded := uint64(donePieces) * uint64(t.PieceLength)
-		if donePieces == len(t.PieceHashes) {
-			downloaded = (downloaded - uint64(t.PieceLength)) + uint64(t.calculatePieceSize(uint(len(t.PieceHashes)-1)))
+		if time.Since(lastSave) > resumeInterval {
+			t.saveResume()
+			lastSave = time.Now()
 		}
+
+		connected, _ := t.connectedPeers()
+		ratio := float64(donePieces) / float64(len(t.PieceHashes))
 		ui.UpdateUI(ui.Progress{
 			Ratio:      ratio,
 			Downloaded: downloaded,
 		})
-		ui.UpdateUI(ui.ConnectedPeers(t.ConnectedPeers))
+		ui.UpdateUI(ui.ConnectedPeers(connected))
 
-		log.Println(utils.Bold(fmt.Sprintf("(%0.2f%%) Downloaded piece %d from %d peers\n", ratio*100, res.index, t.ConnectedPeers)))
+		log.Println(utils.Bold(fmt.Sprintf("(%0.2f%%) Downloaded piece %d from %d peers\n", ratio*100, res.index, connected)))
+	}
+	close(t.completed)
+	return nil
+}
+
+// Seed keeps serving peers once the download is complete, until the upload
+// ratio reaches ratio or seedTime has passed, whichever comes first. A zero
+// value disables that limit; with both disabled Seed returns only after Stop.
+func (t *Torrent) Seed(ratio float64, seedTime time.Duration) {
+	t.init()
+	log.Println(utils.Bold("Seeding ", t.Name))
+
+	var deadline <-chan time.Time
+	if seedTime > 0 {
+		timer := time.NewTimer(seedTime)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			uploaded := t.Uploaded()
+			connected, _ := t.connectedPeers()
+			ui.UpdateUI(ui.Uploaded(uploaded))
+			ui.UpdateUI(ui.ConnectedPeers(connected))
+			if ratio > 0 && float64(uploaded) >= ratio*float64(t.Length) {
+				log.Println(utils.Bold("Reached seed ratio ", ratio))
+				return
+			}
+		case <-deadline:
+			log.Println(utils.Bold("Reached seed time ", seedTime))
+			return
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// Stop disconnects all peers and ends Download or Seed.
+func (t *Torrent) Stop() {
+	t.init()
+	t.stopOnce.Do(func() {
+		close(t.done)
+	})
+}
+
+// saveResume persists the completed pieces so a restart can skip them.
+func (t *Torrent) saveResume() {
+	if t.ResumePath == "" {
+		return
+	}
+	err := t.Storage.SaveResume(t.ResumePath, t.InfoHash, t.bitfield())
+	if err != nil {
+		log.Print(utils.BoldRed("Could not save resume data: ", err), "\n\n")
 	}
-	close(workQuene)
-	return buf, nil
 }
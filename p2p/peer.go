@@ -0,0 +1,444 @@
+package p2p
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/aryanA101a/villi/bitfield"
+	"github.com/aryanA101a/villi/client"
+	"github.com/aryanA101a/villi/message"
+	"github.com/aryanA101a/villi/utils"
+)
+
+// largest block we serve, peers asking for more get disconnected
+const maxRequestLength = 128 * 1024
+
+// number of block requests a peer may queue with us
+const maxRequestQueue = 250
+
+// time a peer gets to deliver a requested block before it is dropped and its
+// requests go to other peers
+const requestTimeout = 30 * time.Second
+
+const keepAliveInterval = 2 * time.Minute
+
+type blockRequest struct {
+	index  int
+	begin  int
+	length int
+}
+
+// peerConn is the state of one connection, driven by a single goroutine in
+// run. Incoming messages are read by readLoop and handed over on msgs.
+type peerConn struct {
+	t      *Torrent
+	c      *client.Client
+	msgs   chan *message.Message
+	errs   chan error
+	haves  chan int
+	closed chan struct{}
+	// chokeUpdate is signalled when the choker changed unchokeWanted
+	chokeUpdate chan struct{}
+	// cancels carries requests of ours that another peer already answered
+	cancels chan blockRequest
+
+	amInterested bool
+	// wake is closed when the picker may have something for us again
+	wake <-chan struct{}
+	// amChoking is what we last told the peer
+	amChoking bool
+	// peerInterested and unchokeWanted are shared with the choker and
+	// guarded by t.mu
+	peerInterested bool
+	unchokeWanted  bool
+	// pending are the blocks we requested from the peer, requests the ones
+	// it requested from us
+	pending   []blockRequest
+	requests  []blockRequest
+	snubTimer *time.Timer
+	// outbound is set if we dialed the peer
+	outbound bool
+	// listenPort is where an inbound peer accepts connections, zero if it
+	// did not tell; guarded by t.mu
+	listenPort uint16
+	// backlog is how many requests we keep in flight, at most the queue
+	// length the peer told us in its extended handshake
+	backlog int
+	// pexSent are the peers we told the peer about with ut_pex
+	pexSent map[string]pexPeer
+	// allowedFast are the pieces the peer lets us request while it chokes
+	// us, offeredFast the ones we let it request (BEP 6)
+	allowedFast bitfield.Bitfield
+	offeredFast bitfield.Bitfield
+	// byte counters read by the choker, accessed atomically
+	downloaded uint64
+	uploaded   uint64
+}
+
+func newPeerConn(t *Torrent, c *client.Client, outbound bool) *peerConn {
+	return &peerConn{
+		t:        t,
+		c:        c,
+		outbound: outbound,
+		msgs:     make(chan *message.Message, 16),
+		errs:     make(chan error, 1),
+		haves:    make(chan int, len(t.PieceHashes)),
+		closed:   make(chan struct{}),
+
+		chokeUpdate: make(chan struct{}, 1),
+		cancels:     make(chan blockRequest, 2*MaxBacklog),
+		amChoking:   true,
+		backlog:     MaxBacklog,
+		snubTimer:   time.NewTimer(requestTimeout),
+		pexSent:     make(map[string]pexPeer),
+	}
+}
+
+func (pc *peerConn) readLoop() {
+	for {
+		msg, err := pc.c.Read() //blocking call
+		if err != nil {
+			pc.errs <- err
+			return
+		}
+		select {
+		case pc.msgs <- msg:
+		case <-pc.closed:
+			return
+		}
+	}
+}
+
+func (pc *peerConn) run() error {
+	go pc.readLoop()
+	defer close(pc.closed)
+
+	err := pc.sendHaves()
+	if err != nil {
+		return err
+	}
+	if pc.c.SupportsExtensions() {
+		err := pc.sendExtendedHandshake()
+		if err != nil {
+			return err
+		}
+	}
+	err = pc.updateInterest()
+	if err != nil {
+		return err
+	}
+
+	keepAlive := time.NewTicker(keepAliveInterval)
+	defer keepAlive.Stop()
+	pex := time.NewTicker(pexInterval)
+	defer pex.Stop()
+	defer pc.snubTimer.Stop()
+
+	// ready is always ready, serving a queued upload is one more case of the
+	// select below, picked at random among the ready ones, so a peer keeping
+	// its queue full does not keep chokes, cancels or Stop from being seen
+	ready := make(chan struct{})
+	close(ready)
+
+	for {
+		err := pc.requestBlocks()
+		if err != nil {
+			return err
+		}
+
+		var snubbed <-chan time.Time
+		if len(pc.pending) > 0 {
+			snubbed = pc.snubTimer.C
+		}
+		var upload <-chan struct{}
+		if len(pc.requests) > 0 {
+			upload = ready
+		}
+
+		select {
+		case <-upload:
+			err = pc.serveRequest()
+		case msg := <-pc.msgs:
+			err = pc.handleMessage(msg)
+		case err = <-pc.errs:
+		case index := <-pc.haves:
+			err = pc.c.SendHave(index)
+			if err == nil {
+				err = pc.updateInterest()
+			}
+		case <-pc.wake:
+			pc.wake = nil
+		case <-pc.chokeUpdate:
+			err = pc.applyChoke()
+		case req := <-pc.cancels:
+			err = pc.cancel(req)
+		case <-snubbed:
+			err = fmt.Errorf("no block received in %s", requestTimeout)
+		case <-keepAlive.C:
+			err = pc.c.SendKeepAlive()
+		case <-pex.C:
+			err = pc.sendPex()
+		case <-pc.t.done:
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (pc *peerConn) handleMessage(msg *message.Message) error {
+	if msg == nil {
+		return nil
+	}
+
+	switch msg.ID {
+	case message.MsgUnchoke:
+		pc.c.Choked = false
+		pc.wake = nil
+	case message.MsgChoke:
+		pc.c.Choked = true
+		// without the fast extension the peer silently drops our
+		// outstanding requests when it chokes us, with it every dropped
+		// request is rejected
+		if !pc.c.SupportsFast() {
+			pc.t.picker.unrequest(pc, pc.pending)
+			pc.pending = nil
+		}
+	case message.MsgInterested:
+		pc.setPeerInterested(true)
+	case message.MsgNotInterested:
+		pc.setPeerInterested(false)
+	case message.MsgHave:
+		index, err := message.ParseHave(msg)
+		if err != nil {
+			return err
+		}
+		if !pc.c.Bitfield.HasPiece(index) {
+			pc.c.Bitfield.SetPiece(index)
+			pc.t.picker.addHave(index)
+		}
+		pc.wake = nil
+		return pc.updateInterest()
+	case message.MsgBitfield:
+		if len(msg.Payload) != len(pc.t.Bitfield) {
+			return fmt.Errorf("expected bitfield of length %d, got %d", len(pc.t.Bitfield), len(msg.Payload))
+		}
+		pc.setBitfield(msg.Payload)
+		return pc.updateInterest()
+	case message.MsgHaveAll, message.MsgHaveNone, message.MsgReject, message.MsgAllowedFast, message.MsgSuggest:
+		return pc.handleFast(msg)
+	case message.MsgRequest:
+		index, begin, length, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		if length > maxRequestLength {
+			return fmt.Errorf("requested block of %d bytes", length)
+		}
+		if index < 0 || index >= len(pc.t.PieceHashes) || begin+length > pc.t.calculatePieceSize(uint(index)) {
+			return fmt.Errorf("request %d+%d past the end of piece %d", begin, length, index)
+		}
+		choked := pc.amChoking && !pc.offeredFast.HasPiece(index)
+		if choked || len(pc.requests) >= maxRequestQueue || !pc.t.hasPiece(index) {
+			if pc.c.SupportsFast() {
+				return pc.c.SendReject(index, begin, length)
+			}
+			return nil
+		}
+		pc.requests = append(pc.requests, blockRequest{index, begin, length})
+	case message.MsgCancel:
+		index, begin, length, err := message.ParseRequest(msg)
+		if err != nil {
+			return err
+		}
+		for i, req := range pc.requests {
+			if req == (blockRequest{index, begin, length}) {
+				pc.requests = append(pc.requests[:i], pc.requests[i+1:]...)
+				if pc.c.SupportsFast() {
+					return pc.c.SendReject(index, begin, length)
+				}
+				break
+			}
+		}
+	case message.MsgExtended:
+		return pc.handleExtended(msg)
+	case message.MsgPiece:
+		index, begin, data, err := message.ParseBlock(msg)
+		if err != nil {
+			return err
+		}
+		pc.removePending(blockRequest{index, begin, len(data)})
+		atomic.AddUint64(&pc.downloaded, uint64(len(data)))
+		atomic.AddUint64(&pc.t.downloaded, uint64(len(data)))
+		resetTimer(pc.snubTimer, requestTimeout)
+		pc.wake = nil
+
+		ap, cancels := pc.t.picker.receive(pc, index, begin, data)
+		pc.t.sendCancels(cancels)
+		if ap != nil {
+			pc.finishPiece(ap)
+		}
+	}
+	return nil
+}
+
+// setBitfield replaces the pieces the peer has.
+func (pc *peerConn) setBitfield(bf bitfield.Bitfield) {
+	pc.t.picker.removeBitfield(pc.c.Bitfield)
+	pc.c.Bitfield = bf
+	pc.t.picker.addBitfield(pc.c.Bitfield)
+	pc.wake = nil
+}
+
+func (pc *peerConn) setPeerInterested(interested bool) {
+	pc.t.mu.Lock()
+	changed := pc.peerInterested != interested
+	pc.peerInterested = interested
+	pc.t.mu.Unlock()
+	if changed {
+		pc.t.signalRechoke()
+	}
+}
+
+// applyChoke sends the choke or unchoke the choker decided on. Choking a
+// peer drops the requests it queued with us, but for allowed fast ones.
+func (pc *peerConn) applyChoke() error {
+	pc.t.mu.Lock()
+	unchoke := pc.unchokeWanted
+	pc.t.mu.Unlock()
+
+	if unchoke && pc.amChoking {
+		pc.amChoking = false
+		return pc.c.SendUnchoke()
+	}
+	if !unchoke && !pc.amChoking {
+		pc.amChoking = true
+		err := pc.c.SendChoke()
+		if err != nil {
+			return err
+		}
+		return pc.rejectRequests(true)
+	}
+	return nil
+}
+
+// updateInterest tells the peer whether it has pieces we still need.
+func (pc *peerConn) updateInterest() error {
+	interested := false
+	have := pc.t.bitfield()
+	for index := range pc.t.PieceHashes {
+		if pc.c.Bitfield.HasPiece(index) && !have.HasPiece(index) {
+			interested = true
+			break
+		}
+	}
+	if interested == pc.amInterested {
+		return nil
+	}
+	pc.amInterested = interested
+	if interested {
+		return pc.c.SendInterested()
+	}
+	return pc.c.SendNotInterested()
+}
+
+// requestBlocks keeps up to pc.backlog block requests in flight, as handed
+// out by the picker. While choked only allowed fast pieces are requested. If
+// the picker has nothing for us, pc.wake tells when to ask again.
+func (pc *peerConn) requestBlocks() error {
+	bf := pc.requestable()
+	for len(pc.pending) < pc.backlog && pc.amInterested && bf != nil && pc.wake == nil {
+		req, ok, wake := pc.t.picker.nextBlock(pc, bf)
+		if !ok {
+			pc.wake = wake
+			return nil
+		}
+		if len(pc.pending) == 0 {
+			resetTimer(pc.snubTimer, requestTimeout)
+		}
+		pc.pending = append(pc.pending, req)
+		err := pc.c.SendRequest(req.index, req.begin, req.length)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pc *peerConn) removePending(req blockRequest) bool {
+	for i, p := range pc.pending {
+		if p == req {
+			pc.pending = append(pc.pending[:i], pc.pending[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// cancel withdraws a request that was answered by another peer.
+func (pc *peerConn) cancel(req blockRequest) error {
+	if !pc.removePending(req) {
+		return nil
+	}
+	return pc.c.SendCancel(req.index, req.begin, req.length)
+}
+
+// sendCancels passes cancel orders on to the peers they are meant for. If a
+// peer is too far behind the order is dropped, the block then simply
+// arrives twice.
+func (t *Torrent) sendCancels(cancels []cancelOrder) {
+	for _, c := range cancels {
+		select {
+		case c.pc.cancels <- c.req:
+		default:
+		}
+	}
+}
+
+// finishPiece verifies a piece whose blocks have all arrived and hands it
+// over to Download.
+func (pc *peerConn) finishPiece(ap *activePiece) {
+	err := checkIntegrity(ap.work, ap.buf)
+	if err != nil {
+		log.Print(utils.BoldRed("Piece #", ap.work.index, "failed integrity check\n\n"))
+		pc.t.sendCancels(pc.t.picker.release(ap.work.index))
+		return
+	}
+	pc.t.picker.finish(ap.work.index)
+
+	select {
+	case pc.t.results <- &pieceResult{ap.work.index, ap.buf}:
+	case <-pc.t.done:
+	}
+}
+
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
+
+func (pc *peerConn) serveRequest() error {
+	req := pc.requests[0]
+	pc.requests = pc.requests[1:]
+
+	block := make([]byte, req.length)
+	_, err := pc.t.Storage.ReadAt(block, int64(req.index)*int64(pc.t.PieceLength)+int64(req.begin))
+	if err != nil {
+		return err
+	}
+	err = pc.c.SendPiece(req.index, req.begin, block)
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&pc.uploaded, uint64(req.length))
+	atomic.AddUint64(&pc.t.uploaded, uint64(req.length))
+	return nil
+}
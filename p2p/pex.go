@@ -0,0 +1,125 @@
+package p2p
+
+import (
+	"time"
+
+	"github.com/aryanA101a/villi/extension"
+	"github.com/aryanA101a/villi/peers"
+)
+
+// how often connected peers are told about changes to our peer set
+const pexInterval = time.Minute
+
+// at most this many added and dropped peers go into one ut_pex message
+const maxPexPeers = 50
+
+type pexPeer struct {
+	peer  peers.Peer
+	flags byte
+}
+
+// pexPeers returns where the peers connected to us, other than except,
+// accept connections. Inbound peers that did not tell us are left out.
+func (t *Torrent) pexPeers(except *peerConn) map[string]pexPeer {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	swarm := make(map[string]pexPeer)
+	for pc := range t.conns {
+		if pc == except {
+			continue
+		}
+		p := pexPeer{peer: pc.c.Peer()}
+		if pc.c.Encrypted() {
+			p.flags |= extension.PexEncryption
+		}
+		if pc.c.OverUTP() {
+			p.flags |= extension.PexUTP
+		}
+		if pc.outbound {
+			p.flags |= extension.PexOutgoing
+		} else if pc.listenPort != 0 {
+			p.peer.Port = pc.listenPort
+		} else {
+			continue
+		}
+		swarm[p.peer.String()] = p
+	}
+	return swarm
+}
+
+// sendPex tells the peer which peers we connected to and dropped since the
+// last time (BEP 11).
+func (pc *peerConn) sendPex() error {
+	if pc.c.PeerExtension(extension.UTPex) == 0 || pc.t.Private {
+		return nil
+	}
+
+	swarm := pc.t.pexPeers(pc)
+	var added, dropped []peers.Peer
+	var flags, flags6 []byte
+	for key, p := range swarm {
+		if len(added) == maxPexPeers {
+			break
+		}
+		if _, ok := pc.pexSent[key]; ok {
+			continue
+		}
+		added = append(added, p.peer)
+		if p.peer.IP.To4() != nil {
+			flags = append(flags, p.flags)
+		} else {
+			flags6 = append(flags6, p.flags)
+		}
+		pc.pexSent[key] = p
+	}
+	for key, p := range pc.pexSent {
+		if len(dropped) == maxPexPeers {
+			break
+		}
+		if _, ok := swarm[key]; ok {
+			continue
+		}
+		dropped = append(dropped, p.peer)
+		delete(pc.pexSent, key)
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		return nil
+	}
+
+	msg := extension.Pex{
+		Added:    string(peers.Marshal(added)),
+		AddedF:   string(flags),
+		Dropped:  string(peers.Marshal(dropped)),
+		Added6:   string(peers.Marshal6(added)),
+		Added6F:  string(flags6),
+		Dropped6: string(peers.Marshal6(dropped)),
+	}
+	payload, err := msg.Serialize()
+	if err != nil {
+		return err
+	}
+	return pc.c.SendExtension(extension.UTPex, payload)
+}
+
+// handlePex passes the peers a ut_pex message added on to the connection
+// manager. Private torrents get their peers from the tracker only.
+func (pc *peerConn) handlePex(payload []byte) error {
+	if pc.t.Private {
+		return nil
+	}
+	msg, err := extension.ParsePex(payload)
+	if err != nil {
+		return err
+	}
+	added, err := peers.Unmarshal([]byte(msg.Added))
+	if err != nil {
+		return err
+	}
+	added6, err := peers.Unmarshal6([]byte(msg.Added6))
+	if err != nil {
+		return err
+	}
+	pc.t.AddPeers(append(added, added6...))
+	return nil
+}
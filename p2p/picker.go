@@ -0,0 +1,360 @@
+package p2p
+
+import (
+	"log"
+	"math/rand"
+	"sync"
+
+	"github.com/aryanA101a/villi/bitfield"
+	"github.com/aryanA101a/villi/utils"
+)
+
+type pieceState uint8
+
+const (
+	pieceNeeded pieceState = iota
+	pieceInProgress
+	pieceDone
+)
+
+type block struct {
+	received bool
+	// peers with an outstanding request for the block, more than one only
+	// in endgame
+	requesters []*peerConn
+}
+
+// activePiece is a piece being downloaded. Its buffer is shared by every
+// peer fetching blocks of it, so a peer that goes away only takes its
+// unfinished blocks with it.
+type activePiece struct {
+	work      *pieceWork
+	buf       []byte
+	blocks    []block
+	received  int
+	requested int
+}
+
+// cancelOrder tells pc to cancel a request that another peer answered.
+type cancelOrder struct {
+	pc  *peerConn
+	req blockRequest
+}
+
+// piecePicker hands out pieces rarest first. It keeps, for every piece, how
+// many connected peers have it, fed from their bitfield and have messages.
+// Once every remaining block has been requested it enters endgame and hands
+// out duplicate requests for blocks still outstanding.
+type piecePicker struct {
+	mu           sync.Mutex
+	t            *Torrent
+	availability []int
+	state        []pieceState
+	needed       int
+	active       map[int]*activePiece
+	// wake is closed (and replaced) whenever there may be new work for idle
+	// peers
+	wake chan struct{}
+}
+
+func newPiecePicker(t *Torrent, have bitfield.Bitfield) *piecePicker {
+	pp := &piecePicker{
+		t:            t,
+		availability: make([]int, len(t.PieceHashes)),
+		state:        make([]pieceState, len(t.PieceHashes)),
+		active:       make(map[int]*activePiece),
+		wake:         make(chan struct{}),
+	}
+	for index := range pp.state {
+		if have.HasPiece(index) {
+			pp.state[index] = pieceDone
+		} else {
+			pp.needed++
+		}
+	}
+	return pp
+}
+
+func (pp *piecePicker) addBitfield(bf bitfield.Bitfield) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for index := range pp.availability {
+		if bf.HasPiece(index) {
+			pp.availability[index]++
+		}
+	}
+}
+
+func (pp *piecePicker) removeBitfield(bf bitfield.Bitfield) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	for index := range pp.availability {
+		if bf.HasPiece(index) {
+			pp.availability[index]--
+		}
+	}
+}
+
+func (pp *piecePicker) addHave(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if index >= 0 && index < len(pp.availability) {
+		pp.availability[index]++
+	}
+}
+
+func (pp *piecePicker) notify() {
+	close(pp.wake)
+	pp.wake = make(chan struct{})
+}
+
+// nextBlock returns the next block pc should request, given the pieces it
+// has. Pieces already in progress come first so they complete quickly, then
+// the rarest piece not started yet. If there is nothing it returns false and
+// a channel that is closed once it is worth asking again.
+func (pp *piecePicker) nextBlock(pc *peerConn, bf bitfield.Bitfield) (blockRequest, bool, <-chan struct{}) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	ap := pp.started(bf)
+	if ap == nil {
+		ap = pp.start(bf)
+	}
+	if ap != nil {
+		for i := range ap.blocks {
+			b := &ap.blocks[i]
+			if !b.received && len(b.requesters) == 0 {
+				b.requesters = append(b.requesters, pc)
+				ap.requested++
+				if pp.isEndgame() {
+					// that was the last unrequested block, idle peers
+					// may now duplicate requests
+					log.Println(utils.Bold("Entering endgame"))
+					pp.notify()
+				}
+				return pp.blockRequest(ap, i), true, nil
+			}
+		}
+	}
+
+	if pp.isEndgame() {
+		if req, ok := pp.duplicate(pc, bf); ok {
+			return req, true, nil
+		}
+	}
+	return blockRequest{}, false, pp.wake
+}
+
+// started returns the piece in progress closest to completion that bf has
+// and that still has unrequested blocks.
+func (pp *piecePicker) started(bf bitfield.Bitfield) *activePiece {
+	var best *activePiece
+	for index, ap := range pp.active {
+		if ap.received+ap.requested == len(ap.blocks) || !bf.HasPiece(index) {
+			continue
+		}
+		if best == nil || ap.received+ap.requested > best.received+best.requested ||
+			ap.received+ap.requested == best.received+best.requested && index < best.work.index {
+			best = ap
+		}
+	}
+	return best
+}
+
+// start begins the rarest needed piece that bf has.
+func (pp *piecePicker) start(bf bitfield.Bitfield) *activePiece {
+	var candidates []int
+	rarest := 0
+	for index, state := range pp.state {
+		if state != pieceNeeded || !bf.HasPiece(index) {
+			continue
+		}
+		avail := pp.availability[index]
+		if len(candidates) == 0 || avail < rarest {
+			candidates = candidates[:0]
+			rarest = avail
+		}
+		if avail == rarest {
+			candidates = append(candidates, index)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	// break ties randomly so peers do not all go for the same piece
+	index := candidates[rand.Intn(len(candidates))]
+	length := pp.t.calculatePieceSize(uint(index))
+	ap := &activePiece{
+		work: &pieceWork{
+			index:  index,
+			hash:   pp.t.PieceHashes[index],
+			length: length,
+		},
+		buf:    make([]byte, length),
+		blocks: make([]block, (length+MaxBlockSize-1)/MaxBlockSize),
+	}
+	pp.state[index] = pieceInProgress
+	pp.needed--
+	pp.active[index] = ap
+	return ap
+}
+
+// isEndgame reports whether every block still missing has been requested.
+func (pp *piecePicker) isEndgame() bool {
+	if pp.needed > 0 || len(pp.active) == 0 {
+		return false
+	}
+	for _, ap := range pp.active {
+		if ap.received+ap.requested < len(ap.blocks) {
+			return false
+		}
+	}
+	return true
+}
+
+// duplicate picks an outstanding block that pc has not requested yet,
+// preferring the ones with the fewest requesters.
+func (pp *piecePicker) duplicate(pc *peerConn, bf bitfield.Bitfield) (blockRequest, bool) {
+	var best *activePiece
+	bestBlock := -1
+	for index, ap := range pp.active {
+		if !bf.HasPiece(index) {
+			continue
+		}
+	blocks:
+		for i, b := range ap.blocks {
+			if b.received {
+				continue
+			}
+			for _, r := range b.requesters {
+				if r == pc {
+					continue blocks
+				}
+			}
+			if best == nil || len(b.requesters) < len(best.blocks[bestBlock].requesters) {
+				best = ap
+				bestBlock = i
+			}
+		}
+	}
+	if best == nil {
+		return blockRequest{}, false
+	}
+	b := &best.blocks[bestBlock]
+	b.requesters = append(b.requesters, pc)
+	return pp.blockRequest(best, bestBlock), true
+}
+
+func (pp *piecePicker) blockRequest(ap *activePiece, i int) blockRequest {
+	begin := i * MaxBlockSize
+	length := MaxBlockSize
+	if ap.work.length-begin < length {
+		length = ap.work.length - begin
+	}
+	return blockRequest{index: ap.work.index, begin: begin, length: length}
+}
+
+// receive stores a block sent by pc. It returns the piece if that block
+// completed it, plus the duplicate requests other peers should cancel.
+func (pp *piecePicker) receive(pc *peerConn, index, begin int, data []byte) (*activePiece, []cancelOrder) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	ap := pp.active[index]
+	if ap == nil || begin%MaxBlockSize != 0 || begin >= ap.work.length {
+		return nil, nil
+	}
+	i := begin / MaxBlockSize
+	req := pp.blockRequest(ap, i)
+	b := &ap.blocks[i]
+	if len(data) != req.length || b.received {
+		pp.dropRequester(ap, i, pc)
+		return nil, nil
+	}
+
+	copy(ap.buf[begin:], data)
+	b.received = true
+	ap.received++
+	var cancels []cancelOrder
+	for _, r := range b.requesters {
+		if r != pc {
+			cancels = append(cancels, cancelOrder{r, req})
+		}
+	}
+	if len(b.requesters) > 0 {
+		ap.requested--
+	}
+	b.requesters = nil
+
+	if ap.received < len(ap.blocks) {
+		return nil, cancels
+	}
+	delete(pp.active, index)
+	return ap, cancels
+}
+
+// unrequest returns the outstanding requests of pc to the pool, e.g. because
+// it choked us or disconnected. Blocks it already delivered are kept.
+func (pp *piecePicker) unrequest(pc *peerConn, reqs []blockRequest) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+
+	for _, req := range reqs {
+		ap := pp.active[req.index]
+		if ap == nil {
+			continue
+		}
+		pp.dropRequester(ap, req.begin/MaxBlockSize, pc)
+	}
+	pp.notify()
+}
+
+func (pp *piecePicker) dropRequester(ap *activePiece, i int, pc *peerConn) {
+	b := &ap.blocks[i]
+	n := len(b.requesters)
+	b.requesters = removePeer(b.requesters, pc)
+	if n > 0 && len(b.requesters) == 0 && !b.received {
+		ap.requested--
+	}
+}
+
+// release puts a piece that failed verification back up for grabs and
+// returns the requests still outstanding for it.
+func (pp *piecePicker) release(index int) []cancelOrder {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	if pp.state[index] != pieceInProgress {
+		return nil
+	}
+
+	var cancels []cancelOrder
+	if ap := pp.active[index]; ap != nil {
+		for i, b := range ap.blocks {
+			for _, r := range b.requesters {
+				cancels = append(cancels, cancelOrder{r, pp.blockRequest(ap, i)})
+			}
+		}
+		delete(pp.active, index)
+	}
+	pp.state[index] = pieceNeeded
+	pp.needed++
+	pp.notify()
+	return cancels
+}
+
+// finish marks a verified piece as done.
+func (pp *piecePicker) finish(index int) {
+	pp.mu.Lock()
+	defer pp.mu.Unlock()
+	pp.state[index] = pieceDone
+}
+
+func removePeer(peers []*peerConn, pc *peerConn) []*peerConn {
+	for i, r := range peers {
+		if r == pc {
+			return append(peers[:i], peers[i+1:]...)
+		}
+	}
+	return peers
+}
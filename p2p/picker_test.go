@@ -0,0 +1,219 @@
+package p2p
+
+import (
+	"testing"
+
+	"github.com/aryanA101a/villi/bitfield"
+)
+
+// newTestPicker returns a picker for a torrent of numPieces pieces of
+// pieceLength bytes, the last one lastLength bytes, none of them had yet.
+func newTestPicker(numPieces, pieceLength, lastLength int) *piecePicker {
+	t := &Torrent{
+		PieceHashes: make([][20]byte, numPieces),
+		PieceLength: uint(pieceLength),
+		Length:      uint64((numPieces-1)*pieceLength + lastLength),
+	}
+	return newPiecePicker(t, make(bitfield.Bitfield, (numPieces+7)/8))
+}
+
+// pieces returns a bitfield of a torrent of up to 16 pieces with the given
+// ones set.
+func pieces(indexes ...int) bitfield.Bitfield {
+	bf := make(bitfield.Bitfield, 2)
+	for _, index := range indexes {
+		bf.SetPiece(index)
+	}
+	return bf
+}
+
+func TestRarestFirst(t *testing.T) {
+	tests := []struct {
+		name string
+		bf   bitfield.Bitfield
+		want []int
+	}{
+		{"a peer with everything", pieces(0, 1, 2, 3, 4), []int{4, 3, 2, 1, 0}},
+		{"a peer with the common pieces", pieces(0, 1), []int{1, 0}},
+	}
+	for _, tt := range tests {
+		pp := newTestPicker(5, MaxBlockSize, MaxBlockSize)
+		// piece 4 is on nobody else, 3 on one peer, 2 on two and so on
+		pp.addBitfield(pieces(0, 1, 2, 3))
+		pp.addBitfield(pieces(0, 1, 2))
+		pp.addBitfield(pieces(0, 1))
+		pp.addBitfield(pieces(0))
+
+		pc := &peerConn{}
+		var got []int
+		for {
+			req, ok, _ := pp.nextBlock(pc, tt.bf)
+			if !ok {
+				break
+			}
+			got = append(got, req.index)
+		}
+		if !equalInts(got, tt.want) {
+			t.Errorf("%s: pieces picked in order %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRarestFirstHave(t *testing.T) {
+	pp := newTestPicker(3, MaxBlockSize, MaxBlockSize)
+	pp.addBitfield(pieces(0, 1, 2))
+	pp.addBitfield(pieces(1, 2))
+	// a have makes piece 0 as common as 1 and 2, then more common
+	pp.addHave(0)
+	pp.addHave(0)
+	pp.removeBitfield(pieces(2))
+
+	req, ok, _ := pp.nextBlock(&peerConn{}, pieces(0, 1, 2))
+	if !ok || req.index != 2 {
+		t.Fatalf("picked %+v, %v, want piece 2", req, ok)
+	}
+}
+
+func TestStartedPieceFirst(t *testing.T) {
+	// pieces of three blocks
+	pp := newTestPicker(3, 3*MaxBlockSize, 3*MaxBlockSize)
+	pp.addBitfield(pieces(0, 1))
+	pp.addBitfield(pieces(1, 2))
+	pp.addBitfield(pieces(2))
+	pp.addBitfield(pieces(2))
+
+	pc := &peerConn{}
+	bf := pieces(0, 1, 2)
+	// the rarest piece, 0, is finished before anything else is started
+	want := []blockRequest{
+		{0, 0, MaxBlockSize},
+		{0, MaxBlockSize, MaxBlockSize},
+		{0, 2 * MaxBlockSize, MaxBlockSize},
+		{1, 0, MaxBlockSize},
+	}
+	for i, w := range want {
+		req, ok, _ := pp.nextBlock(pc, bf)
+		if !ok || req != w {
+			t.Fatalf("request %d is %+v, want %+v", i, req, w)
+		}
+	}
+	// another peer helps with the started piece
+	req, _, _ := pp.nextBlock(&peerConn{}, bf)
+	if want := (blockRequest{1, MaxBlockSize, MaxBlockSize}); req != want {
+		t.Errorf("second peer got %+v, want %+v", req, want)
+	}
+}
+
+func TestLastBlockLength(t *testing.T) {
+	pp := newTestPicker(1, 2*MaxBlockSize, MaxBlockSize+100)
+	pp.addBitfield(pieces(0))
+	pc := &peerConn{}
+
+	var got []blockRequest
+	for i := 0; i < 2; i++ {
+		req, ok, _ := pp.nextBlock(pc, pieces(0))
+		if !ok {
+			t.Fatalf("no block %d", i)
+		}
+		got = append(got, req)
+	}
+	want := []blockRequest{{0, 0, MaxBlockSize}, {0, MaxBlockSize, 100}}
+	if got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got requests %+v, want %+v", got, want)
+	}
+}
+
+func TestEndgameCancels(t *testing.T) {
+	pp := newTestPicker(1, 2*MaxBlockSize, 2*MaxBlockSize)
+	bf := pieces(0)
+	pp.addBitfield(bf)
+	pp.addBitfield(bf)
+	a, b := &peerConn{}, &peerConn{}
+	block0 := blockRequest{0, 0, MaxBlockSize}
+	block1 := blockRequest{0, MaxBlockSize, MaxBlockSize}
+
+	// a asks for both blocks, which starts endgame
+	for _, want := range []blockRequest{block0, block1} {
+		req, ok, _ := pp.nextBlock(a, bf)
+		if !ok || req != want {
+			t.Fatalf("a got %+v, %v, want %+v", req, ok, want)
+		}
+	}
+	if !pp.isEndgame() {
+		t.Fatal("not in endgame with every block requested")
+	}
+	if _, ok, _ := pp.nextBlock(a, bf); ok {
+		t.Fatal("a got a block it already asked for")
+	}
+
+	// b duplicates both requests
+	var dups []blockRequest
+	for i := 0; i < 2; i++ {
+		req, ok, _ := pp.nextBlock(b, bf)
+		if !ok {
+			t.Fatalf("b got no duplicate %d", i)
+		}
+		dups = append(dups, req)
+	}
+	if dups[0] == dups[1] {
+		t.Fatalf("b got the same duplicate twice: %+v", dups[0])
+	}
+	if _, ok, _ := pp.nextBlock(b, bf); ok {
+		t.Fatal("b got a third request")
+	}
+
+	// whoever answers first has the other one cancel
+	data := make([]byte, MaxBlockSize)
+	ap, cancels := pp.receive(b, 0, 0, data)
+	if ap != nil {
+		t.Fatal("piece complete after one block")
+	}
+	if len(cancels) != 1 || cancels[0].pc != a || cancels[0].req != block0 {
+		t.Errorf("cancels after b delivered block 0: %+v, want a's", cancels)
+	}
+	ap, cancels = pp.receive(a, 0, MaxBlockSize, data)
+	if ap == nil || ap.received != 2 {
+		t.Fatal("piece not complete after both blocks")
+	}
+	if len(cancels) != 1 || cancels[0].pc != b || cancels[0].req != block1 {
+		t.Errorf("cancels after a delivered block 1: %+v, want b's", cancels)
+	}
+
+	// a late duplicate is dropped
+	if ap, cancels := pp.receive(b, 0, MaxBlockSize, data); ap != nil || cancels != nil {
+		t.Errorf("late block gave %v, %+v", ap, cancels)
+	}
+}
+
+func TestUnrequest(t *testing.T) {
+	pp := newTestPicker(1, 2*MaxBlockSize, 2*MaxBlockSize)
+	bf := pieces(0)
+	pp.addBitfield(bf)
+	a, b := &peerConn{}, &peerConn{}
+
+	req, _, _ := pp.nextBlock(a, bf)
+	wake := pp.wake
+	// a chokes us, its block goes to the next peer asking
+	pp.unrequest(a, []blockRequest{req})
+	select {
+	case <-wake:
+	default:
+		t.Error("idle peers not woken")
+	}
+	got, ok, _ := pp.nextBlock(b, bf)
+	if !ok || got != req {
+		t.Errorf("b got %+v, want a's dropped %+v", got, req)
+	}
+}
+
+func equalInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
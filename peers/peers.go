@@ -15,7 +15,7 @@ type Peer struct{
 func Unmarshal(peersBin []byte)([]Peer,error){
 	const peerSize=6
 	numPeers:=len(peersBin)/peerSize
-	if len(peersBin)%numPeers !=0{
+	if len(peersBin)%peerSize !=0{
 		err:= fmt.Errorf("recieved malformed peers")
 		return nil,err
 	}
@@ -28,6 +28,69 @@ func Unmarshal(peersBin []byte)([]Peer,error){
 	return peers,nil
 }
 
+// Marshal encodes peers in the compact form read by Unmarshal. Peers without
+// an IPv4 address are left out.
+func Marshal(peers []Peer) []byte {
+	buf := make([]byte, 0, 6*len(peers))
+	for _, peer := range peers {
+		ip := peer.IP.To4()
+		if ip == nil {
+			continue
+		}
+		buf = append(buf, ip...)
+		buf = append(buf, byte(peer.Port>>8), byte(peer.Port))
+	}
+	return buf
+}
+
+// Unmarshal6 parses compact IPv6 peers (BEP 7), 16 address bytes and a
+// port each.
+func Unmarshal6(peersBin []byte) ([]Peer, error) {
+	const peerSize = 18
+	if len(peersBin)%peerSize != 0 {
+		return nil, fmt.Errorf("received malformed IPv6 peers")
+	}
+	peers := make([]Peer, len(peersBin)/peerSize)
+	for i := range peers {
+		offset := i * peerSize
+		peers[i].IP = net.IP(peersBin[offset : offset+16])
+		peers[i].Port = binary.BigEndian.Uint16(peersBin[offset+16:])
+	}
+	return peers, nil
+}
+
+// Marshal6 encodes the IPv6 peers among peers in the compact form read by
+// Unmarshal6.
+func Marshal6(peers []Peer) []byte {
+	buf := make([]byte, 0, 18*len(peers))
+	for _, peer := range peers {
+		if peer.IP.To4() != nil || len(peer.IP) != net.IPv6len {
+			continue
+		}
+		buf = append(buf, peer.IP...)
+		buf = append(buf, byte(peer.Port>>8), byte(peer.Port))
+	}
+	return buf
+}
+
+// FromAddr returns the peer behind a network address such as the remote end
+// of an accepted connection.
+func FromAddr(addr net.Addr) (Peer, error) {
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return Peer{}, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return Peer{}, fmt.Errorf("invalid peer address %s", addr)
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return Peer{}, err
+	}
+	return Peer{IP: ip, Port: uint16(portNum)}, nil
+}
+
 func (p Peer) String() string{
 	return net.JoinHostPort(p.IP.String(),strconv.Itoa(int(p.Port)))
 }
\ No newline at end of file
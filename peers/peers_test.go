@@ -0,0 +1,143 @@
+package peers
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestUnmarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		bin     []byte
+		want    []string
+		wantErr bool
+	}{
+		// used to divide by the number of peers
+		{"empty", nil, nil, false},
+		{"short", []byte{127, 0, 0, 1, 0x1a}, nil, true},
+		{"one", []byte{127, 0, 0, 1, 0x1a, 0xe1}, []string{"127.0.0.1:6881"}, false},
+		{"two", []byte{192, 0, 2, 1, 0, 80, 10, 0, 0, 2, 0xff, 0xff}, []string{"192.0.2.1:80", "10.0.0.2:65535"}, false},
+		{"one and a half", []byte{192, 0, 2, 1, 0, 80, 10, 0, 0}, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := Unmarshal(tt.bin)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v", tt.name, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i].String() != tt.want[i] {
+				t.Errorf("%s: peer %d is %s, want %s", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestUnmarshal6(t *testing.T) {
+	one := append(net.ParseIP("2001:db8::1").To16(), 0x1a, 0xe1)
+	tests := []struct {
+		name    string
+		bin     []byte
+		want    []string
+		wantErr bool
+	}{
+		{"empty", nil, nil, false},
+		{"short", one[:17], nil, true},
+		{"one", one, []string{"[2001:db8::1]:6881"}, false},
+		{"two", append(append([]byte(nil), one...), one...), []string{"[2001:db8::1]:6881", "[2001:db8::1]:6881"}, false},
+	}
+	for _, tt := range tests {
+		got, err := Unmarshal6(tt.bin)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v", tt.name, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i].String() != tt.want[i] {
+				t.Errorf("%s: peer %d is %s, want %s", tt.name, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	list := []Peer{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 6881},
+		{IP: net.ParseIP("2001:db8::2"), Port: 51413},
+		// 4 byte form of an IPv4 address
+		{IP: net.IP{10, 0, 0, 3}, Port: 1},
+		{IP: net.ParseIP("fe80::3"), Port: 65535},
+	}
+
+	v4 := Marshal(list)
+	if len(v4) != 2*6 {
+		t.Fatalf("Marshal encoded %d bytes, want %d", len(v4), 2*6)
+	}
+	got, err := Unmarshal(v4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPeers(t, got, []Peer{list[0], list[2]})
+
+	v6 := Marshal6(list)
+	if len(v6) != 2*18 {
+		t.Fatalf("Marshal6 encoded %d bytes, want %d", len(v6), 2*18)
+	}
+	got, err = Unmarshal6(v6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPeers(t, got, []Peer{list[1], list[3]})
+
+	if b := Marshal([]Peer{{IP: net.IPv4(1, 2, 3, 4), Port: 0x0102}}); !bytes.Equal(b, []byte{1, 2, 3, 4, 1, 2}) {
+		t.Errorf("Marshal encoded %x, want the port big-endian", b)
+	}
+	// nothing of either family encodes to nothing
+	if b := Marshal(nil); len(b) != 0 {
+		t.Errorf("Marshal(nil) = %x", b)
+	}
+	if b := Marshal6([]Peer{list[0]}); len(b) != 0 {
+		t.Errorf("Marshal6 of an IPv4 peer = %x", b)
+	}
+}
+
+func checkPeers(t *testing.T, got, want []Peer) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range got {
+		if !got[i].IP.Equal(want[i].IP) || got[i].Port != want[i].Port {
+			t.Errorf("peer %d is %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestFromAddr(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want Peer
+	}{
+		{&net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 6881}, Peer{IP: net.IPv4(192, 0, 2, 1), Port: 6881}},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 80}, Peer{IP: net.ParseIP("2001:db8::1"), Port: 80}},
+	}
+	for _, tt := range tests {
+		got, err := FromAddr(tt.addr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.addr, err)
+			continue
+		}
+		if !got.IP.Equal(tt.want.IP) || got.Port != tt.want.Port {
+			t.Errorf("%s: got %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/aryanA101a/villi/torrentfile"
+	"github.com/aryanA101a/villi/utils"
+)
+
+// exit codes of `villi scrape`
+const (
+	scrapeAnswered   = 0
+	scrapeUnanswered = 1
+	scrapeError      = 2
+)
+
+func runScrape(args []string) int {
+	fs := flag.NewFlagSet("scrape", flag.ExitOnError)
+	timeoutFlag := fs.Duration("timeout", 30*time.Second, "How long each tracker gets to answer")
+	fs.Usage = func() {
+		fmt.Print(scrapeUsageText)
+	}
+	args = parseArgs(fs, args)
+	if len(args) != 1 {
+		fs.Usage()
+		return scrapeError
+	}
+
+	var tf torrentfile.TorrentFile
+	var err error
+	if torrentfile.IsMagnet(args[0]) {
+		tf, err = torrentfile.OpenMagnet(args[0])
+	} else {
+		tf, err = torrentfile.Open(args[0], ".")
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, utils.BoldRed(err))
+		return scrapeError
+	}
+	if len(tf.Announce) == 0 {
+		fmt.Fprintln(os.Stderr, utils.BoldRed(tf.Name, " has no trackers"))
+		return scrapeError
+	}
+
+	status := scrapeUnanswered
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIER\tSEEDERS\tLEECHERS\tDOWNLOADED\tTRACKER")
+	for _, r := range tf.Scrape(*timeoutFlag) {
+		if r.Err != nil {
+			fmt.Fprintf(w, "%d\t-\t-\t-\t%s (%s)\n", r.Tier, r.URL, r.Err)
+			continue
+		}
+		status = scrapeAnswered
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%s\n", r.Tier, r.Stats.Complete, r.Stats.Incomplete, r.Stats.Downloaded, r.URL)
+	}
+	w.Flush()
+	return status
+}
+
+var scrapeUsageText = `Usage: villi scrape [options] torrent_file|magnet_link
+
+Asks every tracker of the torrent how many seeders and leechers its swarm
+has and how often it was downloaded, without joining it.
+
+Options:
+  --timeout  How long each tracker gets to answer (default 30s)
+
+Exit status:
+  0  at least one tracker answered
+  1  no tracker answered
+  2  the torrent could not be read or has no trackers
+`
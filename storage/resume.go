@@ -0,0 +1,146 @@
+package storage
+
+import (
+	"encoding/hex"
+	"os"
+	"path/filepath"
+
+	"github.com/aryanA101a/villi/bitfield"
+	bencode "github.com/zeebo/bencode"
+)
+
+// resumeData is what gets persisted between runs so an interrupted download
+// can continue where it stopped.
+type resumeData struct {
+	InfoHash string       `bencode:"info hash"`
+	Bitfield string       `bencode:"bitfield"`
+	Files    []resumeFile `bencode:"files"`
+}
+
+type resumeFile struct {
+	Path  string `bencode:"path"`
+	Size  int64  `bencode:"size"`
+	Mtime int64  `bencode:"mtime"`
+}
+
+// ResumePath returns the location of the resume file for a torrent, keyed by
+// its info hash.
+func ResumePath(infoHash [20]byte) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "villi", "resume", hex.EncodeToString(infoHash[:])+".resume"), nil
+}
+
+// LoadResume reads the resume file at path and returns the pieces that are
+// already complete on disk. Pieces touching a file whose size or mtime no
+// longer match the resume file are hashed again against pieceHashes before
+// being trusted. Without a usable resume file every piece whose data exists
+// on disk is hashed, so data put in place by other means is picked up too.
+func (s *Storage) LoadResume(path string, infoHash [20]byte, pieceHashes [][20]byte) (bitfield.Bitfield, error) {
+	bf := make(bitfield.Bitfield, (len(pieceHashes)+7)/8)
+
+	rd, err := readResume(path)
+	if err != nil {
+		return nil, err
+	}
+	valid := rd != nil && rd.InfoHash == string(infoHash[:]) && len(rd.Bitfield) == len(bf) && len(rd.Files) == len(s.files)
+	for i := 0; valid && i < len(rd.Files); i++ {
+		valid = rd.Files[i].Path == s.files[i].path
+	}
+	if valid {
+		copy(bf, rd.Bitfield)
+	} else {
+		// claim everything and let the hashes decide
+		for index := range pieceHashes {
+			bf.SetPiece(index)
+		}
+	}
+
+	checked := make(map[int]bool)
+	for i, f := range s.files {
+		info, err := f.fp.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if valid && info.Size() == rd.Files[i].Size && info.ModTime().UnixNano() == rd.Files[i].Mtime {
+			continue
+		}
+		// the file changed since the resume file was written, recheck
+		// every piece that claims to be complete inside it
+		if f.length == 0 {
+			continue
+		}
+		first := int(f.offset / uint64(s.pieceLength))
+		last := int((f.offset + f.length - 1) / uint64(s.pieceLength))
+		for index := first; index <= last; index++ {
+			if !bf.HasPiece(index) || checked[index] {
+				continue
+			}
+			checked[index] = true
+			ok, err := s.VerifyPiece(index, pieceHashes[index])
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				bf.ClearPiece(index)
+			}
+		}
+	}
+	return bf, nil
+}
+
+// readResume returns nil if there is no resume file or it cannot be parsed.
+func readResume(path string) (*resumeData, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rd := resumeData{}
+	err = bencode.DecodeBytes(data, &rd)
+	if err != nil {
+		return nil, nil
+	}
+	return &rd, nil
+}
+
+// SaveResume records the completed pieces together with the current size and
+// mtime of every file.
+func (s *Storage) SaveResume(path string, infoHash [20]byte, bf bitfield.Bitfield) error {
+	rd := resumeData{
+		InfoHash: string(infoHash[:]),
+		Bitfield: string(bf),
+	}
+	for _, f := range s.files {
+		info, err := f.fp.Stat()
+		if err != nil {
+			return err
+		}
+		rd.Files = append(rd.Files, resumeFile{
+			Path:  f.path,
+			Size:  info.Size(),
+			Mtime: info.ModTime().UnixNano(),
+		})
+	}
+
+	data, err := bencode.EncodeBytes(rd)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so a crash never leaves a torn resume file
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// File describes one file of a torrent and where it lives on disk.
+type File struct {
+	Path   string
+	Length uint64
+}
+
+type file struct {
+	path   string
+	length uint64
+	offset uint64 // global byte offset of the file inside the torrent
+	fp     *os.File
+}
+
+// span is the part of a global byte range that falls inside a single file.
+type span struct {
+	file   *file
+	offset uint64 // offset inside the file
+	length uint64
+}
+
+// Storage writes verified pieces straight to their place on disk so that
+// only the pieces in flight have to be kept in memory.
+type Storage struct {
+	files       []*file
+	pieceLength uint
+	length      uint64
+}
+
+func New(files []File, pieceLength uint) (*Storage, error) {
+	s := &Storage{pieceLength: pieceLength}
+	for _, f := range files {
+		err := os.MkdirAll(filepath.Dir(f.Path), os.ModePerm)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		fp, err := os.OpenFile(f.Path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, &file{
+			path:   f.Path,
+			length: f.Length,
+			offset: s.length,
+			fp:     fp,
+		})
+		s.length += f.Length
+	}
+	return s, nil
+}
+
+// Open opens the files of a torrent read-only, without creating anything.
+// Files that do not exist read back as missing data.
+func Open(files []File, pieceLength uint) (*Storage, error) {
+	s := &Storage{pieceLength: pieceLength}
+	for _, f := range files {
+		fp, err := os.Open(f.Path)
+		if err != nil && !os.IsNotExist(err) {
+			s.Close()
+			return nil, err
+		}
+		if err != nil {
+			fp = nil
+		}
+		s.files = append(s.files, &file{
+			path:   f.Path,
+			length: f.Length,
+			offset: s.length,
+			fp:     fp,
+		})
+		s.length += f.Length
+	}
+	return s, nil
+}
+
+// spans maps the global byte range [off, off+n) onto the files it covers.
+// Zero-length files never show up in the result.
+func (s *Storage) spans(off, n uint64) ([]span, error) {
+	if off+n > s.length {
+		return nil, fmt.Errorf("range %d+%d out of bounds (length %d)", off, n, s.length)
+	}
+	// first file whose end lies past off
+	i := sort.Search(len(s.files), func(i int) bool {
+		return s.files[i].offset+s.files[i].length > off
+	})
+
+	var spans []span
+	for ; n > 0 && i < len(s.files); i++ {
+		f := s.files[i]
+		if f.length == 0 {
+			continue
+		}
+		inner := off - f.offset
+		length := f.length - inner
+		if length > n {
+			length = n
+		}
+		spans = append(spans, span{file: f, offset: inner, length: length})
+		off += length
+		n -= length
+	}
+	return spans, nil
+}
+
+func (s *Storage) pieceOffset(index int) uint64 {
+	return uint64(index) * uint64(s.pieceLength)
+}
+
+func (s *Storage) pieceSize(index int) (int, error) {
+	begin := s.pieceOffset(index)
+	if begin >= s.length {
+		return 0, fmt.Errorf("piece %d out of bounds", index)
+	}
+	end := begin + uint64(s.pieceLength)
+	if end > s.length {
+		end = s.length
+	}
+	return int(end - begin), nil
+}
+
+// WritePiece writes a verified piece to the file(s) it belongs to.
+func (s *Storage) WritePiece(index int, buf []byte) error {
+	_, err := s.WriteAt(buf, int64(s.pieceOffset(index)))
+	return err
+}
+
+// ReadPiece reads piece index back from disk.
+func (s *Storage) ReadPiece(index int) ([]byte, error) {
+	length, err := s.pieceSize(index)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length)
+	_, err = s.ReadAt(buf, int64(s.pieceOffset(index)))
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// VerifyPiece hashes piece index as it is on disk and compares it to hash.
+// Pieces that are not completely present on disk never verify.
+func (s *Storage) VerifyPiece(index int, hash [20]byte) (bool, error) {
+	length, err := s.pieceSize(index)
+	if err != nil {
+		return false, err
+	}
+	buf := make([]byte, length)
+	complete, err := s.readAt(buf, int64(s.pieceOffset(index)))
+	if err != nil || !complete {
+		return false, err
+	}
+	sum := sha1.Sum(buf)
+	return bytes.Equal(sum[:], hash[:]), nil
+}
+
+// WriteAt writes p at the global torrent offset off, splitting it across
+// files where needed.
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	spans, err := s.spans(uint64(off), uint64(len(p)))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, sp := range spans {
+		if sp.file.fp == nil {
+			return n, fmt.Errorf("%s is not open for writing", sp.file.path)
+		}
+		written, err := sp.file.fp.WriteAt(p[n:n+int(sp.length)], int64(sp.offset))
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ReadAt reads len(p) bytes starting at the global torrent offset off.
+// Regions of a file that have not been written yet read back as zeroes.
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	_, err := s.readAt(p, off)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// readAt is ReadAt that also reports whether every byte was actually present
+// on disk.
+func (s *Storage) readAt(p []byte, off int64) (bool, error) {
+	spans, err := s.spans(uint64(off), uint64(len(p)))
+	if err != nil {
+		return false, err
+	}
+	complete := true
+	n := 0
+	for _, sp := range spans {
+		chunk := p[n : n+int(sp.length)]
+		n += len(chunk)
+		read := 0
+		if sp.file.fp != nil {
+			read, err = sp.file.fp.ReadAt(chunk, int64(sp.offset))
+			if err != nil && err != io.EOF {
+				return false, err
+			}
+		}
+		if read < len(chunk) {
+			// the file is missing or shorter than expected
+			complete = false
+			for i := read; i < len(chunk); i++ {
+				chunk[i] = 0
+			}
+		}
+	}
+	return complete, nil
+}
+
+func (s *Storage) Close() error {
+	var err error
+	for _, f := range s.files {
+		if f.fp == nil {
+			continue
+		}
+		if cerr := f.fp.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
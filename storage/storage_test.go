@@ -0,0 +1,187 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestStorage creates files of the given lengths in a temporary
+// directory.
+func newTestStorage(t *testing.T, pieceLength uint, lengths ...uint64) *Storage {
+	dir := t.TempDir()
+	var files []File
+	for i, length := range lengths {
+		files = append(files, File{
+			Path:   filepath.Join(dir, "sub", string(rune('a'+i))),
+			Length: length,
+		})
+	}
+	s, err := New(files, pieceLength)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestSpans(t *testing.T) {
+	// files a..e: 10, 0, 5, 20 and 3 bytes, at 0, 10, 10, 15 and 35
+	s := newTestStorage(t, 8, 10, 0, 5, 20, 3)
+
+	type want struct {
+		file           int
+		offset, length uint64
+	}
+	tests := []struct {
+		name    string
+		off, n  uint64
+		want    []want
+		wantErr bool
+	}{
+		{"inside the first file", 2, 5, []want{{0, 2, 5}}, false},
+		{"whole first file", 0, 10, []want{{0, 0, 10}}, false},
+		{"across the empty file", 8, 4, []want{{0, 8, 2}, {2, 0, 2}}, false},
+		{"starting on a boundary", 10, 5, []want{{2, 0, 5}}, false},
+		{"across three files", 9, 10, []want{{0, 9, 1}, {2, 0, 5}, {3, 0, 4}}, false},
+		{"to the very end", 30, 8, []want{{3, 15, 5}, {4, 0, 3}}, false},
+		{"last byte", 37, 1, []want{{4, 2, 1}}, false},
+		{"everything", 0, 38, []want{{0, 0, 10}, {2, 0, 5}, {3, 0, 20}, {4, 0, 3}}, false},
+		{"nothing", 12, 0, nil, false},
+		{"past the end", 37, 2, nil, true},
+		{"beyond the end", 40, 1, nil, true},
+	}
+	for _, tt := range tests {
+		got, err := s.spans(tt.off, tt.n)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v", tt.name, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %d spans, want %d", tt.name, len(got), len(tt.want))
+			continue
+		}
+		for i, w := range tt.want {
+			sp := got[i]
+			if sp.file != s.files[w.file] || sp.offset != w.offset || sp.length != w.length {
+				t.Errorf("%s: span %d is %s+%d/%d, want %s+%d/%d", tt.name, i,
+					filepath.Base(sp.file.path), sp.offset, sp.length,
+					filepath.Base(s.files[w.file].path), w.offset, w.length)
+			}
+		}
+	}
+}
+
+func TestPieceSize(t *testing.T) {
+	s := newTestStorage(t, 16, 10, 25)
+	tests := []struct {
+		index   int
+		want    int
+		wantErr bool
+	}{
+		{0, 16, false},
+		{1, 16, false},
+		// the last piece is short
+		{2, 3, false},
+		{3, 0, true},
+	}
+	for _, tt := range tests {
+		got, err := s.pieceSize(tt.index)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("pieceSize(%d) = %d, %v, want %d", tt.index, got, err, tt.want)
+		}
+	}
+}
+
+func TestPiecesAcrossFiles(t *testing.T) {
+	s := newTestStorage(t, 16, 10, 0, 5, 20)
+	data := make([]byte, 35)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+
+	// nothing written yet, so nothing verifies
+	ok, err := s.VerifyPiece(0, sha1.Sum(data[:16]))
+	if err != nil || ok {
+		t.Fatalf("unwritten piece verified: %v, %v", ok, err)
+	}
+
+	for index := 0; index*16 < len(data); index++ {
+		end := index*16 + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		err := s.WritePiece(index, data[index*16:end])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for index := 0; index*16 < len(data); index++ {
+		end := index*16 + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		piece, err := s.ReadPiece(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(piece, data[index*16:end]) {
+			t.Errorf("piece %d reads back as %v", index, piece)
+		}
+		ok, err := s.VerifyPiece(index, sha1.Sum(data[index*16:end]))
+		if err != nil || !ok {
+			t.Errorf("piece %d does not verify: %v", index, err)
+		}
+	}
+
+	// each file holds its own part
+	wants := [][]byte{data[:10], nil, data[10:15], data[15:]}
+	for i, f := range s.files {
+		got, err := os.ReadFile(f.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, wants[i]) {
+			t.Errorf("file %d holds %v, want %v", i, got, wants[i])
+		}
+	}
+}
+
+func TestOpenMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	present := filepath.Join(dir, "present")
+	err := os.WriteFile(present, []byte("0123456789"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open([]File{
+		{Path: present, Length: 10},
+		{Path: filepath.Join(dir, "missing"), Length: 6},
+	}, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// the piece across both files reads back zero filled and fails to verify
+	piece, err := s.ReadPiece(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte("89\x00\x00\x00\x00\x00\x00"); !bytes.Equal(piece, want) {
+		t.Errorf("piece 1 reads back as %q, want %q", piece, want)
+	}
+	ok, err := s.VerifyPiece(1, sha1.Sum(piece))
+	if err != nil || ok {
+		t.Errorf("piece with missing data verified: %v, %v", ok, err)
+	}
+	ok, err = s.VerifyPiece(0, sha1.Sum([]byte("01234567")))
+	if err != nil || !ok {
+		t.Errorf("present piece does not verify: %v", err)
+	}
+	if _, err := s.WriteAt([]byte("x"), 12); err == nil {
+		t.Error("wrote to a file that is not open")
+	}
+}
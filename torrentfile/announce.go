@@ -0,0 +1,436 @@
+package torrentfile
+
+import (
+	"log"
+	"math/rand"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/aryanA101a/villi/dht"
+	"github.com/aryanA101a/villi/p2p"
+	"github.com/aryanA101a/villi/peers"
+	"github.com/aryanA101a/villi/ui"
+	"github.com/aryanA101a/villi/utils"
+)
+
+// how long to wait between announces when a tracker does not say
+const defaultAnnounceInterval = 30 * time.Minute
+
+// first wait before trying a tier none of whose trackers answered again,
+// doubled on every further failure up to the announce interval
+const announceRetryInterval = time.Minute
+
+// how long the first announces may hold up the download
+const initialAnnounceTimeout = 20 * time.Second
+
+// how long shutdown waits for trackers to take the stopped event
+const stopAnnounceTimeout = 5 * time.Second
+
+// left reported before a magnet link's metadata is known, anything but 0 as
+// trackers take a peer with nothing left for a seeder
+const unknownLeft = 16384
+
+// transferStats are the counters announces report.
+type transferStats interface {
+	Uploaded() uint64
+	Downloaded() uint64
+	Left() uint64
+}
+
+// startingStats are reported until the download runs.
+type startingStats struct {
+	left uint64
+}
+
+func (s startingStats) Uploaded() uint64   { return 0 }
+func (s startingStats) Downloaded() uint64 { return 0 }
+func (s startingStats) Left() uint64       { return s.left }
+
+// tier is a group of trackers of which one at a time is announced to, the
+// first in order that answers (BEP 12).
+type tier struct {
+	index    int
+	trackers []*tracker
+	// failures is how many rounds in a row none of the trackers answered
+	failures int
+}
+
+// announcer keeps the trackers of a torrent, and the DHT if added, informed.
+// Tiers announce side by side, each to its own working tracker.
+type announcer struct {
+	t     *TorrentFile
+	tiers []*tier
+	// node is our DHT node, nil if the DHT is not used, and bootstrap the
+	// nodes it joins through
+	node      *dht.Node
+	bootstrap []string
+	// dhtDone is closed when the DHT is dropped before stop
+	dhtDone chan struct{}
+	// base is every announce before the event and transfer stats are filled
+	// in
+	base announceRequest
+
+	// mu guards the fields below as well as the status of every tracker
+	mu    sync.Mutex
+	stats transferStats
+	// torrent is set by attach, until then the peers trackers return are
+	// kept in pending
+	torrent  *p2p.Torrent
+	attached chan struct{}
+	pending  []peers.Peer
+	// firstRounds counts the tiers and the DHT done with their first
+	// announce, update is signalled when it or pending changes
+	firstRounds int
+	update      chan struct{}
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newAnnouncer returns an announcer for the tiers of t, each shuffled as BEP
+// 12 asks. Until attach it reports left bytes left and nothing transferred.
+func (t *TorrentFile) newAnnouncer(base announceRequest, left uint64) *announcer {
+	a := &announcer{
+		t:        t,
+		base:     base,
+		stats:    startingStats{left},
+		attached: make(chan struct{}),
+		update:   make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+	seen := make(map[string]bool)
+	for _, urls := range t.Announce {
+		ti := &tier{index: len(a.tiers)}
+		for _, announceURL := range urls {
+			u, err := url.Parse(announceURL)
+			if err != nil || seen[u.String()] {
+				continue
+			}
+			seen[u.String()] = true
+			ti.trackers = append(ti.trackers, &tracker{URL: u, status: "not contacted"})
+		}
+		if len(ti.trackers) == 0 {
+			continue
+		}
+		rand.Shuffle(len(ti.trackers), func(i, j int) {
+			ti.trackers[i], ti.trackers[j] = ti.trackers[j], ti.trackers[i]
+		})
+		a.tiers = append(a.tiers, ti)
+	}
+	return a
+}
+
+// start announces started to every tier and to the DHT, and keeps
+// announcing until stop.
+func (a *announcer) start() {
+	a.mu.Lock()
+	a.publish()
+	a.mu.Unlock()
+	for _, ti := range a.tiers {
+		a.wg.Add(1)
+		go a.run(ti)
+	}
+	if a.node != nil {
+		a.wg.Add(1)
+		go a.runDHT()
+	}
+}
+
+// rounds is how many first announces waitPeers waits for.
+func (a *announcer) rounds() int {
+	if a.node != nil {
+		return len(a.tiers) + 1
+	}
+	return len(a.tiers)
+}
+
+// firstRound counts a tier or the DHT done with its first announce.
+func (a *announcer) firstRound() {
+	a.mu.Lock()
+	a.firstRounds++
+	a.signal()
+	a.mu.Unlock()
+}
+
+// waitPeers waits until every tier and the DHT were announced to once,
+// until at least max peers turned up or until timeout, and returns the
+// peers so far.
+func (a *announcer) waitPeers(max int, timeout time.Duration) []peers.Peer {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		a.mu.Lock()
+		if a.firstRounds == a.rounds() || len(a.pending) >= max {
+			break
+		}
+		a.mu.Unlock()
+
+		select {
+		case <-a.update:
+			continue
+		case <-timer.C:
+		}
+		a.mu.Lock()
+		break
+	}
+	defer a.mu.Unlock()
+	found := a.pending
+	a.pending = nil
+	return found
+}
+
+// attach hands the download to the announcer, which from then on reports
+// its transfer stats and passes it the peers trackers return.
+func (a *announcer) attach(torrent *p2p.Torrent) {
+	a.mu.Lock()
+	a.stats = torrent
+	a.torrent = torrent
+	pending := a.pending
+	a.pending = nil
+	close(a.attached)
+	a.mu.Unlock()
+	torrent.AddPeers(pending)
+}
+
+// stop ends the announces and waits a little for the stopped events to go
+// out.
+func (a *announcer) stop() {
+	close(a.done)
+	stopped := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(stopAnnounceTimeout):
+	}
+}
+
+// found passes peers a tracker or the DHT returned on to the download, or
+// keeps them until there is one.
+func (a *announcer) found(list []peers.Peer) {
+	a.mu.Lock()
+	torrent := a.torrent
+	if torrent == nil {
+		a.pending = append(a.pending, list...)
+		a.signal()
+	}
+	a.mu.Unlock()
+	if torrent != nil {
+		torrent.AddPeers(list)
+	}
+}
+
+// signal wakes waitPeers, a.mu must be held.
+func (a *announcer) signal() {
+	select {
+	case a.update <- struct{}{}:
+	default:
+	}
+}
+
+// request returns the announce for ev with the current transfer stats.
+func (a *announcer) request(ev event) announceRequest {
+	a.mu.Lock()
+	stats := a.stats
+	a.mu.Unlock()
+
+	req := a.base
+	req.Event = ev
+	req.Uploaded = stats.Uploaded()
+	req.Downloaded = stats.Downloaded()
+	req.Left = stats.Left()
+	if ev == eventStopped {
+		req.NumWant = 0
+	}
+	return req
+}
+
+// run announces to ti until stop. Its trackers hear right away that we
+// started, and also when the download completes and when we stop.
+func (a *announcer) run(ti *tier) {
+	defer a.wg.Done()
+
+	attached := a.attached
+	var completed <-chan struct{}
+	downloaded := false
+	first := true
+	for {
+		wait := ti.nextAnnounce()
+		if front := ti.trackers[0]; ti.failures == 0 && downloaded && front.started && !front.completed {
+			wait = 0
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-attached:
+			timer.Stop()
+			attached = nil
+			completed = a.torrent.Completed()
+			continue
+		case <-completed:
+			timer.Stop()
+			completed = nil
+			downloaded = true
+			continue
+		case <-a.done:
+			timer.Stop()
+			select {
+			case <-completed:
+				downloaded = true
+			default:
+			}
+			a.stopTier(ti, downloaded)
+			return
+		}
+
+		a.announceTier(ti, downloaded)
+		if first {
+			first = false
+			a.firstRound()
+		}
+	}
+}
+
+// nextAnnounce returns how long to wait before announcing to ti again.
+func (ti *tier) nextAnnounce() time.Duration {
+	front := ti.trackers[0]
+	if ti.failures > 0 {
+		limit := front.interval
+		if limit <= 0 {
+			limit = defaultAnnounceInterval
+		}
+		wait := announceRetryInterval
+		for i := 1; i < ti.failures && wait < limit; i++ {
+			wait *= 2
+		}
+		if wait > limit {
+			wait = limit
+		}
+		return wait
+	}
+	if !front.started {
+		return 0
+	}
+	return front.interval
+}
+
+// announceTier announces to the trackers of ti in order until one answers,
+// and moves that one to the front of the tier (BEP 12).
+func (a *announcer) announceTier(ti *tier, downloaded bool) {
+	for i, tr := range ti.trackers {
+		ev := eventNone
+		if !tr.started {
+			ev = eventStarted
+		} else if downloaded && !tr.completed {
+			ev = eventCompleted
+		}
+		resp, err := a.announce(tr, a.request(ev))
+		if err != nil {
+			continue
+		}
+		a.mu.Lock()
+		copy(ti.trackers[1:i+1], ti.trackers[:i])
+		ti.trackers[0] = tr
+		a.mu.Unlock()
+		ti.failures = 0
+		a.found(resp.Peers)
+		return
+	}
+	ti.failures++
+}
+
+// stopTier tells every tracker of ti that heard we started that we stopped,
+// and that we completed first if it does not know yet.
+func (a *announcer) stopTier(ti *tier, downloaded bool) {
+	for _, tr := range ti.trackers {
+		if !tr.started {
+			continue
+		}
+		if downloaded && !tr.completed {
+			a.announce(tr, a.request(eventCompleted))
+		}
+		a.announce(tr, a.request(eventStopped))
+	}
+}
+
+// announce sends one announce to tr, remembering what the next one needs,
+// and shows how it went.
+func (a *announcer) announce(tr *tracker, req announceRequest) (*trackerResponse, error) {
+	a.setStatus(tr, func() { tr.status = "updating..." })
+	log.Println(utils.Bold("Contacting tracker[" + tr.URL.String() + "] " + req.Event.String()))
+
+	resp, err := a.t.requestPeers(tr, req)
+	if err != nil {
+		log.Println(utils.BoldRed("Failed(", err, ")\n"))
+		a.setStatus(tr, func() {
+			tr.status = err.Error()
+			tr.lastAnnounce = time.Now()
+		})
+		return nil, err
+	}
+	switch req.Event {
+	case eventStarted:
+		tr.started = true
+		// a tracker told we started with nothing left needs no completed
+		tr.completed = req.Left == 0
+	case eventCompleted:
+		tr.completed = true
+	case eventStopped:
+		tr.started = false
+	}
+
+	tr.interval = resp.Interval
+	if tr.interval <= 0 {
+		tr.interval = defaultAnnounceInterval
+	}
+	if tr.interval < resp.MinInterval {
+		tr.interval = resp.MinInterval
+	}
+	if resp.Warning != "" {
+		log.Println(utils.BoldRed("Tracker warning: ", resp.Warning))
+	}
+	log.Println(utils.Bold("Got: "), resp.Peers, utils.Bold(" seeders: "), resp.Seeders, utils.Bold(" leechers: "), resp.Leechers)
+
+	a.setStatus(tr, func() {
+		tr.status = "working"
+		if resp.Warning != "" {
+			tr.status = "working (" + resp.Warning + ")"
+		}
+		tr.lastAnnounce = time.Now()
+		tr.peers = len(resp.Peers)
+		tr.seeders = resp.Seeders
+		tr.leechers = resp.Leechers
+	})
+	return resp, nil
+}
+
+// setStatus changes what is shown about tr with set and shows it.
+func (a *announcer) setStatus(tr *tracker, set func()) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	set()
+	a.publish()
+}
+
+// publish shows the status of every tracker, a.mu must be held.
+func (a *announcer) publish() {
+	var trackers ui.Trackers
+	for _, ti := range a.tiers {
+		for _, tr := range ti.trackers {
+			trackers = append(trackers, ui.Tracker{
+				URL:          tr.URL.String(),
+				Tier:         ti.index,
+				Status:       tr.status,
+				LastAnnounce: tr.lastAnnounce,
+				Peers:        tr.peers,
+				Seeders:      tr.seeders,
+				Leechers:     tr.leechers,
+			})
+		}
+	}
+	ui.UpdateUI(trackers)
+}
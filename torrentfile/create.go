@@ -0,0 +1,220 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bencode "github.com/zeebo/bencode"
+)
+
+// bounds of the piece length Create picks, and how many pieces it aims for
+const (
+	minPieceLength = 16 * 1024
+	maxPieceLength = 16 * 1024 * 1024
+	targetPieces   = 1500
+)
+
+// CreateOptions are the choices made when creating a torrent.
+type CreateOptions struct {
+	// PieceLength is the size of the pieces, a power of two of at least 16
+	// KiB, picked from the size of the data if 0
+	PieceLength uint
+	// Announce are the tracker URLs by tier (BEP 12)
+	Announce [][]string
+	// WebSeeds are HTTP URLs the data can also be fetched from (BEP 19)
+	WebSeeds  []string
+	Comment   string
+	CreatedBy string
+	// CreationDate is left out of the torrent if zero
+	CreationDate time.Time
+	Private      bool
+	// Source tells apart torrents of the same files made for different
+	// trackers
+	Source string
+}
+
+// Create makes a torrent of the file or directory at root, and returns it
+// along with its bencoded form. The files of a directory are taken in
+// lexical order, skipping anything but regular files. progress, if not nil,
+// is called after every piece.
+func Create(root string, opts CreateOptions, progress func(done, total int)) (TorrentFile, []byte, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return TorrentFile{}, nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return TorrentFile{}, nil, err
+	}
+
+	// paths are relative to root, an empty one for a single file
+	type entry struct {
+		path   string
+		length uint64
+	}
+	var entries []entry
+	var length uint64
+	if info.IsDir() {
+		err = filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry{rel, uint64(fi.Size())})
+			length += uint64(fi.Size())
+			return nil
+		})
+		if err != nil {
+			return TorrentFile{}, nil, err
+		}
+	} else if info.Mode().IsRegular() {
+		entries = append(entries, entry{"", uint64(info.Size())})
+		length = uint64(info.Size())
+	}
+	if length == 0 {
+		return TorrentFile{}, nil, fmt.Errorf("no data to make a torrent of in %s", root)
+	}
+
+	pieceLength := opts.PieceLength
+	if pieceLength == 0 {
+		pieceLength = choosePieceLength(length)
+	}
+	if pieceLength < minPieceLength || pieceLength&(pieceLength-1) != 0 {
+		return TorrentFile{}, nil, fmt.Errorf("piece length %d is not a power of two of at least 16 KiB", pieceLength)
+	}
+
+	numPieces := int((length + uint64(pieceLength) - 1) / uint64(pieceLength))
+	pieces := make([]byte, 0, 20*numPieces)
+	buf := make([]byte, pieceLength)
+	filled := 0
+	hashPiece := func() {
+		hash := sha1.Sum(buf[:filled])
+		pieces = append(pieces, hash[:]...)
+		filled = 0
+		if progress != nil {
+			progress(len(pieces)/20, numPieces)
+		}
+	}
+
+	var files []bencodeInfoFile
+	for _, e := range entries {
+		f, err := os.Open(filepath.Join(root, e.path))
+		if err != nil {
+			return TorrentFile{}, nil, err
+		}
+		// lengths were counted by the walk, a file that changed since would
+		// not match them
+		r := io.LimitReader(f, int64(e.length))
+		var read uint64
+		for {
+			n, err := io.ReadFull(r, buf[filled:])
+			read += uint64(n)
+			filled += n
+			if filled == len(buf) {
+				hashPiece()
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				f.Close()
+				return TorrentFile{}, nil, err
+			}
+		}
+		f.Close()
+		if read != e.length {
+			return TorrentFile{}, nil, fmt.Errorf("%s changed while it was hashed", filepath.Join(root, e.path))
+		}
+		if e.path != "" {
+			files = append(files, bencodeInfoFile{
+				Path:   strings.Split(filepath.ToSlash(e.path), "/"),
+				Length: e.length,
+			})
+		}
+	}
+	if filled > 0 {
+		hashPiece()
+	}
+
+	bi := bencodeInfo{
+		Pieces:      string(pieces),
+		PieceLength: pieceLength,
+		Name:        filepath.Base(root),
+		Source:      opts.Source,
+	}
+	if opts.Private {
+		bi.Private = 1
+	}
+	if files == nil {
+		bi.Length = length
+	} else {
+		bi.Files, err = bencode.EncodeBytes(files)
+		if err != nil {
+			return TorrentFile{}, nil, err
+		}
+	}
+	infoBytes, err := bencode.EncodeBytes(bi)
+	if err != nil {
+		return TorrentFile{}, nil, err
+	}
+
+	bto := bencodeTorrent{
+		Info:      infoBytes,
+		Comment:   opts.Comment,
+		CreatedBy: opts.CreatedBy,
+	}
+	var tiers [][]string
+	for _, tier := range opts.Announce {
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
+	}
+	if len(tiers) > 0 {
+		bto.Announce = tiers[0][0]
+	}
+	// announce-list is only needed for more than the one tracker
+	if len(tiers) > 1 || (len(tiers) == 1 && len(tiers[0]) > 1) {
+		bto.AnnounceList = tiers
+	}
+	if len(opts.WebSeeds) > 0 {
+		bto.URLList, err = bencode.EncodeBytes(opts.WebSeeds)
+		if err != nil {
+			return TorrentFile{}, nil, err
+		}
+	}
+	if !opts.CreationDate.IsZero() {
+		bto.CreationDate = opts.CreationDate.Unix()
+	}
+	data, err := bencode.EncodeBytes(bto)
+	if err != nil {
+		return TorrentFile{}, nil, err
+	}
+
+	// read back as any torrent, with the files where they are
+	t, err := bto.toTorrentFile(filepath.Dir(root))
+	if err != nil {
+		return TorrentFile{}, nil, err
+	}
+	return t, data, nil
+}
+
+// choosePieceLength picks the smallest power of two piece length that keeps
+// the pieces of length bytes near targetPieces.
+func choosePieceLength(length uint64) uint {
+	pieceLength := uint(minPieceLength)
+	for pieceLength < maxPieceLength && length/uint64(pieceLength) > targetPieces {
+		pieceLength *= 2
+	}
+	return pieceLength
+}
@@ -0,0 +1,163 @@
+package torrentfile
+
+import (
+	"crypto/sha1"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aryanA101a/villi/storage"
+	bencode "github.com/zeebo/bencode"
+)
+
+// writeTestFiles creates the files under root with random contents of the
+// given lengths.
+func writeTestFiles(t *testing.T, root string, lengths map[string]int) {
+	rng := rand.New(rand.NewSource(1))
+	for name, length := range lengths {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data := make([]byte, length)
+		rng.Read(data)
+		err = os.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// checkCreated loads data back with Open and checks it against t and the
+// files on disk.
+func checkCreated(tt *testing.T, t TorrentFile, data []byte, outPath string) TorrentFile {
+	tt.Helper()
+	path := filepath.Join(tt.TempDir(), "created.torrent")
+	err := os.WriteFile(path, data, 0644)
+	if err != nil {
+		tt.Fatal(err)
+	}
+	loaded, err := Open(path, outPath)
+	if err != nil {
+		tt.Fatal(err)
+	}
+	if loaded.InfoHash != t.InfoHash || loaded.InfoHash != sha1.Sum(loaded.info) {
+		tt.Errorf("info hash %x loads back as %x", t.InfoHash, loaded.InfoHash)
+	}
+
+	// every piece hash matches the data where the files are
+	store, err := storage.Open(loaded.storageFiles(), loaded.PieceLength)
+	if err != nil {
+		tt.Fatal(err)
+	}
+	defer store.Close()
+	for index, hash := range loaded.PieceHashes {
+		ok, err := store.VerifyPiece(index, hash)
+		if err != nil || !ok {
+			tt.Errorf("piece %d does not verify: %v", index, err)
+		}
+	}
+	return loaded
+}
+
+func TestCreateFile(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]int{"file.bin": 40000})
+	root := filepath.Join(dir, "file.bin")
+	opts := CreateOptions{PieceLength: 16384, Announce: [][]string{{"http://tracker.example/announce"}}}
+
+	tf, data, err := Create(root, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := checkCreated(t, tf, data, dir)
+	if loaded.Name != "file.bin" || loaded.Length != 40000 || len(loaded.PieceHashes) != 3 {
+		t.Errorf("got %s of %d bytes in %d pieces", loaded.Name, loaded.Length, len(loaded.PieceHashes))
+	}
+	if len(loaded.Files) != 1 || loaded.Files[0].Path != root {
+		t.Errorf("got files %+v, want %s", loaded.Files, root)
+	}
+
+	// the same data makes the same torrent
+	_, again, err := Create(root, opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(again) != string(data) {
+		t.Error("creating the torrent again made a different one")
+	}
+
+	// one tracker needs no announce-list
+	var bto bencodeTorrent
+	err = bencode.DecodeBytes(data, &bto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bto.Announce != "http://tracker.example/announce" || bto.AnnounceList != nil {
+		t.Errorf("got announce %q and announce-list %v", bto.Announce, bto.AnnounceList)
+	}
+}
+
+func TestCreateDirectory(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFiles(t, dir, map[string]int{
+		"data/b":        20000,
+		"data/a/z":      5,
+		"data/a/c/d":    30000,
+		"data/B":        16384,
+		"data/a/c/e/f":  1,
+		"data/aa":       7000,
+		"elsewhere/x.y": 100,
+	})
+	// not a regular file, left out
+	err := os.MkdirAll(filepath.Join(dir, "data", "empty"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "data")
+	announce := [][]string{{"http://a.example/announce", "udp://b.example:80"}, {"http://c.example/announce"}}
+	var steps []int
+	opts := CreateOptions{PieceLength: 16384, Announce: announce}
+
+	tf, data, err := Create(root, opts, func(done, total int) {
+		steps = append(steps, done)
+		if total != 5 {
+			t.Errorf("progress of %d pieces, want 5", total)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := checkCreated(t, tf, data, dir)
+	if len(steps) != 5 || steps[4] != 5 {
+		t.Errorf("progress went %v", steps)
+	}
+
+	// in lexical order of their paths
+	want := []string{"B", "a/c/d", "a/c/e/f", "a/z", "aa", "b"}
+	if len(loaded.Files) != len(want) {
+		t.Fatalf("got %d files, want %d", len(loaded.Files), len(want))
+	}
+	for i, f := range loaded.Files {
+		if f.Path != filepath.Join(root, filepath.FromSlash(want[i])) {
+			t.Errorf("file %d is %s, want %s", i, f.Path, want[i])
+		}
+	}
+	if loaded.Length != 20000+5+30000+16384+1+7000 {
+		t.Errorf("got length %d", loaded.Length)
+	}
+
+	var bto bencodeTorrent
+	err = bencode.DecodeBytes(data, &bto)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bto.Announce != announce[0][0] || len(bto.AnnounceList) != 2 || len(bto.AnnounceList[0]) != 2 {
+		t.Errorf("got announce %q and announce-list %v", bto.Announce, bto.AnnounceList)
+	}
+	if tf.InfoHash != loaded.InfoHash {
+		t.Errorf("Create returned info hash %x, the file has %x", tf.InfoHash, loaded.InfoHash)
+	}
+}
@@ -0,0 +1,99 @@
+package torrentfile
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aryanA101a/villi/dht"
+	"github.com/aryanA101a/villi/utils"
+	"github.com/aryanA101a/villi/utp"
+)
+
+// how often the DHT is asked for peers again, well within the half hour
+// nodes keep the peers announced to them
+const dhtAnnounceInterval = 15 * time.Minute
+
+// newDHTNode starts our DHT node. It shares the uTP socket when there is
+// one, as that holds the UDP side of the port peers connect to. The node
+// keeps answering other nodes until it is closed.
+func newDHTNode(port uint16, sock *utp.Socket) (*dht.Node, error) {
+	if sock != nil {
+		return dht.NewConn(sock.Divert('d'))
+	}
+	node, err := dht.New(fmt.Sprintf(":%d", port))
+	if err != nil {
+		// the port is taken by another DHT node, any port will do
+		node, err = dht.New(":0")
+	}
+	return node, err
+}
+
+// addDHT has the announcer also look the torrent up in the DHT through
+// node, joining it through bootstrap or the default nodes and the nodes of
+// the torrent. Call it before start.
+func (a *announcer) addDHT(node *dht.Node, bootstrap []string) {
+	a.node = node
+	a.dhtDone = make(chan struct{})
+	if len(bootstrap) == 0 {
+		bootstrap = dht.DefaultBootstrap
+	}
+	a.bootstrap = append(append([]string(nil), bootstrap...), a.t.nodes...)
+}
+
+// runDHT looks up the peers of the torrent and announces that we accept
+// connections, right away and then every dhtAnnounceInterval until stop.
+func (a *announcer) runDHT() {
+	defer a.wg.Done()
+
+	first := true
+	var wait time.Duration
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-a.done:
+			timer.Stop()
+			return
+		case <-a.dhtDone:
+			timer.Stop()
+			return
+		}
+
+		wait = dhtAnnounceInterval
+		var err error
+		if a.node.Nodes() == 0 {
+			log.Println(utils.Bold("Joining the DHT..."))
+			err = a.node.Bootstrap(a.bootstrap)
+		}
+		if err != nil {
+			log.Println(utils.BoldRed("DHT lookup failed(", err, ")\n"))
+			wait = announceRetryInterval
+		} else {
+			log.Println(utils.Bold("Looking up peers in the DHT (", a.node.Nodes(), " nodes known)..."))
+			result := a.node.Announce(a.t.InfoHash, a.base.Port)
+			select {
+			case <-a.dhtDone:
+				return
+			default:
+			}
+			log.Println(utils.Bold("Got from DHT: "), result)
+			a.found(result)
+		}
+
+		if first {
+			first = false
+			a.firstRound()
+		}
+	}
+}
+
+// dropDHT stops the DHT lookups and closes the node, for a magnet link whose
+// metadata says the torrent is private.
+func (a *announcer) dropDHT() {
+	if a.node == nil {
+		return
+	}
+	close(a.dhtDone)
+	a.node.Close()
+}
@@ -0,0 +1,33 @@
+package torrentfile
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aryanA101a/villi/dht"
+)
+
+func TestDropDHT(t *testing.T) {
+	node, err := dht.New("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+	a := (&TorrentFile{}).newAnnouncer(announceRequest{}, 0)
+	// a node that never answers keeps the lookups going
+	a.addDHT(node, []string{"127.0.0.1:9"})
+	a.start()
+	defer a.stop()
+
+	a.dropDHT()
+	stopped := make(chan struct{})
+	go func() {
+		a.wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("DHT lookups still running after the DHT was dropped")
+	}
+}
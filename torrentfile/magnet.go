@@ -0,0 +1,128 @@
+package torrentfile
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+
+	"github.com/aryanA101a/villi/peers"
+)
+
+// Magnet is what a magnet link tells about a torrent: enough to find peers
+// and fetch the rest from them.
+type Magnet struct {
+	InfoHash [20]byte
+	Name     string
+	Trackers []string
+	Peers    []peers.Peer
+}
+
+// IsMagnet reports whether s looks like a magnet link rather than a path.
+func IsMagnet(s string) bool {
+	return strings.HasPrefix(s, "magnet:")
+}
+
+// ParseMagnet parses the xt (info hash), dn (name), tr (trackers) and x.pe
+// (peer addresses) parameters of a magnet link.
+func ParseMagnet(uri string) (Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return Magnet{}, err
+	}
+	if u.Scheme != "magnet" {
+		return Magnet{}, fmt.Errorf("not a magnet link: %s", uri)
+	}
+	q := u.Query()
+
+	m := Magnet{
+		Name:     q.Get("dn"),
+		Trackers: q["tr"],
+	}
+
+	found := false
+	for _, xt := range q["xt"] {
+		if !strings.HasPrefix(xt, "urn:btih:") {
+			continue
+		}
+		m.InfoHash, err = parseInfoHash(strings.TrimPrefix(xt, "urn:btih:"))
+		if err != nil {
+			return Magnet{}, err
+		}
+		found = true
+		break
+	}
+	if !found {
+		return Magnet{}, fmt.Errorf("magnet link has no urn:btih info hash")
+	}
+
+	for _, pe := range q["x.pe"] {
+		addr, err := net.ResolveTCPAddr("tcp", pe)
+		if err != nil {
+			continue
+		}
+		peer, err := peers.FromAddr(addr)
+		if err != nil {
+			continue
+		}
+		m.Peers = append(m.Peers, peer)
+	}
+	return m, nil
+}
+
+// parseInfoHash accepts an info hash in hex (40 characters) or base32 (32
+// characters) form.
+func parseInfoHash(s string) ([20]byte, error) {
+	var infoHash [20]byte
+	var buf []byte
+	var err error
+	switch len(s) {
+	case 40:
+		buf, err = hex.DecodeString(s)
+	case 32:
+		buf, err = base32.StdEncoding.DecodeString(strings.ToUpper(s))
+	default:
+		return infoHash, fmt.Errorf("invalid info hash %q", s)
+	}
+	if err != nil {
+		return infoHash, fmt.Errorf("invalid info hash %q: %v", s, err)
+	}
+	copy(infoHash[:], buf)
+	return infoHash, nil
+}
+
+// OpenMagnet prepares a download from a magnet link. The returned torrent has
+// no info dictionary yet; DownloadToFile fetches it from the swarm first.
+func OpenMagnet(uri string) (TorrentFile, error) {
+	m, err := ParseMagnet(uri)
+	if err != nil {
+		return TorrentFile{}, err
+	}
+	name := m.Name
+	if name == "" {
+		name = hex.EncodeToString(m.InfoHash[:])
+	}
+	// every tracker of a magnet link is a tier of its own
+	var announce [][]string
+	for _, tracker := range m.Trackers {
+		announce = append(announce, []string{tracker})
+	}
+	return TorrentFile{
+		Announce: announce,
+		InfoHash: m.InfoHash,
+		Name:     name,
+		peers:    m.Peers,
+	}, nil
+}
+
+// Magnet returns a magnet link to the torrent with its name and trackers.
+func (t *TorrentFile) Magnet() string {
+	params := url.Values{"dn": []string{t.Name}}
+	for _, tier := range t.Announce {
+		params["tr"] = append(params["tr"], tier...)
+	}
+	// the info hash goes first and unescaped, as clients expect
+	return "magnet:?xt=urn:btih:" + hex.EncodeToString(t.InfoHash[:]) + "&" + params.Encode()
+}
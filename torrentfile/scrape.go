@@ -0,0 +1,173 @@
+package torrentfile
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	bencode "github.com/zeebo/bencode"
+)
+
+// ScrapeStats is what a tracker knows of the swarm of one torrent.
+type ScrapeStats struct {
+	// Complete counts the seeders, Incomplete the leechers and Downloaded
+	// how often the torrent was downloaded in full
+	Complete   int
+	Downloaded int
+	Incomplete int
+}
+
+// ScrapeResult is how scraping one tracker of a torrent went.
+type ScrapeResult struct {
+	URL  string
+	Tier int
+	// Stats is only meaningful when Err is nil
+	Stats ScrapeStats
+	Err   error
+}
+
+type bencodeScrapeResp struct {
+	FailureReason string `bencode:"failure reason,omitempty"`
+	// Files are keyed by the raw 20 byte info hash
+	Files map[string]bencodeScrapeFile `bencode:"files"`
+}
+
+type bencodeScrapeFile struct {
+	Complete   int `bencode:"complete"`
+	Downloaded int `bencode:"downloaded"`
+	Incomplete int `bencode:"incomplete"`
+}
+
+// Scrape asks the tracker at announceURL for the swarm stats of infoHashes,
+// giving it timeout to answer. Torrents the tracker does not know of are
+// left out of the result.
+func Scrape(announceURL string, infoHashes [][20]byte, timeout time.Duration) (map[[20]byte]ScrapeStats, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return scrapeHTTP(u, infoHashes, timeout)
+	case "udp":
+		return scrapeUDP(u, infoHashes, timeout)
+	}
+	return nil, fmt.Errorf("announce url not recognized")
+}
+
+// Scrape asks every tracker of the torrent at once for the stats of its
+// swarm, giving each timeout to answer, and returns the answers by tier.
+func (t *TorrentFile) Scrape(timeout time.Duration) []ScrapeResult {
+	var results []ScrapeResult
+	for i, tier := range t.Announce {
+		for _, announceURL := range tier {
+			results = append(results, ScrapeResult{URL: announceURL, Tier: i})
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(r *ScrapeResult) {
+			defer wg.Done()
+			stats, err := Scrape(r.URL, [][20]byte{t.InfoHash}, timeout)
+			if err != nil {
+				r.Err = err
+				return
+			}
+			s, ok := stats[t.InfoHash]
+			if !ok {
+				r.Err = fmt.Errorf("torrent unknown to the tracker")
+				return
+			}
+			r.Stats = s
+		}(&results[i])
+	}
+	wg.Wait()
+	return results
+}
+
+// scrapeURL returns the scrape URL of an HTTP tracker, the announce URL with
+// "announce" at the start of its last path element replaced by "scrape".
+func scrapeURL(announce *url.URL) (*url.URL, error) {
+	dir, last := path.Split(announce.Path)
+	if !strings.HasPrefix(last, "announce") {
+		return nil, fmt.Errorf("tracker does not support scrape")
+	}
+	u := *announce
+	u.Path = dir + "scrape" + strings.TrimPrefix(last, "announce")
+	u.RawPath = ""
+	return &u, nil
+}
+
+func scrapeHTTP(announce *url.URL, infoHashes [][20]byte, timeout time.Duration) (map[[20]byte]ScrapeStats, error) {
+	u, err := scrapeURL(announce)
+	if err != nil {
+		return nil, err
+	}
+	params := u.Query()
+	for _, infoHash := range infoHashes {
+		params.Add("info_hash", string(infoHash[:]))
+	}
+	u.RawQuery = params.Encode()
+
+	c := &http.Client{Timeout: timeout}
+	resp, err := c.Get(u.String())
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	scrapeResp := bencodeScrapeResp{}
+	err = bencode.NewDecoder(resp.Body).Decode(&scrapeResp)
+	if err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("tracker responded %s", resp.Status)
+		}
+		return nil, err
+	}
+	if scrapeResp.FailureReason != "" {
+		return nil, &TrackerError{Reason: scrapeResp.FailureReason}
+	}
+
+	stats := make(map[[20]byte]ScrapeStats, len(scrapeResp.Files))
+	for key, f := range scrapeResp.Files {
+		if len(key) != 20 {
+			continue
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], key)
+		stats[infoHash] = ScrapeStats{
+			Complete:   f.Complete,
+			Downloaded: f.Downloaded,
+			Incomplete: f.Incomplete,
+		}
+	}
+	return stats, nil
+}
+
+// scrapeUDP scrapes over the first address of a UDP tracker, the swarm is
+// the same over either family.
+func scrapeUDP(announce *url.URL, infoHashes [][20]byte, timeout time.Duration) (map[[20]byte]ScrapeStats, error) {
+	addrs, err := trackerAddrs(announce.Host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no address for %s", announce.Host)
+	}
+	u := &udpTracker{addr: addrs[0], timeout: timeout}
+	list, err := u.scrape(infoHashes)
+	if err != nil {
+		return nil, err
+	}
+	stats := make(map[[20]byte]ScrapeStats, len(list))
+	for i, s := range list {
+		stats[infoHashes[i]] = s
+	}
+	return stats, nil
+}
@@ -0,0 +1,557 @@
+package torrentfile
+
+import (
+	"crypto/rand"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aryanA101a/villi/peers"
+	"github.com/aryanA101a/villi/utils"
+	bencode "github.com/zeebo/bencode"
+)
+
+// announce interval a tracker server hands out unless configured
+const defaultServerInterval = 30 * time.Minute
+
+// how many peers an announce gets when it does not say, and at most
+const (
+	defaultServerNumWant = 50
+	maxServerNumWant     = 200
+)
+
+// how often expired peers are dropped and the swarms saved
+const serverSweepInterval = time.Minute
+
+// ServerConfig is how a tracker server runs.
+type ServerConfig struct {
+	// HTTPAddr and UDPAddr are where announces and scrapes are taken, an
+	// empty address leaves that protocol out
+	HTTPAddr string
+	UDPAddr  string
+	// Interval is how long peers are told to wait between announces, they
+	// are forgotten after twice that without one
+	Interval time.Duration
+	// Allow are the only torrents tracked, any torrent if empty
+	Allow [][20]byte
+	// StatePath is where the swarms are kept across restarts, nowhere if
+	// empty
+	StatePath string
+}
+
+// TrackerServer is a BitTorrent tracker taking announces and scrapes over
+// HTTP and UDP (BEP 15).
+type TrackerServer struct {
+	cfg   ServerConfig
+	allow map[[20]byte]bool
+	http  net.Listener
+	udp   net.PacketConn
+	// secret makes UDP connection ids that cannot be guessed
+	secret [20]byte
+
+	mu     sync.Mutex
+	swarms map[[20]byte]*swarm
+	// saveMu keeps saves from writing StatePath at the same time
+	saveMu sync.Mutex
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// swarm is a torrent's peers as far as the tracker knows.
+type swarm struct {
+	// peers are keyed by peer id
+	peers map[[20]byte]*swarmPeer
+	// downloaded counts the peers that finished downloading
+	downloaded int
+}
+
+type swarmPeer struct {
+	id   [20]byte
+	peer peers.Peer
+	left uint64
+	// seen is when the peer last announced
+	seen time.Time
+}
+
+// announceQuery is an announce as the server reads it, over either
+// protocol.
+type announceQuery struct {
+	InfoHash [20]byte
+	PeerID   [20]byte
+	// Peer is the announcing peer's address with the port it listens on
+	Peer    peers.Peer
+	Left    uint64
+	Event   event
+	NumWant int
+	// Want picks the peers that may be returned, any if nil
+	Want func(peers.Peer) bool
+}
+
+// bencodeServerState is what is kept of the swarms in StatePath.
+type bencodeServerState struct {
+	Swarms []bencodeSwarm `bencode:"swarms"`
+}
+
+type bencodeSwarm struct {
+	InfoHash   string             `bencode:"info hash"`
+	Downloaded int                `bencode:"downloaded"`
+	Peers      []bencodeSwarmPeer `bencode:"peers"`
+}
+
+type bencodeSwarmPeer struct {
+	PeerID string `bencode:"peer id"`
+	IP     string `bencode:"ip"`
+	Port   uint16 `bencode:"port"`
+	Left   uint64 `bencode:"left"`
+	Seen   int64  `bencode:"seen"`
+}
+
+// ListenTracker opens the addresses of cfg and loads the swarms kept in its
+// StatePath. Nothing is answered until Serve.
+func ListenTracker(cfg ServerConfig) (*TrackerServer, error) {
+	if cfg.HTTPAddr == "" && cfg.UDPAddr == "" {
+		return nil, errors.New("no address to listen on")
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultServerInterval
+	}
+	s := &TrackerServer{
+		cfg:    cfg,
+		swarms: make(map[[20]byte]*swarm),
+		done:   make(chan struct{}),
+	}
+	if len(cfg.Allow) > 0 {
+		s.allow = make(map[[20]byte]bool, len(cfg.Allow))
+		for _, infoHash := range cfg.Allow {
+			s.allow[infoHash] = true
+		}
+	}
+	_, err := rand.Read(s.secret[:])
+	if err != nil {
+		return nil, err
+	}
+	if cfg.StatePath != "" {
+		err = s.load()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.HTTPAddr != "" {
+		s.http, err = net.Listen("tcp", cfg.HTTPAddr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.UDPAddr != "" {
+		s.udp, err = net.ListenPacket("udp", cfg.UDPAddr)
+		if err != nil {
+			if s.http != nil {
+				s.http.Close()
+			}
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// HTTPAddr is the address HTTP announces go to, nil without HTTP.
+func (s *TrackerServer) HTTPAddr() net.Addr {
+	if s.http == nil {
+		return nil
+	}
+	return s.http.Addr()
+}
+
+// UDPAddr is the address UDP announces go to, nil without UDP.
+func (s *TrackerServer) UDPAddr() net.Addr {
+	if s.udp == nil {
+		return nil
+	}
+	return s.udp.LocalAddr()
+}
+
+// Serve answers announces and scrapes until Close, then saves the swarms
+// and returns whether that went well.
+func (s *TrackerServer) Serve() error {
+	var wg sync.WaitGroup
+	if s.http != nil {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/announce", s.handleAnnounce)
+		mux.HandleFunc("/scrape", s.handleScrape)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			http.Serve(s.http, mux)
+		}()
+	}
+	if s.udp != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveUDP()
+		}()
+	}
+
+	ticker := time.NewTicker(serverSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.sweep()
+		case <-s.done:
+			wg.Wait()
+			if s.cfg.StatePath == "" {
+				return nil
+			}
+			return s.save()
+		}
+	}
+}
+
+// Close stops answering, Serve returns once the swarms are saved.
+func (s *TrackerServer) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		if s.http != nil {
+			s.http.Close()
+		}
+		if s.udp != nil {
+			s.udp.Close()
+		}
+	})
+	return nil
+}
+
+// sweep forgets the peers that stopped announcing and saves the swarms.
+func (s *TrackerServer) sweep() {
+	s.mu.Lock()
+	s.expire(time.Now())
+	s.mu.Unlock()
+	if s.cfg.StatePath != "" {
+		err := s.save()
+		if err != nil {
+			log.Println(utils.BoldRed("Could not save the swarms (", err, ")"))
+		}
+	}
+}
+
+// expire drops peers not seen for two intervals and swarms left empty that
+// never saw a download, s.mu must be held.
+func (s *TrackerServer) expire(now time.Time) {
+	for infoHash, sw := range s.swarms {
+		for id, p := range sw.peers {
+			if now.Sub(p.seen) > 2*s.cfg.Interval {
+				delete(sw.peers, id)
+			}
+		}
+		if len(sw.peers) == 0 && sw.downloaded == 0 {
+			delete(s.swarms, infoHash)
+		}
+	}
+}
+
+// allowed reports whether the torrent is tracked.
+func (s *TrackerServer) allowed(infoHash [20]byte) bool {
+	return s.allow == nil || s.allow[infoHash]
+}
+
+// announce records q and returns up to q.NumWant other peers of the swarm
+// with its seeder and leecher counts. Seeders are not sent other seeders.
+func (s *TrackerServer) announce(q announceQuery) (list []swarmPeer, complete, incomplete int, err error) {
+	if !s.allowed(q.InfoHash) {
+		return nil, 0, 0, errors.New("torrent not allowed")
+	}
+	numWant := q.NumWant
+	if numWant < 0 {
+		numWant = defaultServerNumWant
+	}
+	if numWant > maxServerNumWant {
+		numWant = maxServerNumWant
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sw, ok := s.swarms[q.InfoHash]
+	if !ok {
+		sw = &swarm{peers: make(map[[20]byte]*swarmPeer)}
+		s.swarms[q.InfoHash] = sw
+	}
+	if q.Event == eventStopped {
+		delete(sw.peers, q.PeerID)
+		numWant = 0
+	} else {
+		// a download counts once, when the peer we saw with something left
+		// has nothing left, however often it says completed
+		if prev, ok := sw.peers[q.PeerID]; ok && prev.left > 0 && q.Left == 0 {
+			sw.downloaded++
+		}
+		sw.peers[q.PeerID] = &swarmPeer{id: q.PeerID, peer: q.Peer, left: q.Left, seen: time.Now()}
+	}
+
+	for id, p := range sw.peers {
+		if p.left == 0 {
+			complete++
+		} else {
+			incomplete++
+		}
+		if len(list) >= numWant || id == q.PeerID || (q.Left == 0 && p.left == 0) {
+			continue
+		}
+		if q.Want != nil && !q.Want(p.peer) {
+			continue
+		}
+		list = append(list, *p)
+	}
+	return list, complete, incomplete, nil
+}
+
+// addrs returns the addresses of the peers of list.
+func addrs(list []swarmPeer) []peers.Peer {
+	addrList := make([]peers.Peer, 0, len(list))
+	for _, p := range list {
+		addrList = append(addrList, p.peer)
+	}
+	return addrList
+}
+
+// scrape returns the stats of the tracked torrents among infoHashes, or of
+// every tracked torrent if there are none.
+func (s *TrackerServer) scrape(infoHashes [][20]byte) map[[20]byte]ScrapeStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(infoHashes) == 0 {
+		for infoHash := range s.swarms {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+	stats := make(map[[20]byte]ScrapeStats, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		sw, ok := s.swarms[infoHash]
+		if !ok || !s.allowed(infoHash) {
+			continue
+		}
+		st := ScrapeStats{Downloaded: sw.downloaded}
+		for _, p := range sw.peers {
+			if p.left == 0 {
+				st.Complete++
+			} else {
+				st.Incomplete++
+			}
+		}
+		stats[infoHash] = st
+	}
+	return stats
+}
+
+func (s *TrackerServer) handleAnnounce(w http.ResponseWriter, r *http.Request) {
+	q, compact, err := parseAnnounceQuery(r)
+	var resp bencodeTrackerResp
+	if err == nil {
+		var list []swarmPeer
+		list, resp.Complete, resp.Incomplete, err = s.announce(q)
+		resp.Interval = int(s.cfg.Interval / time.Second)
+		if compact {
+			resp.Peers, _ = bencode.EncodeBytes(string(peers.Marshal(addrs(list))))
+			resp.Peers6 = string(peers.Marshal6(addrs(list)))
+		} else {
+			noPeerID := r.URL.Query().Get("no_peer_id") == "1"
+			dicts := make([]bencodeTrackerPeer, 0, len(list))
+			for _, p := range list {
+				d := bencodeTrackerPeer{IP: p.peer.IP.String(), Port: p.peer.Port}
+				if !noPeerID {
+					d.PeerID = string(p.id[:])
+				}
+				dicts = append(dicts, d)
+			}
+			resp.Peers, _ = bencode.EncodeBytes(dicts)
+		}
+	}
+	if err != nil {
+		resp = bencodeTrackerResp{FailureReason: err.Error()}
+	}
+	writeBencode(w, resp)
+}
+
+func (s *TrackerServer) handleScrape(w http.ResponseWriter, r *http.Request) {
+	var infoHashes [][20]byte
+	for _, param := range r.URL.Query()["info_hash"] {
+		if len(param) != 20 {
+			writeBencode(w, bencodeScrapeResp{FailureReason: "invalid info_hash"})
+			return
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], param)
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	resp := bencodeScrapeResp{Files: make(map[string]bencodeScrapeFile)}
+	for infoHash, st := range s.scrape(infoHashes) {
+		resp.Files[string(infoHash[:])] = bencodeScrapeFile{
+			Complete:   st.Complete,
+			Downloaded: st.Downloaded,
+			Incomplete: st.Incomplete,
+		}
+	}
+	writeBencode(w, resp)
+}
+
+func writeBencode(w http.ResponseWriter, v interface{}) {
+	data, err := bencode.EncodeBytes(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write(data)
+}
+
+// parseAnnounceQuery reads an HTTP announce. The peer is taken to be at the
+// address the request came from. compact is false only if the peer asked
+// for the original list of dictionaries.
+func parseAnnounceQuery(r *http.Request) (q announceQuery, compact bool, err error) {
+	params := r.URL.Query()
+	infoHash, peerID := params.Get("info_hash"), params.Get("peer_id")
+	if len(infoHash) != 20 {
+		return q, false, errors.New("invalid info_hash")
+	}
+	if len(peerID) != 20 {
+		return q, false, errors.New("invalid peer_id")
+	}
+	copy(q.InfoHash[:], infoHash)
+	copy(q.PeerID[:], peerID)
+
+	port, err := strconv.ParseUint(params.Get("port"), 10, 16)
+	if err != nil || port == 0 {
+		return q, false, errors.New("invalid port")
+	}
+	if params.Get("left") != "" {
+		q.Left, err = strconv.ParseUint(params.Get("left"), 10, 64)
+		if err != nil {
+			return q, false, errors.New("invalid left")
+		}
+	}
+	switch params.Get("event") {
+	case "", "empty":
+	case "started":
+		q.Event = eventStarted
+	case "completed":
+		q.Event = eventCompleted
+	case "stopped":
+		q.Event = eventStopped
+	default:
+		return q, false, errors.New("invalid event")
+	}
+	q.NumWant = -1
+	if params.Get("numwant") != "" {
+		q.NumWant, err = strconv.Atoi(params.Get("numwant"))
+		if err != nil {
+			return q, false, errors.New("invalid numwant")
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return q, false, err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return q, false, errors.New("invalid peer address")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	q.Peer = peers.Peer{IP: ip, Port: uint16(port)}
+	return q, params.Get("compact") != "0", nil
+}
+
+// load reads the swarms saved in StatePath, if any.
+func (s *TrackerServer) load() error {
+	data, err := os.ReadFile(s.cfg.StatePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state bencodeServerState
+	err = bencode.DecodeBytes(data, &state)
+	if err != nil {
+		return err
+	}
+
+	for _, bs := range state.Swarms {
+		if len(bs.InfoHash) != 20 {
+			continue
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], bs.InfoHash)
+		sw := &swarm{peers: make(map[[20]byte]*swarmPeer), downloaded: bs.Downloaded}
+		for _, bp := range bs.Peers {
+			ip := net.ParseIP(bp.IP)
+			if len(bp.PeerID) != 20 || ip == nil {
+				continue
+			}
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			var id [20]byte
+			copy(id[:], bp.PeerID)
+			sw.peers[id] = &swarmPeer{
+				id:   id,
+				peer: peers.Peer{IP: ip, Port: bp.Port},
+				left: bp.Left,
+				seen: time.Unix(bp.Seen, 0),
+			}
+		}
+		s.swarms[infoHash] = sw
+	}
+	s.expire(time.Now())
+	return nil
+}
+
+// save writes the swarms to StatePath.
+func (s *TrackerServer) save() error {
+	s.saveMu.Lock()
+	defer s.saveMu.Unlock()
+
+	var state bencodeServerState
+	s.mu.Lock()
+	for infoHash, sw := range s.swarms {
+		bs := bencodeSwarm{InfoHash: string(infoHash[:]), Downloaded: sw.downloaded}
+		for id, p := range sw.peers {
+			bs.Peers = append(bs.Peers, bencodeSwarmPeer{
+				PeerID: string(id[:]),
+				IP:     p.peer.IP.String(),
+				Port:   p.peer.Port,
+				Left:   p.left,
+				Seen:   p.seen.Unix(),
+			})
+		}
+		state.Swarms = append(state.Swarms, bs)
+	}
+	s.mu.Unlock()
+
+	data, err := bencode.EncodeBytes(state)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(s.cfg.StatePath), os.ModePerm)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so a crash never leaves a torn state file
+	tmp := s.cfg.StatePath + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.cfg.StatePath)
+}
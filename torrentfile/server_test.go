@@ -0,0 +1,227 @@
+package torrentfile
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aryanA101a/villi/peers"
+	bencode "github.com/zeebo/bencode"
+)
+
+// newTestServer runs a tracker server on local HTTP and UDP ports until the
+// test ends.
+func newTestServer(t *testing.T) *TrackerServer {
+	s, err := ListenTracker(ServerConfig{HTTPAddr: "127.0.0.1:0", UDPAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error)
+	go func() { served <- s.Serve() }()
+	t.Cleanup(func() {
+		s.Close()
+		if err := <-served; err != nil {
+			t.Error(err)
+		}
+	})
+	return s
+}
+
+func testPeerID(n byte) [20]byte {
+	return [20]byte{'-', 'T', 'T', n}
+}
+
+// httpAnnounce announces the peer numbered n, listening on port 1000+n, with
+// the extra params.
+func httpAnnounce(t *testing.T, s *TrackerServer, infoHash [20]byte, n byte, left uint64, params url.Values) bencodeTrackerResp {
+	t.Helper()
+	id := testPeerID(n)
+	params.Set("info_hash", string(infoHash[:]))
+	params.Set("peer_id", string(id[:]))
+	params.Set("port", strconv.Itoa(1000+int(n)))
+	params.Set("left", strconv.FormatUint(left, 10))
+	resp, err := http.Get("http://" + s.HTTPAddr().String() + "/announce?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var r bencodeTrackerResp
+	err = bencode.NewDecoder(resp.Body).Decode(&r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.FailureReason != "" {
+		t.Fatalf("announce failed: %s", r.FailureReason)
+	}
+	return r
+}
+
+func checkScrape(t *testing.T, announceURL string, infoHash [20]byte, want ScrapeStats) {
+	t.Helper()
+	stats, err := Scrape(announceURL, [][20]byte{infoHash}, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := stats[infoHash]; !ok || got != want {
+		t.Errorf("scrape of %s got %+v, want %+v", announceURL, got, want)
+	}
+}
+
+func TestServerHTTP(t *testing.T) {
+	s := newTestServer(t)
+	announceURL := "http://" + s.HTTPAddr().String() + "/announce"
+	infoHash := [20]byte{1}
+
+	// a leecher, then a seeder that is sent the leecher
+	r := httpAnnounce(t, s, infoHash, 1, 100, url.Values{"event": {"started"}})
+	if r.Interval != int(defaultServerInterval/time.Second) || r.Complete != 0 || r.Incomplete != 1 {
+		t.Errorf("first announce got interval %d, %d seeders, %d leechers", r.Interval, r.Complete, r.Incomplete)
+	}
+	r = httpAnnounce(t, s, infoHash, 2, 0, url.Values{"event": {"started"}})
+	if r.Complete != 1 || r.Incomplete != 1 {
+		t.Errorf("second announce got %d seeders, %d leechers", r.Complete, r.Incomplete)
+	}
+	var compact string
+	err := bencode.DecodeBytes(r.Peers, &compact)
+	if err != nil {
+		t.Fatalf("peers not compact: %v", err)
+	}
+	list, err := peers.Unmarshal([]byte(compact))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].String() != "127.0.0.1:1001" {
+		t.Errorf("compact peers %v, want the leecher", list)
+	}
+	checkScrape(t, announceURL, infoHash, ScrapeStats{Complete: 1, Incomplete: 1})
+
+	// the list of dictionaries, with peer ids unless asked not to
+	tests := []struct {
+		params url.Values
+		wantID bool
+	}{
+		{url.Values{"compact": {"0"}}, true},
+		{url.Values{"compact": {"0"}, "no_peer_id": {"1"}}, false},
+	}
+	for _, tt := range tests {
+		r = httpAnnounce(t, s, infoHash, 3, 50, tt.params)
+		var dicts []bencodeTrackerPeer
+		err = bencode.DecodeBytes(r.Peers, &dicts)
+		if err != nil {
+			t.Fatalf("%v: peers not a list: %v", tt.params, err)
+		}
+		if len(dicts) != 2 {
+			t.Fatalf("%v: got %d peers, want 2", tt.params, len(dicts))
+		}
+		for _, d := range dicts {
+			want := ""
+			if tt.wantID {
+				id := testPeerID(byte(d.Port - 1000))
+				want = string(id[:])
+			}
+			if d.IP != "127.0.0.1" || d.PeerID != want {
+				t.Errorf("%v: got peer %+v", tt.params, d)
+			}
+		}
+	}
+
+	// a peer that stops is gone from the swarm
+	httpAnnounce(t, s, infoHash, 1, 100, url.Values{"event": {"stopped"}})
+	checkScrape(t, announceURL, infoHash, ScrapeStats{Complete: 1, Incomplete: 1})
+	r = httpAnnounce(t, s, infoHash, 2, 0, url.Values{})
+	bencode.DecodeBytes(r.Peers, &compact)
+	if list, _ := peers.Unmarshal([]byte(compact)); len(list) != 1 || list[0].Port != 1003 {
+		t.Errorf("after a stop got peers %v, want the one left", list)
+	}
+}
+
+func TestServerUDP(t *testing.T) {
+	s := newTestServer(t)
+	u := &udpTracker{addr: s.UDPAddr().String()}
+	announceURL := "udp://" + s.UDPAddr().String() + "/announce"
+	infoHash := [20]byte{2}
+
+	req := announceRequest{PeerID: testPeerID(1), Port: 1001, Event: eventStarted, Left: 100, NumWant: -1}
+	resp, err := u.announce(infoHash, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interval != defaultServerInterval || len(resp.Peers) != 0 || resp.Leechers != 1 {
+		t.Errorf("first announce got %+v", resp)
+	}
+	req = announceRequest{PeerID: testPeerID(2), Port: 1002, Event: eventStarted, NumWant: -1}
+	resp, err = u.announce(infoHash, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Seeders != 1 || resp.Leechers != 1 || len(resp.Peers) != 1 || resp.Peers[0].String() != "127.0.0.1:1001" {
+		t.Errorf("second announce got %+v", resp)
+	}
+	checkScrape(t, announceURL, infoHash, ScrapeStats{Complete: 1, Incomplete: 1})
+
+	// a peer that stops is gone from the swarm
+	req = announceRequest{PeerID: testPeerID(1), Port: 1001, Event: eventStopped, Left: 100}
+	_, err = u.announce(infoHash, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkScrape(t, announceURL, infoHash, ScrapeStats{Complete: 1})
+}
+
+func TestServerBadConnectionID(t *testing.T) {
+	s := newTestServer(t)
+	conn, err := net.Dial("udp", s.UDPAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	for _, action := range []uint32{actionAnnounce, actionScrape} {
+		packet := udpPacket(0x0123456789abcdef, action, make([]byte, 82))
+		_, err := exchange(conn, packet, time.Now().Add(5*time.Second))
+		var trackerErr *TrackerError
+		if !errors.As(err, &trackerErr) || trackerErr.Reason != "invalid connection id" {
+			t.Errorf("action %d with a made up connection id got error %v", action, err)
+		}
+	}
+}
+
+func TestServerCompletedOnce(t *testing.T) {
+	s := newTestServer(t)
+	infoHash := [20]byte{3}
+	announce := func(n byte, left uint64, ev event) {
+		t.Helper()
+		_, _, _, err := s.announce(announceQuery{
+			InfoHash: infoHash,
+			PeerID:   testPeerID(n),
+			Peer:     peers.Peer{IP: net.IPv4(127, 0, 0, 1).To4(), Port: 1000 + uint16(n)},
+			Left:     left,
+			Event:    ev,
+			NumWant:  -1,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// repeating completed does not count the download again
+	announce(1, 100, eventStarted)
+	announce(1, 0, eventCompleted)
+	announce(1, 0, eventCompleted)
+	announce(1, 0, eventNone)
+	// a seeder from the start did not download it here
+	announce(2, 0, eventStarted)
+	announce(2, 0, eventCompleted)
+	// nor is saying completed needed
+	announce(3, 50, eventStarted)
+	announce(3, 0, eventNone)
+
+	want := ScrapeStats{Complete: 3, Downloaded: 2}
+	if got := s.scrape([][20]byte{infoHash})[infoHash]; got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
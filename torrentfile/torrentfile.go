@@ -6,12 +6,20 @@ import (
 	"io/ioutil"
 	"log"
 	"math/rand"
-	"net/url"
+	"net"
 	"os"
-	"path"
-
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aryanA101a/villi/bitfield"
+	"github.com/aryanA101a/villi/client"
+	"github.com/aryanA101a/villi/lsd"
+	"github.com/aryanA101a/villi/mse"
 	"github.com/aryanA101a/villi/p2p"
 	"github.com/aryanA101a/villi/peers"
+	"github.com/aryanA101a/villi/storage"
 	"github.com/aryanA101a/villi/ui"
 	"github.com/aryanA101a/villi/utils"
 	bencode "github.com/zeebo/bencode"
@@ -24,72 +32,143 @@ const Max_Peer int = 30
 const Port uint16 = 6881
 
 type TorrentFile struct {
-	Announce    []string
+	// Announce are the tracker URLs by tier, tried in order (BEP 12)
+	Announce    [][]string
 	InfoHash    [20]byte
 	PieceHashes [][20]byte
 	PieceLength uint
 	Length      uint64
 	Name        string
 	Files       []*file
+	// Private torrents only get peers from their trackers
+	Private bool
+	// info is the bencoded info dictionary, nil for a magnet link until it
+	// was fetched from peers
+	info []byte
+	// peers known without asking a tracker, e.g. from a magnet link
+	peers []peers.Peer
+	// DHT nodes listed in the torrent, as host:port
+	nodes []string
+}
+
+// Config holds the settings of a download that are chosen by the user.
+type Config struct {
+	// Seeding after the download ends when either limit is reached, zero
+	// disables a limit
+	SeedRatio float64
+	SeedTime  time.Duration
+	// NoSeed stops as soon as the download is complete
+	NoSeed bool
+	// NoDHT skips looking for peers in the DHT
+	NoDHT bool
+	// DHTBootstrap are the host:port addresses used to join the DHT,
+	// dht.DefaultBootstrap if empty
+	DHTBootstrap []string
+	// NoLSD skips announcing the torrent on the local network
+	NoLSD bool
+	// Encryption is whether peer connections are encrypted with MSE
+	Encryption mse.Policy
+	// NoUTP connects to and accepts peers over TCP only
+	NoUTP bool
+	// Stop, once closed, ends the download or seeding early and tells the
+	// trackers we stopped
+	Stop <-chan struct{}
 }
 
 type bencodeInfo struct {
 	Pieces      string             `bencode:"pieces"`
 	PieceLength uint               `bencode:"piece length"`
-	Length      uint64             `bencode:"length"`
+	Length      uint64             `bencode:"length,omitempty"`
 	Name        string             `bencode:"name"`
-	Files       bencode.RawMessage `bencode:"files"`
+	Files       bencode.RawMessage `bencode:"files,omitempty"`
+	Private     int                `bencode:"private,omitempty"`
+	// Source tells apart torrents of the same files made for different
+	// trackers
+	Source string `bencode:"source,omitempty"`
 }
 
 type bencodeTorrent struct {
-	Announce     string             `bencode:"announce"`
-	AnnounceList [][]string         `bencode:"announce-list"`
+	Announce     string             `bencode:"announce,omitempty"`
+	AnnounceList [][]string         `bencode:"announce-list,omitempty"`
 	Info         bencode.RawMessage `bencode:"info"`
+	Nodes        [][]interface{}    `bencode:"nodes,omitempty"`
+	Comment      string             `bencode:"comment,omitempty"`
+	CreatedBy    string             `bencode:"created by,omitempty"`
+	CreationDate int64              `bencode:"creation date,omitempty"`
+	// URLList are the web seeds (BEP 19), a list or a single string
+	URLList bencode.RawMessage `bencode:"url-list,omitempty"`
 }
 type bencodeInfoFile struct {
 	Path   []string `bencode:"path"`
 	Length uint64   `bencode:"length"`
 }
 type file struct {
-	Path        string
-	Length      uint64
-	FilePointer *os.File
+	Path   string
+	Length uint64
 }
 
-func (t *TorrentFile) DownloadToFile(path string) error {
+func (t *TorrentFile) DownloadToFile(path string, cfg Config) error {
 	var peerID [20]byte
 	_, err := rand.Read(peerID[:])
 	if err != nil {
 		return nil
 	}
-	var peerList []peers.Peer
-	peerDict := make(map[string]peers.Peer)
 
-	for _, announceURL := range t.Announce {
-		if len(peerDict) >= Max_Peer {
-			break
-		}
-		u, err := url.Parse(announceURL)
+	dialer := client.Dialer{Encryption: cfg.Encryption}
+	port := Port
+	listener, err := p2p.Listen(Port, !cfg.NoUTP)
+	if err != nil {
+		log.Println(utils.BoldRed("Could not listen for peers (", err, "), seeding to inbound peers is disabled\n"))
+	} else {
+		port = listener.Port()
+		listener.Encryption = cfg.Encryption
+		dialer.UTP = listener.UTP()
+		defer listener.Close()
+		go listener.Serve()
+	}
+
+	// with the info dictionary at hand the pieces on disk are known before
+	// trackers are asked, so they hear what is actually left
+	var store *storage.Storage
+	var bf bitfield.Bitfield
+	var resumePath string
+	left := uint64(unknownLeft)
+	if t.info != nil {
+		store, bf, resumePath, err = t.openResume()
 		if err != nil {
-			continue
+			return err
 		}
+		defer store.Close()
+		left = t.left(bf)
+	}
 
-		log.Println(utils.Bold("Contacting tracker[" + announceURL + "] for peer list..."))
+	var peerList []peers.Peer
+	peerDict := make(map[string]peers.Peer)
+	for _, peer := range t.peers {
+		peerDict[peer.String()] = peer
+	}
 
-		var result []peers.Peer
-		result, err = t.requestPeers(u, peerID, Port)
+	// trackers and the DHT are asked side by side, the download waits only
+	// for what they return by then
+	a := t.newAnnouncer(announceRequest{
+		PeerID:  peerID,
+		Port:    port,
+		Key:     rand.Uint32(),
+		NumWant: p2p.MaxPeers,
+	}, left)
+	if !cfg.NoDHT && !t.Private {
+		node, err := newDHTNode(port, dialer.UTP)
 		if err != nil {
-			log.Println(utils.BoldRed("Failed(", err, "). Trying again...\n"))
-			continue
-		}
-
-		log.Println(utils.Bold("Got: "), result)
-		for _, peer := range result {
-			if _, ok := peerDict[peer.String()]; !ok {
-				peerDict[peer.String()] = peer
-			}
+			log.Println(utils.BoldRed("DHT lookup failed(", err, ")\n"))
+		} else {
+			defer node.Close()
+			a.addDHT(node, cfg.DHTBootstrap)
 		}
-
+	}
+	a.start()
+	defer a.stop()
+	for _, peer := range a.waitPeers(Max_Peer, initialAnnounceTimeout) {
+		peerDict[peer.String()] = peer
 	}
 	peerList = append(peerList, maps.Values(peerDict)...)
 
@@ -97,10 +176,30 @@ func (t *TorrentFile) DownloadToFile(path string) error {
 
 	log.Print("\n\n", utils.Bold("Got ", len(peerList), " peers"), "\n", utils.Bold("Final PeerList: "), peerList,"\n\n")
 
-	if peerList == nil {
-
-		return err
+	if t.info == nil {
+		ui.UpdateUI(ui.Status("fetching metadata..."))
+		log.Println(utils.Bold("Fetching metadata for ", t.Name))
+		info, err := p2p.FetchMetadata(peerList, peerID, t.InfoHash, dialer)
+		if err != nil {
+			return err
+		}
+		err = t.loadInfo(info, path)
+		if err != nil {
+			return err
+		}
+		if t.Private {
+			// private torrents only get peers from their trackers
+			log.Println(utils.Bold(t.Name, " is private, leaving the DHT"))
+			a.dropDHT()
+		}
+		ui.UpdateUI(ui.FileName(t.Name))
+		ui.UpdateUI(ui.FileSize(utils.ConvertToHumanReadable(t.Length)))
 
+		store, bf, resumePath, err = t.openResume()
+		if err != nil {
+			return err
+		}
+		defer store.Close()
 	}
 
 	torrent := p2p.Torrent{
@@ -112,29 +211,121 @@ func (t *TorrentFile) DownloadToFile(path string) error {
 		Length:         t.Length,
 		Name:           t.Name,
 		ConnectedPeers: 0,
+		Storage:        store,
+		Bitfield:       bf,
+		ResumePath:     resumePath,
+		Info:           t.info,
+		Private:        t.Private,
+		Dialer:         dialer,
 	}
+	if listener != nil {
+		torrent.Port = listener.Port()
+		listener.Add(&torrent)
+		defer listener.Remove(&torrent)
+
+		if !cfg.NoLSD && !t.Private {
+			service, err := lsd.New(listener.Port())
+			if err != nil {
+				log.Println(utils.BoldRed("Local service discovery is disabled (", err, ")\n"))
+			} else {
+				defer service.Close()
+				service.Add(t.InfoHash, func(peer peers.Peer) {
+					log.Println(utils.Bold("Found local peer ", peer))
+					torrent.AddPeers([]peers.Peer{peer})
+				})
+			}
+		}
+	}
+	defer torrent.Stop()
+
+	a.attach(&torrent)
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-cfg.Stop:
+			log.Println(utils.Bold("Stopping ", t.Name))
+			torrent.Stop()
+		case <-finished:
+		}
+	}()
+	stopped := func() bool {
+		select {
+		case <-cfg.Stop:
+			return true
+		default:
+			return false
+		}
+	}
+
 	ui.UpdateUI(ui.Status("downloading..."))
 
-	buf, err := torrent.Download()
+	err = torrent.Download()
 	if err != nil {
+		if stopped() {
+			return nil
+		}
 		return err
 	}
-	ui.UpdateUI(ui.Status("writing file to disk..."))
-	offset := uint64(0)
-	for _, f := range t.Files {
-		_, err = f.FilePointer.Write(buf[offset:f.Length])
-		if err != nil {
-			return err
+	if cfg.NoSeed || stopped() {
+		return nil
+	}
+
+	ui.UpdateUI(ui.Status("seeding..."))
+	torrent.Seed(cfg.SeedRatio, cfg.SeedTime)
+	return nil
+
+}
+
+// openResume opens the torrent's files and reads which pieces are complete
+// on disk.
+func (t *TorrentFile) openResume() (*storage.Storage, bitfield.Bitfield, string, error) {
+	store, err := t.openStorage()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	resumePath, err := storage.ResumePath(t.InfoHash)
+	if err != nil {
+		store.Close()
+		return nil, nil, "", err
+	}
+	bf, err := store.LoadResume(resumePath, t.InfoHash, t.PieceHashes)
+	if err != nil {
+		store.Close()
+		return nil, nil, "", err
+	}
+	return store, bf, resumePath, nil
+}
+
+// left returns the number of bytes of the pieces missing from bf.
+func (t *TorrentFile) left(bf bitfield.Bitfield) uint64 {
+	var left uint64
+	for index := range t.PieceHashes {
+		if bf.HasPiece(index) {
+			continue
 		}
-		offset += f.Length
-		err = f.FilePointer.Close()
-		if err != nil {
-			return err
+		begin := uint64(index) * uint64(t.PieceLength)
+		end := begin + uint64(t.PieceLength)
+		if end > t.Length {
+			end = t.Length
 		}
+		left += end - begin
 	}
+	return left
+}
 
-	return nil
+func (t *TorrentFile) storageFiles() []storage.File {
+	files := make([]storage.File, 0, len(t.Files))
+	for _, f := range t.Files {
+		files = append(files, storage.File{Path: f.Path, Length: f.Length})
+	}
+	return files
+}
 
+// openStorage opens (creating where needed) the files of the torrent on disk.
+func (t *TorrentFile) openStorage() (*storage.Storage, error) {
+	return storage.New(t.storageFiles(), t.PieceLength)
 }
 
 func Open(inPath string, outPath string) (TorrentFile, error) {
@@ -175,91 +366,132 @@ func (i *bencodeInfo) splitPiecesHashes() ([][20]byte, error) {
 	return hashes, nil
 }
 
+// filePath builds the on-disk location of a torrent file from the torrent name
+// and the path components of its info dictionary entry, refusing components
+// that would escape the output directory.
+func filePath(outPath string, name string, components []string) (string, error) {
+	elems := append([]string{name}, components...)
+	for _, elem := range elems {
+		if elem == "" || elem == "." || elem == ".." || strings.ContainsAny(elem, "/\\") {
+			return "", fmt.Errorf("invalid path component %q", elem)
+		}
+	}
+	return filepath.Join(append([]string{outPath}, elems...)...), nil
+}
+
 func (bto *bencodeTorrent) toTorrentFile(outPath string) (TorrentFile, error) {
+	//parse tracker urls, keeping the tiers of announce-list
+	var announceList [][]string
+	for _, tier := range bto.AnnounceList {
+		var urls []string
+		for _, url := range tier {
+			if url != "" {
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) > 0 {
+			announceList = append(announceList, urls)
+		}
+	}
+	if len(announceList) == 0 && bto.Announce != "" {
+		announceList = [][]string{{bto.Announce}}
+	}
 
-	bencodeInfo := bencodeInfo{}
-	err := bencode.DecodeBytes(bto.Info, &bencodeInfo)
+	//parse dht nodes, a list of [host, port] pairs
+	var nodes []string
+	for _, node := range bto.Nodes {
+		if len(node) != 2 {
+			continue
+		}
+		host, ok := node[0].(string)
+		port, ok2 := node[1].(int64)
+		if !ok || !ok2 {
+			continue
+		}
+		nodes = append(nodes, net.JoinHostPort(host, strconv.FormatInt(port, 10)))
+	}
+
+	t := TorrentFile{
+		Announce: announceList,
+		nodes:    nodes,
+	}
+	err := t.loadInfo(bto.Info, outPath)
 	if err != nil {
 		return TorrentFile{}, err
 	}
+	return t, nil
+}
+
+// loadInfo fills in the torrent from its bencoded info dictionary.
+func (t *TorrentFile) loadInfo(info []byte, outPath string) error {
+
+	bencodeInfo := bencodeInfo{}
+	err := bencode.DecodeBytes(info, &bencodeInfo)
+	if err != nil {
+		return err
+	}
 
 	//sha1 hash of info dict in .torrent file
-	infoHash := sha1.Sum(bto.Info)
+	infoHash := sha1.Sum(info)
 
 	//a slice containing sha1 hash of each piece
 	pieceHashes, err := bencodeInfo.splitPiecesHashes()
 	if err != nil {
-		return TorrentFile{}, err
+		return err
 	}
 	var length uint64
 	files := make([]*file, 0)
-	if err != nil {
-		return TorrentFile{}, err
-	}
 
 	if bencodeInfo.Length > 0 {
-		var filePointer *os.File
-		name := path.Join(outPath, bencodeInfo.Name)
-		filePointer, err = os.Create(name)
+		name, err := filePath(outPath, bencodeInfo.Name, nil)
 		if err != nil {
-
-			return TorrentFile{}, err
+			return err
 		}
-
 		files = append(files, &file{
-			Path:        name,
-			Length:      bencodeInfo.Length,
-			FilePointer: filePointer,
+			Path:   name,
+			Length: bencodeInfo.Length,
 		})
 		length = bencodeInfo.Length
 
 	} else {
-		err = os.Mkdir(path.Join(outPath, bencodeInfo.Name), os.ModePerm)
-		if err != nil && os.IsNotExist(err) {
-			return TorrentFile{}, err
-		}
-
 		bencodeInfoFiles := make([]*bencodeInfoFile, 0)
 		err = bencode.DecodeBytes(bencodeInfo.Files, &bencodeInfoFiles)
 		if err != nil {
-			return TorrentFile{}, err
+			return err
 		}
 
 		for _, f := range bencodeInfoFiles {
-			var filePointer *os.File
-			name := path.Join(outPath, bencodeInfo.Name+"/"+f.Path[0])
-			filePointer, err = os.Create(name)
+			if len(f.Path) == 0 {
+				return fmt.Errorf("file entry without a path in %s", bencodeInfo.Name)
+			}
+			name, err := filePath(outPath, bencodeInfo.Name, f.Path)
 			if err != nil {
-				return TorrentFile{}, err
+				return err
 			}
-
 			files = append(files, &file{
-				Path:        name,
-				Length:      f.Length,
-				FilePointer: filePointer,
+				Path:   name,
+				Length: f.Length,
 			})
 			length += f.Length
 		}
 	}
 
-	//parse tracker urls
-	var announceList []string
-	if len(bto.AnnounceList) > 0 {
-		for _, tier := range bto.AnnounceList {
-			announceList = append(announceList, tier...)
-		}
-	} else {
-		announceList = append(announceList, bto.Announce)
+	// storage divides by the piece length and takes a hash for every piece
+	if bencodeInfo.PieceLength == 0 {
+		return fmt.Errorf("piece length of %s is 0", bencodeInfo.Name)
 	}
-
-	t := TorrentFile{
-		Announce:    announceList,
-		InfoHash:    infoHash,
-		PieceHashes: pieceHashes,
-		PieceLength: bencodeInfo.PieceLength,
-		Length:      length,
-		Name:        bencodeInfo.Name,
-		Files:       files,
+	numPieces := (length + uint64(bencodeInfo.PieceLength) - 1) / uint64(bencodeInfo.PieceLength)
+	if uint64(len(pieceHashes)) != numPieces {
+		return fmt.Errorf("%s has %d piece hashes for %d pieces", bencodeInfo.Name, len(pieceHashes), numPieces)
 	}
-	return t, nil
+
+	t.InfoHash = infoHash
+	t.PieceHashes = pieceHashes
+	t.PieceLength = bencodeInfo.PieceLength
+	t.Length = length
+	t.Name = bencodeInfo.Name
+	t.Files = files
+	t.Private = bencodeInfo.Private == 1
+	t.info = info
+	return nil
 }
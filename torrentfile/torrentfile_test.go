@@ -0,0 +1,52 @@
+package torrentfile
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aryanA101a/villi/ui"
+	bencode "github.com/zeebo/bencode"
+)
+
+func TestMain(m *testing.M) {
+	// no UI to show progress in
+	ui.UpdateUI = func(interface{}) {}
+	os.Exit(m.Run())
+}
+
+func TestLoadInfo(t *testing.T) {
+	hashes := func(n int) string { return strings.Repeat("01234567890123456789", n) }
+	files, err := bencode.EncodeBytes([]bencodeInfoFile{
+		{Path: []string{"a"}, Length: 10},
+		{Path: []string{"b", "c"}, Length: 7},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		info    bencodeInfo
+		wantErr bool
+	}{
+		{"single file", bencodeInfo{Name: "f", Length: 20, PieceLength: 8, Pieces: hashes(3)}, false},
+		{"multiple files", bencodeInfo{Name: "d", Files: files, PieceLength: 16, Pieces: hashes(2)}, false},
+		{"whole pieces", bencodeInfo{Name: "f", Length: 16, PieceLength: 8, Pieces: hashes(2)}, false},
+		// used to divide by zero once on disk
+		{"no piece length", bencodeInfo{Name: "f", Length: 20, Pieces: hashes(3)}, true},
+		{"missing hash", bencodeInfo{Name: "f", Length: 20, PieceLength: 8, Pieces: hashes(2)}, true},
+		{"extra hash", bencodeInfo{Name: "d", Files: files, PieceLength: 16, Pieces: hashes(3)}, true},
+		{"partial hash", bencodeInfo{Name: "f", Length: 20, PieceLength: 8, Pieces: hashes(3)[:59]}, true},
+	}
+	for _, tt := range tests {
+		info, err := bencode.EncodeBytes(tt.info)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var tf TorrentFile
+		err = tf.loadInfo(info, t.TempDir())
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: got error %v", tt.name, err)
+		}
+	}
+}
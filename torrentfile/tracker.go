@@ -1,11 +1,7 @@
 package torrentfile
 
 import (
-	"bytes"
-	"crypto/sha1"
-	"encoding/binary"
 	"fmt"
-	"math/rand"
 	"net"
 	"net/http"
 	"net/url"
@@ -13,350 +9,234 @@ import (
 	"time"
 
 	"github.com/aryanA101a/villi/peers"
-	"github.com/jackpal/bencode-go"
+	bencode "github.com/zeebo/bencode"
 )
 
 type bencodeTrackerResp struct {
-	Interval int    `bencode:"interval"`
-	Peers    string `bencode:"peers"`
+	FailureReason  string `bencode:"failure reason,omitempty"`
+	WarningMessage string `bencode:"warning message,omitempty"`
+	Interval       int    `bencode:"interval,omitempty"`
+	MinInterval    int    `bencode:"min interval,omitempty"`
+	TrackerID      string `bencode:"tracker id,omitempty"`
+	Complete       int    `bencode:"complete,omitempty"`
+	Incomplete     int    `bencode:"incomplete,omitempty"`
+	// Peers is a compact string or, in the original model, a list of
+	// dictionaries
+	Peers  bencode.RawMessage `bencode:"peers,omitempty"`
+	Peers6 string             `bencode:"peers6,omitempty"`
 }
 
-func (t *TorrentFile) buildTrackerURL(announceURL string, peerID [20]byte, port uint16) (string, error) {
-	base, err := url.Parse(announceURL)
-	if err != nil {
-		return "", err
-	}
-	params := url.Values{
-		"info_hash":  []string{string(t.InfoHash[:])},
-		"peer_id":    []string{string(peerID[:])},
-		"port":       []string{strconv.Itoa(int(Port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
-		"compact":    []string{"1"},
-		"left":       []string{strconv.FormatUint(t.Length,10)},
-	}
-	base.RawQuery = params.Encode()
-	return base.String(), nil
+type bencodeTrackerPeer struct {
+	PeerID string `bencode:"peer id,omitempty"`
+	IP     string `bencode:"ip"`
+	Port   uint16 `bencode:"port"`
 }
 
-func (t *TorrentFile) requestPeers(announceURL *url.URL, peerID [20]byte, port uint16) ([]peers.Peer, error) {
-	var peers []peers.Peer
-	var err error
-
-	switch announceURL.Scheme {
-	case "http":
-		peers, err = t.requestPeersHTTP(announceURL, peerID, port)
-	case "udp":
-		peers, err = t.requestPeersUDP(announceURL, peerID, port)
-	default:
-		err = fmt.Errorf("announce url not recognized")
-	}
-	return peers, err
+// TrackerError is a failure reason a tracker gave instead of peers.
+type TrackerError struct {
+	Reason string
 }
 
-func (t *TorrentFile) requestPeersHTTP(announceURL *url.URL, peerID [20]byte, port uint16) ([]peers.Peer, error) {
-	url, err := t.buildTrackerURL(announceURL.String(), peerID, port)
-	if err != nil {
-		return nil, err
-	}
-
-	c := &http.Client{Timeout: 15 * time.Second}
-	resp, err := c.Get(url)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	trackerResp := bencodeTrackerResp{}
-	err = bencode.Unmarshal(resp.Body, &trackerResp)
-	if err != nil {
-		return nil, err
-	}
-
-	return peers.Unmarshal([]byte(trackerResp.Peers))
+func (e *TrackerError) Error() string {
+	return "tracker failure: " + e.Reason
 }
 
-func (t *TorrentFile) requestPeersUDP(announceURL *url.URL, peerID [20]byte, port uint16) ([]peers.Peer, error) {
-	
-	conn, err := net.Dial("udp", announceURL.Host)
-	if err != nil {
-		return nil, err
-	}
-	defer conn.Close()
+// event tells a tracker why we announce, numbered as in UDP announces
+type event uint32
 
-	var connID uint64
-	err = conn.SetDeadline(time.Now().Add(4 * time.Second))
-	if err != nil {
-		return nil, err
-	}
-	connID, err = connectReqUDP(conn)
-	if err != nil {
-		return nil, err
-	}
-
-	
+const (
+	eventNone event = iota
+	eventCompleted
+	eventStarted
+	eventStopped
+)
 
-	var peers []peers.Peer
-	peers, err = announceReqUDP(conn, connID, peerID, port, *t)
-	
-	if err != nil {
-		return nil, err
+func (e event) String() string {
+	switch e {
+	case eventCompleted:
+		return "completed"
+	case eventStarted:
+		return "started"
+	case eventStopped:
+		return "stopped"
 	}
-
-
-	return peers, nil
-
+	return ""
 }
 
-func connectReqUDP(conn net.Conn) (uint64, error) {
-
-	/*
-		connect request:
-			Offset  Size            Name            Value
-			0       64-bit integer  protocol_id     0x41727101980 // magic constant
-			8       32-bit integer  action          0 // connect
-			12      32-bit integer  transaction_id
-			16
-
-		connect response:
-			Offset  Size            Name            Value
-			0       32-bit integer  action          0 // connect
-			4       32-bit integer  transaction_id
-			8       64-bit integer  connection_id
-			16
-
-	*/
-
-	connectPacket, err := buildConnectPacket()
-	if err != nil {
-		return 0, err
-	}
-
-	transactionID := binary.BigEndian.Uint32(connectPacket[12:])
-
-	_, err = conn.Write(connectPacket)
-	if err != nil {
-		return 0, err
-	}
-
-	respBytes := make([]byte, 16)
-	var respLen int
-	respLen, err = conn.Read(respBytes)
-	if err != nil {
-		return 0, err
-	}
-
-	if respLen != 16 {
-		err = fmt.Errorf("unexpected response size %d", respLen)
-		return 0, err
-	}
-
-	if binary.BigEndian.Uint32(respBytes[0:4]) != 0 {
-		err = fmt.Errorf("unexpected connect response action")
-		return 0, err
-	}
-
-	if transactionID != binary.BigEndian.Uint32(respBytes[4:8]) {
-		err = fmt.Errorf("TransactionID does not match")
-		return 0, err
-	}
-
-	connectID := binary.BigEndian.Uint64(respBytes[8:])
-	return connectID, nil
+// announceRequest is what we tell a tracker about ourselves and our
+// progress.
+type announceRequest struct {
+	PeerID [20]byte
+	// Port is where we accept peer connections
+	Port  uint16
+	Event event
+	// Uploaded and Downloaded count the bytes transferred since the started
+	// event, Left the bytes of the pieces we still need
+	Uploaded   uint64
+	Downloaded uint64
+	Left       uint64
+	// Key tells us apart from other peers behind the same address, NumWant
+	// is how many peers we ask for, -1 for the tracker's default
+	Key     uint32
+	NumWant int
 }
 
-func buildConnectPacket() ([]byte, error) {
-	packet := make([]byte, 16)
-	transactionID := make([]byte, 4)
-	_, err := rand.Read(transactionID)
-	if err != nil {
-		return nil, err
-	}
-
-	binary.BigEndian.PutUint64(packet[:8], uint64(0x41727101980))
-	binary.BigEndian.PutUint32(packet[8:12], uint32(0))
-	binary.BigEndian.PutUint32(packet[12:], binary.BigEndian.Uint32(transactionID[:]))
-
-	return packet, err
+// tracker is an announce URL and what we remember of it between announces.
+type tracker struct {
+	URL *url.URL
+	// trackerID is what an HTTP tracker asked to get back on later announces
+	trackerID string
+	// started and completed are set once the tracker took those events
+	started   bool
+	completed bool
+	// interval is how long to wait between announces
+	interval time.Duration
+	// udp are the addresses of a UDP tracker with their connection ids
+	udp map[string]*udpTracker
+
+	// status is how the last announce went, shown with the time it was
+	// made and what it returned
+	status       string
+	lastAnnounce time.Time
+	peers        int
+	seeders      int
+	leechers     int
 }
 
-func announceReqUDP(conn net.Conn, connectID uint64, peerID [20]byte, port uint16, t TorrentFile) ([]peers.Peer, error) {
-	/*
-		IPv4 announce request:
-			Offset  Size    Name    Value
-			0       64-bit integer  connection_id
-			8       32-bit integer  action          1 // announce
-			12      32-bit integer  transaction_id
-			16      20-byte string  info_hash
-			36      20-byte string  peer_id
-			56      64-bit integer  downloaded
-			64      64-bit integer  left
-			72      64-bit integer  uploaded
-			80      32-bit integer  event           0 // 0: none; 1: completed; 2: started; 3: stopped
-			84      32-bit integer  IP address      0 // default
-			88      32-bit integer  key
-			92      32-bit integer  num_want        -1 // default
-			96      16-bit integer  port
-			98
-
-		IPv4 announce response:
-			Offset      Size            Name            Value
-			0           32-bit integer  action          1 // announce
-			4           32-bit integer  transaction_id
-			8           32-bit integer  interval
-			12          32-bit integer  leechers
-			16          32-bit integer  seeders
-			20 + 6 * n  32-bit integer  IP address
-			24 + 6 * n  16-bit integer  TCP port
-			20 + 6 * N
-	*/
-
-	announcePacket, err := buildAnnouncePacket(connectID, peerID, port, t)
-	if err != nil {
-		return nil, err
-	}
-	transactionID := announcePacket[12:16]
-	_, err = conn.Write(announcePacket)
-	if err != nil {
-		return nil, err
-	}
-
-	respBuffer := new(bytes.Buffer)
-	var respLen int
-	respBytes := make([]byte, 4096)
-	respLen, err = conn.Read(respBytes)
-	if err != nil {
-		return nil, err
-	}
-
-	err = binary.Write(respBuffer, binary.BigEndian, respBytes[:respLen])
-	if err != nil {
-		return nil, err
-	}
+// trackerResponse is what a tracker answered to an announce.
+type trackerResponse struct {
+	Peers []peers.Peer
+	// Interval is how long to wait before announcing again, MinInterval how
+	// long at least, 0 if the tracker did not say
+	Interval    time.Duration
+	MinInterval time.Duration
+	// Seeders and Leechers are the swarm the tracker knows of
+	Seeders  int
+	Leechers int
+	// Warning is a message from the tracker, the announce still went through
+	Warning string
+}
 
-	if respLen <= 20 {
-		err = fmt.Errorf("unexpected response size")
-		return nil, err
+func (t *TorrentFile) buildTrackerURL(tr *tracker, req announceRequest) (string, error) {
+	base := *tr.URL
+	params := url.Values{
+		"info_hash":  []string{string(t.InfoHash[:])},
+		"peer_id":    []string{string(req.PeerID[:])},
+		"port":       []string{strconv.Itoa(int(req.Port))},
+		"uploaded":   []string{strconv.FormatUint(req.Uploaded, 10)},
+		"downloaded": []string{strconv.FormatUint(req.Downloaded, 10)},
+		"compact":    []string{"1"},
+		"left":       []string{strconv.FormatUint(req.Left, 10)},
 	}
-
-	if binary.BigEndian.Uint32(transactionID[:]) != binary.BigEndian.Uint32(respBuffer.Bytes()[4:8]) {
-		err = fmt.Errorf("transaction id not matching")
-		return nil, err
+	if req.Event != eventNone {
+		params.Set("event", req.Event.String())
 	}
-
-	action := binary.BigEndian.Uint32(respBuffer.Bytes()[0:4])
-	if action != 1 {
-		if action == 3 {
-			err = fmt.Errorf("%d:unexpected announce response action | message:%s", action, string(respBuffer.Bytes()[8:]))
-		} else {
-			err = fmt.Errorf("%d:unexpected announce response action", action)
-
-		}
-		return nil, err
+	params.Set("key", fmt.Sprintf("%08x", req.Key))
+	if req.NumWant >= 0 {
+		params.Set("numwant", strconv.Itoa(req.NumWant))
 	}
-
-	peerList, err := peers.Unmarshal(respBuffer.Bytes()[20:])
-	if err != nil {
-		return nil, err
+	if tr.trackerID != "" {
+		params.Set("trackerid", tr.trackerID)
 	}
-
-	return peerList, nil
+	base.RawQuery = params.Encode()
+	return base.String(), nil
 }
 
-func buildAnnouncePacket(connID uint64, peerID [20]byte, port uint16, t TorrentFile) ([]byte, error) {
-	announcePacket := new(bytes.Buffer)
-
-	transactionID := make([]byte, 4)
-	_, err := rand.Read(transactionID[:])
-	if err != nil {
-		return nil, err
-	}
-
-	//connection id
-	err = binary.Write(announcePacket, binary.BigEndian, connID)
-	if err != nil {
-		return nil, err
-	}
+func (t *TorrentFile) requestPeers(tr *tracker, req announceRequest) (*trackerResponse, error) {
+	var resp *trackerResponse
+	var err error
 
-	//action
-	err = binary.Write(announcePacket, binary.BigEndian, uint32(1))
-	if err != nil {
-		return nil, err
+	switch tr.URL.Scheme {
+	case "http", "https":
+		resp, err = t.requestPeersHTTP(tr, req)
+	case "udp":
+		resp, err = t.requestPeersUDP(tr, req)
+	default:
+		err = fmt.Errorf("announce url not recognized")
 	}
+	return resp, err
+}
 
-	//transaction id
-	
-	err = binary.Write(announcePacket, binary.BigEndian, transactionID)
+func (t *TorrentFile) requestPeersHTTP(tr *tracker, req announceRequest) (*trackerResponse, error) {
+	url, err := t.buildTrackerURL(tr, req)
 	if err != nil {
 		return nil, err
 	}
 
-	//infohash
-	err = binary.Write(announcePacket, binary.BigEndian, t.InfoHash)
+	c := &http.Client{Timeout: 15 * time.Second}
+	resp, err := c.Get(url)
 	if err != nil {
 		return nil, err
 	}
+	defer resp.Body.Close()
 
-	//peer id
-	err = binary.Write(announcePacket, binary.BigEndian, get_peer_id())
+	trackerResp := bencodeTrackerResp{}
+	err = bencode.NewDecoder(resp.Body).Decode(&trackerResp)
 	if err != nil {
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("tracker responded %s", resp.Status)
+		}
 		return nil, err
 	}
-
-	//downloaded
-	err = binary.Write(announcePacket, binary.BigEndian, uint64(0))
-	if err != nil {
-		return nil, err
+	if trackerResp.FailureReason != "" {
+		return nil, &TrackerError{Reason: trackerResp.FailureReason}
 	}
-
-	//left
-	err = binary.Write(announcePacket, binary.BigEndian, uint64(0))
-	if err != nil {
-		return nil, err
+	if trackerResp.TrackerID != "" {
+		tr.trackerID = trackerResp.TrackerID
 	}
 
-	//uploaded
-	err = binary.Write(announcePacket, binary.BigEndian, uint64(0))
+	peerList, err := unmarshalTrackerPeers(trackerResp.Peers)
 	if err != nil {
 		return nil, err
 	}
-
-	//event
-	err = binary.Write(announcePacket, binary.BigEndian, uint32(0))
-	if err != nil {
-		return nil, err
-	}
-
-	//ip address
-	err = binary.Write(announcePacket, binary.BigEndian, uint32(0))
+	peerList6, err := peers.Unmarshal6([]byte(trackerResp.Peers6))
 	if err != nil {
 		return nil, err
 	}
+	return &trackerResponse{
+		Peers:       append(peerList, peerList6...),
+		Interval:    time.Duration(trackerResp.Interval) * time.Second,
+		MinInterval: time.Duration(trackerResp.MinInterval) * time.Second,
+		Seeders:     trackerResp.Complete,
+		Leechers:    trackerResp.Incomplete,
+		Warning:     trackerResp.WarningMessage,
+	}, nil
+}
 
-	//key
-	err = binary.Write(announcePacket, binary.BigEndian, uint32(0))
-	if err != nil {
-		return nil, err
+// unmarshalTrackerPeers reads the peers of an HTTP tracker response, compact
+// or a list of dictionaries whose ip may also be a DNS name.
+func unmarshalTrackerPeers(raw bencode.RawMessage) ([]peers.Peer, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	if raw[0] != 'l' {
+		var compact string
+		err := bencode.DecodeBytes(raw, &compact)
+		if err != nil {
+			return nil, err
+		}
+		return peers.Unmarshal([]byte(compact))
 	}
 
-	//num want
-	err = binary.Write(announcePacket, binary.BigEndian, int32(-1))
+	var list []bencodeTrackerPeer
+	err := bencode.DecodeBytes(raw, &list)
 	if err != nil {
 		return nil, err
 	}
-
-	//port
-	err = binary.Write(announcePacket, binary.BigEndian, uint16(8000))
-	if err != nil {
-		return nil, err
+	var peerList []peers.Peer
+	for _, p := range list {
+		ip := net.ParseIP(p.IP)
+		if ip == nil {
+			ips, err := net.LookupIP(p.IP)
+			if err != nil || len(ips) == 0 {
+				continue
+			}
+			ip = ips[0]
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		peerList = append(peerList, peers.Peer{IP: ip, Port: p.Port})
 	}
-
-	return announcePacket.Bytes(), nil
-}
-
-func get_peer_id() [20]byte {
-	buf:=new(bytes.Buffer)
-	binary.Write(buf,binary.LittleEndian,time.Now().Unix())
-	return sha1.Sum(buf.Bytes())
-
+	return peerList, nil
 }
@@ -0,0 +1,168 @@
+package torrentfile
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"log"
+	"net"
+	"time"
+
+	"github.com/aryanA101a/villi/peers"
+	"github.com/aryanA101a/villi/utils"
+)
+
+// serveUDP answers the UDP tracker protocol in the packet layouts of
+// udptracker.go until the socket is closed.
+func (s *TrackerServer) serveUDP() {
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				log.Println(utils.BoldRed("UDP tracker stopped (", err, ")"))
+			}
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok || n < 16 {
+			continue
+		}
+		resp := s.handleUDP(buf[:n], udpAddr)
+		if resp != nil {
+			s.udp.WriteTo(resp, addr)
+		}
+	}
+}
+
+// handleUDP returns the response to one request, nil for packets that get
+// none.
+func (s *TrackerServer) handleUDP(packet []byte, addr *net.UDPAddr) []byte {
+	connID := binary.BigEndian.Uint64(packet[0:])
+	action := binary.BigEndian.Uint32(packet[8:])
+	transactionID := binary.BigEndian.Uint32(packet[12:])
+
+	if action == actionConnect {
+		if connID != udpProtocolID {
+			return nil
+		}
+		resp := udpResponse(actionConnect, transactionID)
+		return appendUint64(resp, s.connectionID(addr, time.Now()))
+	}
+	if !s.validConnectionID(connID, addr) {
+		return udpError(transactionID, "invalid connection id")
+	}
+
+	switch action {
+	case actionAnnounce:
+		return s.handleUDPAnnounce(packet, addr, transactionID)
+	case actionScrape:
+		return s.handleUDPScrape(packet, transactionID)
+	}
+	return udpError(transactionID, "unknown action")
+}
+
+func (s *TrackerServer) handleUDPAnnounce(packet []byte, addr *net.UDPAddr, transactionID uint32) []byte {
+	var a udpAnnounce
+	err := binary.Read(bytes.NewReader(packet[16:]), binary.BigEndian, &a)
+	if err != nil {
+		return udpError(transactionID, "malformed announce")
+	}
+	if a.Event > uint32(eventStopped) {
+		return udpError(transactionID, "invalid event")
+	}
+
+	// a tracker reached over IPv4 returns IPv4 peers, over IPv6 IPv6 ones
+	ip := addr.IP
+	v4 := ip.To4() != nil
+	if v4 {
+		ip = ip.To4()
+	}
+	list, complete, incomplete, err := s.announce(announceQuery{
+		InfoHash: a.InfoHash,
+		PeerID:   a.PeerID,
+		Peer:     peers.Peer{IP: ip, Port: a.Port},
+		Left:     a.Left,
+		Event:    event(a.Event),
+		NumWant:  int(a.NumWant),
+		Want: func(p peers.Peer) bool {
+			return (p.IP.To4() != nil) == v4
+		},
+	})
+	if err != nil {
+		return udpError(transactionID, err.Error())
+	}
+
+	resp := udpResponse(actionAnnounce, transactionID)
+	resp = appendUint32(resp, uint32(s.cfg.Interval/time.Second))
+	resp = appendUint32(resp, uint32(incomplete))
+	resp = appendUint32(resp, uint32(complete))
+	if v4 {
+		return append(resp, peers.Marshal(addrs(list))...)
+	}
+	return append(resp, peers.Marshal6(addrs(list))...)
+}
+
+func (s *TrackerServer) handleUDPScrape(packet []byte, transactionID uint32) []byte {
+	body := packet[16:]
+	var infoHashes [][20]byte
+	for len(body) >= 20 && len(infoHashes) < udpMaxScrape {
+		var infoHash [20]byte
+		copy(infoHash[:], body)
+		infoHashes = append(infoHashes, infoHash)
+		body = body[20:]
+	}
+	if len(infoHashes) == 0 {
+		return udpError(transactionID, "no info_hash")
+	}
+
+	stats := s.scrape(infoHashes)
+	resp := udpResponse(actionScrape, transactionID)
+	for _, infoHash := range infoHashes {
+		// torrents not tracked read as empty swarms
+		st := stats[infoHash]
+		resp = appendUint32(resp, uint32(st.Complete))
+		resp = appendUint32(resp, uint32(st.Downloaded))
+		resp = appendUint32(resp, uint32(st.Incomplete))
+	}
+	return resp
+}
+
+// connectionID is the connection id addr gets at now. It is derived from the
+// IP address, clients may send from a new port each time, and the minute, so
+// the server need not remember it.
+func (s *TrackerServer) connectionID(addr *net.UDPAddr, now time.Time) uint64 {
+	h := sha1.New()
+	h.Write(s.secret[:])
+	h.Write(addr.IP.To16())
+	binary.Write(h, binary.BigEndian, now.Unix()/int64(udpConnIDLifetime/time.Second))
+	return binary.BigEndian.Uint64(h.Sum(nil))
+}
+
+// validConnectionID reports whether connID was handed to addr within the
+// last two minutes, as BEP 15 asks.
+func (s *TrackerServer) validConnectionID(connID uint64, addr *net.UDPAddr) bool {
+	now := time.Now()
+	return connID == s.connectionID(addr, now) || connID == s.connectionID(addr, now.Add(-udpConnIDLifetime))
+}
+
+func udpResponse(action uint32, transactionID uint32) []byte {
+	resp := make([]byte, 8, 20)
+	binary.BigEndian.PutUint32(resp[0:], action)
+	binary.BigEndian.PutUint32(resp[4:], transactionID)
+	return resp
+}
+
+func udpError(transactionID uint32, message string) []byte {
+	return append(udpResponse(actionError, transactionID), message...)
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
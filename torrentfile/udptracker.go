@@ -0,0 +1,440 @@
+package torrentfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aryanA101a/villi/peers"
+)
+
+// UDP tracker protocol (BEP 15) actions
+const (
+	actionConnect  = 0
+	actionAnnounce = 1
+	actionScrape   = 2
+	actionError    = 3
+)
+
+// magic constant a connect request starts with
+const udpProtocolID = 0x41727101980
+
+// a request is sent again after 15·2ⁿ seconds without an answer, up to
+// n = 8 as BEP 15 says
+const (
+	udpTimeout        = 15 * time.Second
+	udpMaxRetransmits = 8
+)
+
+// how long an announce may take over all its retransmits unless the
+// udpTracker says otherwise. The full BEP 15 schedule takes hours, which
+// would hold up the announces that follow on a dead tracker.
+const udpRequestTimeout = 2 * time.Minute
+
+// how long a connection id may be used for
+const udpConnIDLifetime = time.Minute
+
+// most info hashes one scrape request may carry
+const udpMaxScrape = 74
+
+// largest UDP payload
+const maxUDPPacket = 65536
+
+// udpTracker is one address of a UDP tracker. It keeps the connection id
+// for reuse by the requests that follow within a minute.
+type udpTracker struct {
+	addr string
+	// timeout bounds each request, connect included, udpRequestTimeout if 0
+	timeout time.Duration
+
+	mu        sync.Mutex
+	connID    uint64
+	connected time.Time
+}
+
+/*
+	connect request:
+		Offset  Size            Name            Value
+		0       64-bit integer  protocol_id     0x41727101980 // magic constant
+		8       32-bit integer  action          0 // connect
+		12      32-bit integer  transaction_id
+		16
+
+	connect response:
+		Offset  Size            Name            Value
+		0       32-bit integer  action          0 // connect
+		4       32-bit integer  transaction_id
+		8       64-bit integer  connection_id
+		16
+
+	IPv4 announce request:
+		Offset  Size    Name    Value
+		0       64-bit integer  connection_id
+		8       32-bit integer  action          1 // announce
+		12      32-bit integer  transaction_id
+		16      20-byte string  info_hash
+		36      20-byte string  peer_id
+		56      64-bit integer  downloaded
+		64      64-bit integer  left
+		72      64-bit integer  uploaded
+		80      32-bit integer  event           0 // 0: none; 1: completed; 2: started; 3: stopped
+		84      32-bit integer  IP address      0 // default
+		88      32-bit integer  key
+		92      32-bit integer  num_want        -1 // default
+		96      16-bit integer  port
+		98
+
+	IPv4 announce response:
+		Offset      Size            Name            Value
+		0           32-bit integer  action          1 // announce
+		4           32-bit integer  transaction_id
+		8           32-bit integer  interval
+		12          32-bit integer  leechers
+		16          32-bit integer  seeders
+		20 + 6 * n  32-bit integer  IP address
+		24 + 6 * n  16-bit integer  TCP port
+		20 + 6 * N
+
+	IPv6 announce response, when the tracker is reached over IPv6:
+		Offset      Size            Name            Value
+		0           32-bit integer  action          1 // announce
+		4           32-bit integer  transaction_id
+		8           32-bit integer  interval
+		12          32-bit integer  leechers
+		16          32-bit integer  seeders
+		20 + 18 * n 128-bit integer IP address
+		36 + 18 * n 16-bit integer  TCP port
+		20 + 18 * N
+
+	scrape request:
+		Offset          Size            Name            Value
+		0               64-bit integer  connection_id
+		8               32-bit integer  action          2 // scrape
+		12              32-bit integer  transaction_id
+		16 + 20 * n     20-byte string  info_hash
+		16 + 20 * N
+
+	scrape response:
+		Offset      Size            Name            Value
+		0           32-bit integer  action          2 // scrape
+		4           32-bit integer  transaction_id
+		8 + 12 * n  32-bit integer  seeders
+		12 + 12 * n 32-bit integer  completed
+		16 + 12 * n 32-bit integer  leechers
+		8 + 12 * N
+
+	error response:
+		Offset  Size            Name            Value
+		0       32-bit integer  action          3 // error
+		4       32-bit integer  transaction_id
+		8       string  message
+*/
+
+// udpAnnounce is the announce request after its 16 byte header.
+type udpAnnounce struct {
+	InfoHash   [20]byte
+	PeerID     [20]byte
+	Downloaded uint64
+	Left       uint64
+	Uploaded   uint64
+	Event      uint32
+	IP         uint32
+	Key        uint32
+	NumWant    int32
+	Port       uint16
+}
+
+// requestPeersUDP announces to a UDP tracker. A tracker only returns peers
+// of the address family it is reached over, so one with both IPv4 and IPv6
+// addresses is asked over each of them.
+func (t *TorrentFile) requestPeersUDP(tr *tracker, req announceRequest) (*trackerResponse, error) {
+	udpTrackers, err := tr.udpTrackers()
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		resp *trackerResponse
+		err  error
+	}
+	results := make(chan result, len(udpTrackers))
+	for _, u := range udpTrackers {
+		go func(u *udpTracker) {
+			resp, err := u.announce(t.InfoHash, req)
+			results <- result{resp, err}
+		}(u)
+	}
+
+	// the swarm is the same over either family, only the peers differ
+	var resp *trackerResponse
+	for range udpTrackers {
+		r := <-results
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+		if resp == nil {
+			resp = r.resp
+		} else {
+			resp.Peers = append(resp.Peers, r.resp.Peers...)
+		}
+	}
+	if resp == nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// udpTrackers returns the addresses of a UDP tracker, at most one per
+// address family, keeping their connection ids across announces.
+func (tr *tracker) udpTrackers() ([]*udpTracker, error) {
+	addrs, err := trackerAddrs(tr.URL.Host)
+	if err != nil {
+		return nil, err
+	}
+	if tr.udp == nil {
+		tr.udp = make(map[string]*udpTracker)
+	}
+	udpTrackers := make([]*udpTracker, 0, len(addrs))
+	for _, addr := range addrs {
+		u, ok := tr.udp[addr]
+		if !ok {
+			u = &udpTracker{addr: addr}
+			tr.udp[addr] = u
+		}
+		udpTrackers = append(udpTrackers, u)
+	}
+	return udpTrackers, nil
+}
+
+// trackerAddrs resolves a tracker's host:port to at most one IPv4 and one
+// IPv6 address.
+func trackerAddrs(hostport string) ([]string, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var v4, v6 net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			if v4 == nil {
+				v4 = ip
+			}
+		} else if v6 == nil {
+			v6 = ip
+		}
+	}
+	var addrs []string
+	for _, ip := range []net.IP{v4, v6} {
+		if ip != nil {
+			addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	return addrs, nil
+}
+
+func (u *udpTracker) announce(infoHash [20]byte, req announceRequest) (*trackerResponse, error) {
+	body := new(bytes.Buffer)
+	err := binary.Write(body, binary.BigEndian, udpAnnounce{
+		InfoHash:   infoHash,
+		PeerID:     req.PeerID,
+		Downloaded: req.Downloaded,
+		Left:       req.Left,
+		Uploaded:   req.Uploaded,
+		Event:      uint32(req.Event),
+		Key:        req.Key,
+		NumWant:    int32(req.NumWant),
+		Port:       req.Port,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := u.request(actionAnnounce, body.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < 20 {
+		return nil, fmt.Errorf("announce response of %d bytes", len(resp))
+	}
+
+	unmarshal := peers.Unmarshal
+	if ip := net.ParseIP(u.host()); ip != nil && ip.To4() == nil {
+		unmarshal = peers.Unmarshal6
+	}
+	peerList, err := unmarshal(resp[20:])
+	if err != nil {
+		return nil, err
+	}
+	return &trackerResponse{
+		Peers:    peerList,
+		Interval: time.Duration(binary.BigEndian.Uint32(resp[8:])) * time.Second,
+		Leechers: int(binary.BigEndian.Uint32(resp[12:])),
+		Seeders:  int(binary.BigEndian.Uint32(resp[16:])),
+	}, nil
+}
+
+// scrape asks for the swarm stats of each of infoHashes, in their order.
+func (u *udpTracker) scrape(infoHashes [][20]byte) ([]ScrapeStats, error) {
+	stats := make([]ScrapeStats, 0, len(infoHashes))
+	for len(infoHashes) > 0 {
+		batch := infoHashes
+		if len(batch) > udpMaxScrape {
+			batch = batch[:udpMaxScrape]
+		}
+		infoHashes = infoHashes[len(batch):]
+
+		body := make([]byte, 0, 20*len(batch))
+		for _, infoHash := range batch {
+			body = append(body, infoHash[:]...)
+		}
+		resp, err := u.request(actionScrape, body)
+		if err != nil {
+			return nil, err
+		}
+		if len(resp) < 8+12*len(batch) {
+			return nil, fmt.Errorf("scrape response of %d bytes for %d torrents", len(resp), len(batch))
+		}
+		for i := range batch {
+			entry := resp[8+12*i:]
+			stats = append(stats, ScrapeStats{
+				Complete:   int(binary.BigEndian.Uint32(entry[0:])),
+				Downloaded: int(binary.BigEndian.Uint32(entry[4:])),
+				Incomplete: int(binary.BigEndian.Uint32(entry[8:])),
+			})
+		}
+	}
+	return stats, nil
+}
+
+func (u *udpTracker) host() string {
+	host, _, _ := net.SplitHostPort(u.addr)
+	return host
+}
+
+// request sends an announce or scrape with body after the header and
+// returns the response, connecting first unless the connection id is still
+// good.
+func (u *udpTracker) request(action uint32, body []byte) ([]byte, error) {
+	timeout := u.timeout
+	if timeout <= 0 {
+		timeout = udpRequestTimeout
+	}
+	deadline := time.Now().Add(timeout)
+
+	conn, err := net.Dial("udp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	connID, err := u.connectionID(conn, deadline)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := exchange(conn, udpPacket(connID, action, body), deadline)
+	var trackerErr *TrackerError
+	if errors.As(err, &trackerErr) {
+		// perhaps the tracker forgot the connection id, get a new one next
+		// time
+		u.mu.Lock()
+		u.connected = time.Time{}
+		u.mu.Unlock()
+	}
+	return resp, err
+}
+
+// connectionID returns the connection id, connecting for a new one once it
+// is a minute old.
+func (u *udpTracker) connectionID(conn net.Conn, deadline time.Time) (uint64, error) {
+	u.mu.Lock()
+	if time.Since(u.connected) < udpConnIDLifetime {
+		defer u.mu.Unlock()
+		return u.connID, nil
+	}
+	u.mu.Unlock()
+
+	resp, err := exchange(conn, udpPacket(udpProtocolID, actionConnect, nil), deadline)
+	if err != nil {
+		return 0, err
+	}
+	if len(resp) < 16 {
+		return 0, fmt.Errorf("connect response of %d bytes", len(resp))
+	}
+	connID := binary.BigEndian.Uint64(resp[8:])
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.connID = connID
+	u.connected = time.Now()
+	return connID, nil
+}
+
+// udpPacket builds a request with a fresh transaction id. Connect requests
+// carry the protocol id where others carry the connection id.
+func udpPacket(connID uint64, action uint32, body []byte) []byte {
+	packet := make([]byte, 16, 16+len(body))
+	binary.BigEndian.PutUint64(packet[0:], connID)
+	binary.BigEndian.PutUint32(packet[8:], action)
+	binary.BigEndian.PutUint32(packet[12:], rand.Uint32())
+	return append(packet, body...)
+}
+
+// exchange sends packet and waits for the response with its transaction id,
+// sending it again after 15·2ⁿ seconds (BEP 15) until deadline. An error
+// response becomes a TrackerError.
+func exchange(conn net.Conn, packet []byte, deadline time.Time) ([]byte, error) {
+	action := binary.BigEndian.Uint32(packet[8:])
+	transactionID := packet[12:16]
+	buf := make([]byte, maxUDPPacket)
+
+	for n := 0; n <= udpMaxRetransmits && time.Now().Before(deadline); n++ {
+		_, err := conn.Write(packet)
+		if err != nil {
+			return nil, err
+		}
+		wait := time.Now().Add(udpTimeout << n)
+		if wait.After(deadline) {
+			wait = deadline
+		}
+		err = conn.SetReadDeadline(wait)
+		if err != nil {
+			return nil, err
+		}
+
+		for {
+			respLen, err := conn.Read(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			resp := buf[:respLen]
+			// a late answer to an earlier request
+			if respLen < 8 || !bytes.Equal(resp[4:8], transactionID) {
+				continue
+			}
+
+			switch respAction := binary.BigEndian.Uint32(resp); respAction {
+			case action:
+				return append([]byte(nil), resp...), nil
+			case actionError:
+				return nil, &TrackerError{Reason: string(bytes.TrimRight(resp[8:], "\x00"))}
+			default:
+				return nil, fmt.Errorf("unexpected action %d in response to %d", respAction, action)
+			}
+		}
+	}
+	return nil, fmt.Errorf("tracker did not answer")
+}
@@ -0,0 +1,284 @@
+package torrentfile
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aryanA101a/villi/peers"
+)
+
+// fakeUDPTracker answers BEP 15 requests on a local socket with fixed stats.
+type fakeUDPTracker struct {
+	conn *net.UDPConn
+
+	mu sync.Mutex
+	// connects counts the connect requests, connID is handed out to them
+	connects int
+	connID   uint64
+	// announces are the announces taken, in order
+	announces []udpAnnounce
+	// mismatch has every answer preceded by one with a wrong transaction id
+	// and different contents
+	mismatch bool
+	// reject has announces answered with an error
+	reject string
+}
+
+func newFakeUDPTracker(t *testing.T) *fakeUDPTracker {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeUDPTracker{conn: conn, connID: 0x1122334455667788}
+	t.Cleanup(func() { conn.Close() })
+	go f.serve()
+	return f
+}
+
+func (f *fakeUDPTracker) addr() string {
+	return f.conn.LocalAddr().String()
+}
+
+func (f *fakeUDPTracker) serve() {
+	buf := make([]byte, maxUDPPacket)
+	for {
+		n, addr, err := f.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if n < 16 {
+			continue
+		}
+		packet := buf[:n]
+		connID := binary.BigEndian.Uint64(packet)
+		action := binary.BigEndian.Uint32(packet[8:])
+		transactionID := binary.BigEndian.Uint32(packet[12:])
+
+		f.mu.Lock()
+		resp := f.answer(connID, action, packet[16:])
+		mismatch := f.mismatch
+		f.mu.Unlock()
+		if resp == nil {
+			continue
+		}
+		if mismatch {
+			wrong := append([]byte(nil), resp...)
+			binary.BigEndian.PutUint32(wrong[4:], transactionID+1)
+			if action == actionAnnounce {
+				binary.BigEndian.PutUint32(wrong[16:], 99)
+			}
+			f.conn.WriteToUDP(wrong, addr)
+		}
+		binary.BigEndian.PutUint32(resp[4:], transactionID)
+		f.conn.WriteToUDP(resp, addr)
+	}
+}
+
+// answer returns the response to a request, its transaction id left to be
+// filled in. f.mu must be held.
+func (f *fakeUDPTracker) answer(connID uint64, action uint32, body []byte) []byte {
+	if action == actionConnect {
+		if connID != udpProtocolID {
+			return nil
+		}
+		f.connects++
+		return appendUint64(udpResponse(actionConnect, 0), f.connID)
+	}
+	if connID != f.connID {
+		return udpError(0, "unknown connection id")
+	}
+
+	switch action {
+	case actionAnnounce:
+		var a udpAnnounce
+		err := binary.Read(bytes.NewReader(body), binary.BigEndian, &a)
+		if err != nil {
+			return udpError(0, err.Error())
+		}
+		f.announces = append(f.announces, a)
+		if f.reject != "" {
+			return udpError(0, f.reject)
+		}
+		resp := udpResponse(actionAnnounce, 0)
+		resp = appendUint32(resp, 1800)
+		resp = appendUint32(resp, 3)
+		resp = appendUint32(resp, 2)
+		return append(resp, peers.Marshal([]peers.Peer{{IP: net.IPv4(10, 0, 0, 1).To4(), Port: 6881}})...)
+	case actionScrape:
+		resp := udpResponse(actionScrape, 0)
+		for i := 0; i+20 <= len(body); i += 20 {
+			resp = appendUint32(resp, uint32(body[i]))
+			resp = appendUint32(resp, 7)
+			resp = appendUint32(resp, 4)
+		}
+		return resp
+	}
+	return udpError(0, "unknown action")
+}
+
+func (f *fakeUDPTracker) counts() (connects, announces int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connects, len(f.announces)
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	u := &udpTracker{addr: f.addr()}
+	infoHash := [20]byte{1, 2, 3}
+	req := announceRequest{
+		PeerID:     [20]byte{'-', 'V', 'I'},
+		Port:       51413,
+		Event:      eventStarted,
+		Downloaded: 100,
+		Left:       200,
+		Uploaded:   300,
+		Key:        42,
+		NumWant:    -1,
+	}
+
+	resp, err := u.announce(infoHash, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Interval != 30*time.Minute || resp.Leechers != 3 || resp.Seeders != 2 {
+		t.Errorf("got interval %v, %d leechers, %d seeders", resp.Interval, resp.Leechers, resp.Seeders)
+	}
+	if len(resp.Peers) != 1 || resp.Peers[0].String() != "10.0.0.1:6881" {
+		t.Errorf("got peers %v", resp.Peers)
+	}
+
+	f.mu.Lock()
+	got := f.announces[0]
+	f.mu.Unlock()
+	want := udpAnnounce{
+		InfoHash:   infoHash,
+		PeerID:     req.PeerID,
+		Downloaded: 100,
+		Left:       200,
+		Uploaded:   300,
+		Event:      uint32(eventStarted),
+		Key:        42,
+		NumWant:    -1,
+		Port:       51413,
+	}
+	if got != want {
+		t.Errorf("tracker got %+v, want %+v", got, want)
+	}
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	u := &udpTracker{addr: f.addr()}
+
+	// more than fit in one request
+	infoHashes := make([][20]byte, udpMaxScrape+3)
+	for i := range infoHashes {
+		infoHashes[i][0] = byte(i)
+	}
+	stats, err := u.scrape(infoHashes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != len(infoHashes) {
+		t.Fatalf("got %d stats for %d torrents", len(stats), len(infoHashes))
+	}
+	for i, s := range stats {
+		want := ScrapeStats{Complete: i, Downloaded: 7, Incomplete: 4}
+		if s != want {
+			t.Errorf("torrent %d: got %+v, want %+v", i, s, want)
+		}
+	}
+	if connects, _ := f.counts(); connects != 1 {
+		t.Errorf("connected %d times for two batches in a row", connects)
+	}
+}
+
+func TestUDPTrackerConnectionIDReuse(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	u := &udpTracker{addr: f.addr()}
+	req := announceRequest{NumWant: -1, Port: 6881}
+
+	for i := 0; i < 3; i++ {
+		_, err := u.announce([20]byte{}, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if connects, announces := f.counts(); connects != 1 || announces != 3 {
+		t.Fatalf("got %d connects for %d announces, want 1 for 3", connects, announces)
+	}
+
+	// a minute on the connection id is used up
+	u.mu.Lock()
+	u.connected = time.Now().Add(-udpConnIDLifetime)
+	u.mu.Unlock()
+	_, err := u.announce([20]byte{}, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if connects, _ := f.counts(); connects != 2 {
+		t.Errorf("got %d connects after the connection id expired, want 2", connects)
+	}
+}
+
+func TestUDPTrackerTransactionIDMismatch(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	f.mu.Lock()
+	f.mismatch = true
+	f.mu.Unlock()
+	u := &udpTracker{addr: f.addr()}
+
+	resp, err := u.announce([20]byte{}, announceRequest{NumWant: -1, Port: 6881})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Seeders != 2 {
+		t.Errorf("took the answer with the wrong transaction id, %d seeders", resp.Seeders)
+	}
+}
+
+func TestUDPTrackerError(t *testing.T) {
+	f := newFakeUDPTracker(t)
+	f.mu.Lock()
+	f.reject = "torrent not allowed"
+	f.mu.Unlock()
+	u := &udpTracker{addr: f.addr()}
+
+	_, err := u.announce([20]byte{}, announceRequest{NumWant: -1, Port: 6881})
+	var trackerErr *TrackerError
+	if !errors.As(err, &trackerErr) || trackerErr.Reason != "torrent not allowed" {
+		t.Fatalf("got error %v", err)
+	}
+	// the connection id may be what the tracker did not like
+	u.mu.Lock()
+	connected := u.connected
+	u.mu.Unlock()
+	if !connected.IsZero() {
+		t.Error("connection id kept after an error")
+	}
+}
+
+func TestUDPTrackerTimeout(t *testing.T) {
+	// a socket that never answers
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	u := &udpTracker{addr: conn.LocalAddr().String(), timeout: 200 * time.Millisecond}
+
+	start := time.Now()
+	_, err = u.announce([20]byte{}, announceRequest{NumWant: -1, Port: 6881})
+	if err == nil {
+		t.Fatal("announce to a silent tracker succeeded")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("announce took %v with a timeout of %v", elapsed, u.timeout)
+	}
+}
@@ -0,0 +1,96 @@
+package torrentfile
+
+import (
+	"github.com/aryanA101a/villi/bitfield"
+	"github.com/aryanA101a/villi/storage"
+)
+
+type VerifyReport struct {
+	Pieces    bitfield.Bitfield
+	BadPieces []int
+	Files     []FileReport
+	Length    uint64
+	Verified  uint64
+}
+
+type FileReport struct {
+	Path     string
+	Length   uint64
+	Verified uint64
+}
+
+func (r VerifyReport) Complete() bool {
+	return len(r.BadPieces) == 0
+}
+
+func (r FileReport) Ratio() float64 {
+	if r.Length == 0 {
+		return 1
+	}
+	return float64(r.Verified) / float64(r.Length)
+}
+
+func (r VerifyReport) Ratio() float64 {
+	if r.Length == 0 {
+		return 1
+	}
+	return float64(r.Verified) / float64(r.Length)
+}
+
+// Verify reads the data of the torrent from disk piece by piece and checks it
+// against the piece hashes. Nothing is created or modified on disk. progress,
+// if not nil, is called after every piece.
+func (t *TorrentFile) Verify(progress func(done, total int)) (VerifyReport, error) {
+	store, err := storage.Open(t.storageFiles(), t.PieceLength)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+	defer store.Close()
+
+	report := VerifyReport{
+		Pieces: make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8),
+		Length: t.Length,
+	}
+	for index, hash := range t.PieceHashes {
+		ok, err := store.VerifyPiece(index, hash)
+		if err != nil {
+			return VerifyReport{}, err
+		}
+		if ok {
+			report.Pieces.SetPiece(index)
+		} else {
+			report.BadPieces = append(report.BadPieces, index)
+		}
+		if progress != nil {
+			progress(index+1, len(t.PieceHashes))
+		}
+	}
+
+	var offset uint64
+	for _, f := range t.Files {
+		fr := FileReport{Path: f.Path, Length: f.Length}
+		if f.Length > 0 {
+			first := offset / uint64(t.PieceLength)
+			last := (offset + f.Length - 1) / uint64(t.PieceLength)
+			for index := first; index <= last; index++ {
+				if !report.Pieces.HasPiece(int(index)) {
+					continue
+				}
+				// count only the part of the piece that overlaps this file
+				begin := index * uint64(t.PieceLength)
+				end := begin + uint64(t.PieceLength)
+				if begin < offset {
+					begin = offset
+				}
+				if end > offset+f.Length {
+					end = offset + f.Length
+				}
+				fr.Verified += end - begin
+			}
+		}
+		report.Verified += fr.Verified
+		report.Files = append(report.Files, fr)
+		offset += f.Length
+	}
+	return report, nil
+}
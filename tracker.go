@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/aryanA101a/villi/torrentfile"
+	"github.com/aryanA101a/villi/utils"
+)
+
+func runTracker(args []string) int {
+	fs := flag.NewFlagSet("tracker", flag.ExitOnError)
+	var cfg torrentfile.ServerConfig
+	fs.StringVar(&cfg.HTTPAddr, "http", ":6969", "Address to take HTTP announces on, empty to disable")
+	fs.StringVar(&cfg.UDPAddr, "udp", ":6969", "Address to take UDP announces on, empty to disable")
+	fs.DurationVar(&cfg.Interval, "interval", 30*time.Minute, "How long peers wait between announces")
+	fs.StringVar(&cfg.StatePath, "state", "", "File to keep the swarms in across restarts")
+	allowFlag := fs.String("allow", "", "File listing the only info hashes to track, one hex hash per line")
+	fs.Usage = func() {
+		fmt.Print(trackerUsageText)
+	}
+	args = parseArgs(fs, args)
+	if len(args) != 0 {
+		fs.Usage()
+		return 2
+	}
+
+	if *allowFlag != "" {
+		allow, err := readAllowList(*allowFlag)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, utils.BoldRed(err))
+			return 2
+		}
+		cfg.Allow = allow
+	}
+
+	server, err := torrentfile.ListenTracker(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, utils.BoldRed(err))
+		return 1
+	}
+	if addr := server.HTTPAddr(); addr != nil {
+		log.Println(utils.Bold("Tracking over HTTP at http://", addr, "/announce"))
+	}
+	if addr := server.UDPAddr(); addr != nil {
+		log.Println(utils.Bold("Tracking over UDP at udp://", addr, "/announce"))
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		log.Println(utils.Bold("Stopping the tracker"))
+		server.Close()
+	}()
+	err = server.Serve()
+	if err != nil {
+		log.Println(utils.BoldRed("Could not save the swarms (", err, ")"))
+		return 1
+	}
+	return 0
+}
+
+// readAllowList reads the hex info hashes listed in path, skipping blank
+// lines and # comments.
+func readAllowList(path string) ([][20]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var allow [][20]byte
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		b, err := hex.DecodeString(text)
+		if err != nil || len(b) != 20 {
+			return nil, fmt.Errorf("%s:%d: not a hex info hash", path, line)
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], b)
+		allow = append(allow, infoHash)
+	}
+	return allow, scanner.Err()
+}
+
+var trackerUsageText = `Usage: villi tracker [options]
+
+Runs a BitTorrent tracker taking announces and scrapes over HTTP and UDP
+until interrupted.
+
+Options:
+  --http      Address to take HTTP announces on, empty to disable (default :6969)
+  --udp       Address to take UDP announces on, empty to disable (default :6969)
+  --interval  How long peers wait between announces, they are forgotten after
+              twice that without one (default 30m)
+  --state     File to keep the swarms in across restarts
+  --allow     File listing the only info hashes to track, one hex hash per line
+`
@@ -28,6 +28,9 @@ const (
 
 type progressErrMsg struct{ err error }
 
+// done is sent once downloading and seeding are over
+type doneMsg struct{}
+
 func finalPause() tea.Cmd {
 	return tea.Tick(time.Millisecond*750, func(_ time.Time) tea.Msg {
 		return nil
@@ -38,6 +41,8 @@ type model struct {
 	meta        ui.Meta
 	progress    ui.Progress
 	progressBar progress.Model
+	uploaded    ui.Uploaded
+	trackers    ui.Trackers
 	err         error
 }
 
@@ -67,14 +72,18 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			Downloaded: msg.Downloaded,
 		}
 
-		var cmds []tea.Cmd
+		return m, m.progressBar.SetPercent(float64(msg.Ratio))
 
-		if msg.Ratio >= 1.0 {
-			cmds = append(cmds, tea.Sequence(finalPause(), tea.Quit))
-		}
+	case doneMsg:
+		return m, tea.Sequence(finalPause(), tea.Quit)
+
+	case ui.Uploaded:
+		m.uploaded = msg
+		return m, nil
 
-		cmds = append(cmds, m.progressBar.SetPercent(float64(msg.Ratio)))
-		return m, tea.Batch(cmds...)
+	case ui.Trackers:
+		m.trackers = msg
+		return m, nil
 
 	case ui.Status:
 		m.meta.Status = msg
@@ -107,10 +116,31 @@ func (m model) View() string {
 	if m.err != nil {
 		return "Error downloading: " + m.err.Error() + "\n"
 	}
-	meta := fmt.Sprintf("%s/%s 🔽 | %d/%d peers     status:%s", utils.ConvertToHumanReadable(m.progress.Downloaded), m.meta.FileSize, m.meta.ConnectedPeers, m.meta.Peers, m.meta.Status)
+	meta := fmt.Sprintf("%s/%s 🔽 | %s 🔼 | %d/%d peers     status:%s", utils.ConvertToHumanReadable(m.progress.Downloaded), m.meta.FileSize, utils.ConvertToHumanReadable(uint64(m.uploaded)), m.meta.ConnectedPeers, m.meta.Peers, m.meta.Status)
 	percentage := fmt.Sprintf("   %s", strconv.FormatFloat(m.progress.Ratio*100, 'f', 2, 64)) + "%"
 	pad := strings.Repeat(" ", padding)
 	return borderStyle(titleStyle(string(m.meta.FileName))+"\n\n" +
 		pad + m.progressBar.View() + downloadPercentageStyle(percentage) + pad + "\n\n" + metaStyle(meta) + "\n\n" +
+		m.trackersView() +
 		pad + helpStyle("Press any key to quit"))
 }
+
+// trackersView lists the trackers by tier with how their last announce went.
+func (m model) trackersView() string {
+	if len(m.trackers) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for _, tr := range m.trackers {
+		line := fmt.Sprintf("tier %d  %s  %s", tr.Tier, tr.URL, tr.Status)
+		if !tr.LastAnnounce.IsZero() {
+			line += fmt.Sprintf("  %d seeders, %d leechers, %d peers at %s", tr.Seeders, tr.Leechers, tr.Peers, tr.LastAnnounce.Format("15:04:05"))
+		}
+		if len(line) > maxWidth+15-2*padding {
+			line = line[:maxWidth+15-2*padding-3] + "..."
+		}
+		b.WriteString(strings.Repeat(" ", padding) + helpStyle(line) + "\n")
+	}
+	b.WriteString("\n")
+	return b.String()
+}
@@ -1,15 +1,36 @@
 package ui
 
+import "time"
+
 type FileName string
 type Status string
 type FileSize string
 type ConnectedPeers int
 type Peers int
+type Uploaded uint64
 
 type Progress struct {
 	Ratio      float64
 	Downloaded uint64
 }
+
+// Tracker is how announcing to one tracker goes.
+type Tracker struct {
+	URL  string
+	Tier int
+	// Status is "not contacted", "updating...", "working" or the last error
+	Status       string
+	LastAnnounce time.Time
+	// Peers is how many peers the last announce returned, Seeders and
+	// Leechers the swarm the tracker knows of
+	Peers    int
+	Seeders  int
+	Leechers int
+}
+
+// Trackers is the state of every tracker of the torrent, by tier.
+type Trackers []Tracker
+
 type Meta struct {
 	FileName       FileName
 	Status         Status
@@ -0,0 +1,568 @@
+package utp
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// payload of a data packet, small enough not to be fragmented
+	maxPayload = 1200
+	// bytes we buffer for the reader, advertised as our window
+	recvBufSize = 1 << 20
+	// how far ahead of the last in-order packet we keep packets
+	reorderLimit = 1024
+	// LEDBAT: the queueing delay we aim for, and how fast the window grows
+	// per round trip when below it
+	targetDelay          = 100 * time.Millisecond
+	maxCwndIncreasePerRT = 3000
+	minWindow            = maxPayload
+	maxWindow            = 4 << 20
+	// the base delay is the lowest delay seen within this long
+	baseDelayWindow = 2 * time.Minute
+	// retransmission timeouts
+	minRTO = 500 * time.Millisecond
+	maxRTO = 60 * time.Second
+	// a connection fails when a packet times out this many times in a row
+	maxRetries = 8
+	// how long a closed connection keeps sending what the peer has not
+	// acknowledged yet
+	lingerTimeout = 30 * time.Second
+)
+
+type connState int
+
+const (
+	stateSynSent connState = iota
+	stateConnected
+	// closing is after Close, until the peer acknowledged everything we sent
+	stateClosing
+	stateClosed
+)
+
+var (
+	errReset   = errors.New("uTP connection reset by peer")
+	errTimeout = errors.New("uTP connection timed out")
+)
+
+type outPacket struct {
+	seq           uint16
+	payload       []byte
+	fin           bool
+	sentAt        time.Time
+	transmissions int
+}
+
+// Conn is a uTP connection.
+type Conn struct {
+	s      *Socket
+	raddr  *net.UDPAddr
+	recvID uint16
+	sendID uint16
+	// established is closed once the peer answered our SYN
+	established chan struct{}
+
+	// wmu keeps concurrent writes from interleaving
+	wmu sync.Mutex
+
+	mu    sync.Mutex
+	state connState
+	err   error
+	// seqNr is the next sequence number we send, ackNr the last one we
+	// received in order
+	seqNr uint16
+	ackNr uint16
+
+	readBuf []byte
+	ooo     map[uint16][]byte
+	gotFin  bool
+	finSeq  uint16
+	eof     bool
+
+	unacked  []*outPacket
+	inflight int
+	peerWnd  uint32
+	cwnd     float64
+	lastAck  uint16
+	dupAcks  int
+	retries  int
+	// after a fast retransmit, recovering is set until everything sent up
+	// to recoverSeq is acknowledged
+	recovering bool
+	recoverSeq uint16
+
+	rtt, rttVar, rto time.Duration
+	// replyMicro is the delay we measured for the peer's last packet
+	replyMicro uint32
+	lastRecv   time.Time
+	baseDelay  uint32
+	baseSince  time.Time
+	closedAt   time.Time
+
+	readDeadline, writeDeadline time.Time
+	// readable and writable are closed (and replaced) when a reader or
+	// writer may be able to make progress
+	readable chan struct{}
+	writable chan struct{}
+}
+
+func newConn(s *Socket, raddr *net.UDPAddr, recvID, sendID uint16) *Conn {
+	return &Conn{
+		s:           s,
+		raddr:       raddr,
+		recvID:      recvID,
+		sendID:      sendID,
+		established: make(chan struct{}),
+		ooo:         make(map[uint16][]byte),
+		peerWnd:     recvBufSize,
+		cwnd:        2 * minWindow,
+		rto:         time.Second,
+		readable:    make(chan struct{}),
+		writable:    make(chan struct{}),
+	}
+}
+
+func (c *Conn) LocalAddr() net.Addr {
+	return c.s.Addr()
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.raddr
+}
+
+func (c *Conn) SetDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	c.notify()
+	return nil
+}
+
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	c.notify()
+	return nil
+}
+
+// notify wakes up blocked readers and writers. c.mu must be held.
+func (c *Conn) notify() {
+	close(c.readable)
+	c.readable = make(chan struct{})
+	close(c.writable)
+	c.writable = make(chan struct{})
+}
+
+// wait blocks until ch is closed or the deadline passes.
+func wait(ch <-chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-ch
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ch:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		if len(c.readBuf) > 0 {
+			wasFull := len(c.readBuf) > recvBufSize-maxPayload
+			n := copy(b, c.readBuf)
+			c.readBuf = c.readBuf[n:]
+			if len(c.readBuf) == 0 {
+				c.readBuf = nil
+			}
+			if wasFull {
+				// tell the peer our window opened up again
+				c.sendState()
+			}
+			return n, nil
+		}
+		switch {
+		case c.eof:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case c.state >= stateClosing:
+			return 0, net.ErrClosed
+		}
+
+		ch, deadline := c.readable, c.readDeadline
+		c.mu.Unlock()
+		err := wait(ch, deadline)
+		c.mu.Lock()
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxPayload {
+			n = maxPayload
+		}
+		for {
+			switch {
+			case c.err != nil:
+				return written, c.err
+			case c.state >= stateClosing:
+				return written, net.ErrClosed
+			}
+			if c.inflight == 0 || c.inflight+n <= c.window() {
+				break
+			}
+			ch, deadline := c.writable, c.writeDeadline
+			c.mu.Unlock()
+			err := wait(ch, deadline)
+			c.mu.Lock()
+			if err != nil {
+				return written, err
+			}
+		}
+
+		p := &outPacket{seq: c.seqNr, payload: append([]byte(nil), b[:n]...)}
+		c.seqNr++
+		c.unacked = append(c.unacked, p)
+		c.inflight += n
+		c.transmit(p)
+		b = b[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// Close sends a FIN and returns. The connection lingers in the background
+// until the peer acknowledged the data still in flight and the FIN, or for
+// lingerTimeout at most.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.state >= stateClosing {
+		c.mu.Unlock()
+		return nil
+	}
+	if c.state == stateConnected && c.err == nil {
+		p := &outPacket{seq: c.seqNr, fin: true}
+		c.seqNr++
+		c.unacked = append(c.unacked, p)
+		c.transmit(p)
+		c.state = stateClosing
+		c.closedAt = time.Now()
+		c.notify()
+		c.mu.Unlock()
+		return nil
+	}
+	c.state = stateClosed
+	c.notify()
+	c.mu.Unlock()
+	c.s.remove(c)
+	return nil
+}
+
+// fail ends the connection with err.
+func (c *Conn) fail(err error) {
+	c.mu.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.state = stateClosed
+	c.notify()
+	c.mu.Unlock()
+	c.s.remove(c)
+}
+
+// reset refuses the connection.
+func (c *Conn) reset() {
+	c.mu.Lock()
+	c.s.send(c.raddr, c.header(stReset, c.seqNr), nil)
+	c.mu.Unlock()
+	c.fail(errReset)
+}
+
+// window is how many bytes may be in flight.
+func (c *Conn) window() int {
+	w := int(c.cwnd)
+	if int(c.peerWnd) < w {
+		w = int(c.peerWnd)
+	}
+	return w
+}
+
+// header builds the header of a packet to the peer. c.mu must be held.
+func (c *Conn) header(typ uint8, seq uint16) *header {
+	wnd := recvBufSize - len(c.readBuf)
+	if wnd < 0 {
+		wnd = 0
+	}
+	return &header{
+		typ:           typ,
+		connID:        c.sendID,
+		timestamp:     micros(time.Now()),
+		timestampDiff: c.replyMicro,
+		wnd:           uint32(wnd),
+		seq:           seq,
+		ack:           c.ackNr,
+	}
+}
+
+func (c *Conn) sendSyn() {
+	h := c.header(stSyn, 1)
+	// a SYN goes to the id the peer will receive on
+	h.connID = c.recvID
+	c.s.send(c.raddr, h, nil)
+}
+
+func (c *Conn) sendState() {
+	c.s.send(c.raddr, c.header(stState, c.seqNr), nil)
+}
+
+func (c *Conn) transmit(p *outPacket) {
+	p.sentAt = time.Now()
+	p.transmissions++
+	typ := uint8(stData)
+	if p.fin {
+		typ = stFin
+	}
+	c.s.send(c.raddr, c.header(typ, p.seq), p.payload)
+}
+
+// handle processes a packet from the peer.
+func (c *Conn) handle(h header, payload []byte, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastRecv = now
+	c.replyMicro = micros(now) - h.timestamp
+	c.peerWnd = h.wnd
+
+	switch h.typ {
+	case stReset:
+		if c.err == nil {
+			c.err = errReset
+		}
+		c.state = stateClosed
+		c.notify()
+		c.s.remove(c)
+		return
+	case stState:
+		if c.state == stateSynSent {
+			c.state = stateConnected
+			c.ackNr = h.seq - 1
+			c.seqNr = 2
+			c.lastAck = 1
+			close(c.established)
+			return
+		}
+	}
+	if c.state != stateConnected && c.state != stateClosing {
+		return
+	}
+
+	c.processAck(h, now)
+	if c.state == stateClosing && len(c.unacked) == 0 {
+		// everything we sent arrived
+		c.state = stateClosed
+		c.notify()
+		c.s.remove(c)
+		return
+	}
+	switch h.typ {
+	case stData:
+		c.receive(h.seq, payload)
+		c.sendState()
+	case stFin:
+		c.gotFin = true
+		c.finSeq = h.seq
+		c.receive(h.seq, nil)
+		c.sendState()
+	}
+}
+
+// receive puts a data or FIN packet in order.
+func (c *Conn) receive(seq uint16, payload []byte) {
+	if !seqLess(c.ackNr, seq) {
+		// already got it, our ack was lost
+		return
+	}
+	if seq != c.ackNr+1 {
+		if uint16(seq-c.ackNr) < reorderLimit && len(c.readBuf)+len(c.ooo)*maxPayload < recvBufSize {
+			c.ooo[seq] = payload
+		}
+		return
+	}
+	if len(c.readBuf)+len(payload) > recvBufSize {
+		// the reader is too slow, the peer will send it again
+		return
+	}
+
+	c.deliver(seq, payload)
+	for {
+		next, ok := c.ooo[c.ackNr+1]
+		if !ok {
+			break
+		}
+		delete(c.ooo, c.ackNr+1)
+		c.deliver(c.ackNr+1, next)
+	}
+	c.notify()
+}
+
+func (c *Conn) deliver(seq uint16, payload []byte) {
+	c.ackNr = seq
+	c.readBuf = append(c.readBuf, payload...)
+	if c.gotFin && seq == c.finSeq {
+		c.eof = true
+	}
+}
+
+// processAck drops the packets the peer acknowledged and adjusts the
+// window. Three acks in a row for the same packet mean the one after it got
+// lost.
+func (c *Conn) processAck(h header, now time.Time) {
+	acked := 0
+	for len(c.unacked) > 0 && !seqLess(h.ack, c.unacked[0].seq) {
+		p := c.unacked[0]
+		c.unacked = c.unacked[1:]
+		acked += len(p.payload)
+		c.inflight -= len(p.payload)
+		if p.transmissions == 1 {
+			c.updateRTT(now.Sub(p.sentAt))
+		}
+	}
+
+	if acked > 0 {
+		c.lastAck = h.ack
+		c.dupAcks = 0
+		c.retries = 0
+		c.ledbat(h.timestampDiff, acked, now)
+		if c.recovering && seqLess(h.ack, c.recoverSeq) && len(c.unacked) > 0 {
+			// the ack stopped at the next packet lost from the same window
+			c.transmit(c.unacked[0])
+		} else {
+			c.recovering = false
+		}
+		c.notify()
+		return
+	}
+	if h.typ == stState && h.ack == c.lastAck && len(c.unacked) > 0 {
+		c.dupAcks++
+		if c.dupAcks == 3 {
+			c.cwnd /= 2
+			if c.cwnd < minWindow {
+				c.cwnd = minWindow
+			}
+			c.recovering = true
+			c.recoverSeq = c.seqNr - 1
+			c.transmit(c.unacked[0])
+		}
+	}
+}
+
+func (c *Conn) updateRTT(sample time.Duration) {
+	if c.rtt == 0 {
+		c.rtt = sample
+		c.rttVar = sample / 2
+	} else {
+		delta := c.rtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttVar += (delta - c.rttVar) / 4
+		c.rtt += (sample - c.rtt) / 8
+	}
+	c.rto = c.rtt + 4*c.rttVar
+	if c.rto < minRTO {
+		c.rto = minRTO
+	}
+}
+
+// ledbat grows the window while the delay the peer measured for our
+// packets stays below targetDelay above the lowest delay seen, and shrinks
+// it once queues build up.
+func (c *Conn) ledbat(delay uint32, acked int, now time.Time) {
+	if c.baseSince.IsZero() || now.Sub(c.baseSince) > baseDelayWindow {
+		c.baseDelay = delay
+		c.baseSince = now
+	} else if delay < c.baseDelay {
+		c.baseDelay = delay
+	}
+	queueing := time.Duration(delay-c.baseDelay) * time.Microsecond
+	offTarget := float64(targetDelay-queueing) / float64(targetDelay)
+	if offTarget < -1 {
+		offTarget = -1
+	}
+	windowFactor := float64(acked) / c.cwnd
+	if windowFactor > 1 {
+		windowFactor = 1
+	}
+	c.cwnd += maxCwndIncreasePerRT * offTarget * windowFactor
+	if c.cwnd < minWindow {
+		c.cwnd = minWindow
+	}
+	if c.cwnd > maxWindow {
+		c.cwnd = maxWindow
+	}
+}
+
+// checkTimeout resends every unacknowledged packet once the oldest one is
+// overdue, backing off the timeout each time.
+func (c *Conn) checkTimeout(now time.Time) {
+	c.mu.Lock()
+	if c.state == stateClosing && now.Sub(c.closedAt) > lingerTimeout {
+		c.mu.Unlock()
+		c.fail(errTimeout)
+		return
+	}
+	if (c.state != stateConnected && c.state != stateClosing) || len(c.unacked) == 0 || now.Sub(c.unacked[0].sentAt) < c.rto {
+		c.mu.Unlock()
+		return
+	}
+	c.retries++
+	if c.retries > maxRetries {
+		c.mu.Unlock()
+		c.fail(errTimeout)
+		return
+	}
+	c.cwnd = minWindow
+	c.rto *= 2
+	if c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+	for _, p := range c.unacked {
+		c.transmit(p)
+	}
+	c.mu.Unlock()
+}
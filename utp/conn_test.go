@@ -0,0 +1,104 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestSocket opens a socket on a local port until the test ends.
+func newTestSocket(t *testing.T) *Socket {
+	s, err := Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// connect dials b from a and returns both ends.
+func connect(t *testing.T, a, b *Socket) (dialed, accepted net.Conn) {
+	t.Helper()
+	type result struct {
+		c   net.Conn
+		err error
+	}
+	accepts := make(chan result, 1)
+	go func() {
+		c, err := b.Accept()
+		accepts <- result{c, err}
+	}()
+	dialed, err := a.DialTimeout(b.Addr().String(), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-accepts
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return dialed, r.c
+}
+
+// transfer writes data to w and checks that r reads back exactly that.
+func transfer(t *testing.T, w io.Writer, r io.Reader, data []byte) {
+	t.Helper()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := w.Write(data)
+		errs <- err
+	}()
+	got := make([]byte, len(data))
+	_, err := io.ReadFull(r, got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("data garbled on the way")
+	}
+}
+
+func TestBulkTransfer(t *testing.T) {
+	a, b := newTestSocket(t), newTestSocket(t)
+	dialed, accepted := connect(t, a, b)
+	defer dialed.Close()
+	defer accepted.Close()
+
+	data := make([]byte, 4<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	transfer(t, dialed, accepted, data)
+	// and back, a few bytes short of whole packets
+	transfer(t, accepted, dialed, data[:10*maxPayload-3])
+}
+
+func TestCloseSendsFin(t *testing.T) {
+	a, b := newTestSocket(t), newTestSocket(t)
+	dialed, accepted := connect(t, a, b)
+	defer accepted.Close()
+
+	_, err := dialed.Write([]byte("last words"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = dialed.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(accepted)
+	if err != nil {
+		t.Fatalf("got %v instead of EOF", err)
+	}
+	if string(got) != "last words" {
+		t.Errorf("read %q before EOF", got)
+	}
+	if _, err := dialed.Write([]byte("more")); err == nil {
+		t.Error("wrote to a closed connection")
+	}
+}
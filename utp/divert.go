@@ -0,0 +1,94 @@
+package utp
+
+import (
+	"net"
+	"sync"
+)
+
+// number of datagrams of a diverted protocol waiting to be read, more are
+// dropped
+const divertBacklog = 256
+
+type datagram struct {
+	data []byte
+	addr *net.UDPAddr
+}
+
+// PacketConn carries the datagrams of another protocol that shares the
+// socket with uTP, such as the DHT on the same port.
+type PacketConn struct {
+	s       *Socket
+	first   byte
+	packets chan datagram
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Divert hands datagrams starting with the byte first to the returned
+// PacketConn instead of treating them as uTP. No uTP packet starts with the
+// 'd' of a bencoded dictionary, so that is the one to use for the DHT.
+func (s *Socket) Divert(first byte) *PacketConn {
+	pc := &PacketConn{
+		s:       s,
+		first:   first,
+		packets: make(chan datagram, divertBacklog),
+		done:    make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.diverted[first] = pc
+	s.mu.Unlock()
+	return pc
+}
+
+func (s *Socket) diverter(first byte) *PacketConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.diverted[first]
+}
+
+func (pc *PacketConn) deliver(data []byte, addr *net.UDPAddr) {
+	select {
+	case pc.packets <- datagram{append([]byte(nil), data...), addr}:
+	default:
+	}
+}
+
+// ReadFrom waits for the next datagram.
+func (pc *PacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case d := <-pc.packets:
+		return copy(b, d.data), d.addr, nil
+	case <-pc.done:
+		return 0, nil, net.ErrClosed
+	case <-pc.s.done:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// WriteTo sends a datagram from the shared socket.
+func (pc *PacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	select {
+	case <-pc.done:
+		return 0, net.ErrClosed
+	default:
+	}
+	return pc.s.conn.WriteTo(b, addr)
+}
+
+func (pc *PacketConn) LocalAddr() net.Addr {
+	return pc.s.conn.LocalAddr()
+}
+
+// Close stops the diverting, the socket stays open for uTP.
+func (pc *PacketConn) Close() error {
+	pc.closeOnce.Do(func() {
+		close(pc.done)
+		pc.s.mu.Lock()
+		if pc.s.diverted[pc.first] == pc {
+			delete(pc.s.diverted, pc.first)
+		}
+		pc.s.mu.Unlock()
+	})
+	return nil
+}
@@ -0,0 +1,179 @@
+package utp
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyLink takes the data packets reaching a socket off it with Divert and
+// hands them on to their connections out of order, or not at all.
+type lossyLink struct {
+	s  *Socket
+	pc *PacketConn
+
+	mu sync.Mutex
+	// sent counts the transmissions of each sequence number
+	sent      map[uint16]int
+	dropped   int
+	reordered int
+}
+
+func newLossyLink(s *Socket) *lossyLink {
+	l := &lossyLink{s: s, pc: s.Divert(stData<<4 | version), sent: make(map[uint16]int)}
+	go l.run()
+	return l
+}
+
+// run lets packets through in groups of four, last first. A group is cut
+// short once no packet came for a moment.
+func (l *lossyLink) run() {
+	packets := make(chan datagram)
+	go func() {
+		defer close(packets)
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := l.pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			packets <- datagram{append([]byte(nil), buf[:n]...), addr.(*net.UDPAddr)}
+		}
+	}()
+
+	var held []datagram
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		select {
+		case d, ok := <-packets:
+			if !ok {
+				return
+			}
+			held = append(held, d)
+			if len(held) < 4 {
+				timer.Reset(10 * time.Millisecond)
+				continue
+			}
+		case <-timer.C:
+		}
+		l.flush(held)
+		held = nil
+	}
+}
+
+// flush delivers held in reverse, dropping the first transmission of every
+// seventh packet.
+func (l *lossyLink) flush(held []datagram) {
+	for i := len(held) - 1; i >= 0; i-- {
+		h, payload, err := parsePacket(held[i].data)
+		if err != nil {
+			continue
+		}
+		l.mu.Lock()
+		l.sent[h.seq]++
+		drop := h.seq%7 == 0 && l.sent[h.seq] == 1
+		if drop {
+			l.dropped++
+		} else if i > 0 {
+			l.reordered++
+		}
+		l.mu.Unlock()
+		if drop {
+			continue
+		}
+
+		l.s.mu.Lock()
+		c := l.s.conns[connKey{held[i].addr.String(), h.connID}]
+		l.s.mu.Unlock()
+		if c != nil {
+			c.handle(h, payload, time.Now())
+		}
+	}
+}
+
+func TestReorderAndLoss(t *testing.T) {
+	a, b := newTestSocket(t), newTestSocket(t)
+	link := newLossyLink(b)
+	dialed, accepted := connect(t, a, b)
+	defer dialed.Close()
+	defer accepted.Close()
+
+	data := make([]byte, 100*maxPayload)
+	rand.New(rand.NewSource(2)).Read(data)
+	accepted.SetReadDeadline(time.Now().Add(30 * time.Second))
+	transfer(t, dialed, accepted, data)
+
+	link.mu.Lock()
+	defer link.mu.Unlock()
+	if link.dropped == 0 || link.reordered == 0 {
+		t.Errorf("%d packets dropped and %d reordered, want some of each", link.dropped, link.reordered)
+	}
+}
+
+func TestDivert(t *testing.T) {
+	s := newTestSocket(t)
+	pc := s.Divert('d')
+	raw, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	_, err = raw.WriteToUDP([]byte("d1:ad2:id20:...e"), s.Addr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 100)
+	n, addr, err := pc.ReadFrom(buf)
+	if err != nil || string(buf[:n]) != "d1:ad2:id20:...e" || addr.String() != raw.LocalAddr().String() {
+		t.Fatalf("read %q from %v, %v", buf[:n], addr, err)
+	}
+	_, err = pc.WriteTo([]byte("d1:rde"), raw.LocalAddr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err = raw.ReadFromUDP(buf)
+	if err != nil || string(buf[:n]) != "d1:rde" {
+		t.Fatalf("answer %q, %v", buf[:n], err)
+	}
+
+	// once closed the socket is uTP only again
+	pc.Close()
+	if _, _, err := pc.ReadFrom(buf); err == nil {
+		t.Error("read from a closed PacketConn")
+	}
+	if s.diverter('d') != nil {
+		t.Error("still diverting after Close")
+	}
+}
+
+func TestCloseLingers(t *testing.T) {
+	a, b := newTestSocket(t), newTestSocket(t)
+	newLossyLink(b)
+	dialed, accepted := connect(t, a, b)
+	defer accepted.Close()
+
+	// closed with most of it in flight, and some of that lost
+	data := make([]byte, 50*maxPayload)
+	rand.New(rand.NewSource(3)).Read(data)
+	dialed.SetWriteDeadline(time.Now().Add(30 * time.Second))
+	go func() {
+		dialed.Write(data)
+		dialed.Close()
+	}()
+
+	accepted.SetReadDeadline(time.Now().Add(30 * time.Second))
+	got, err := io.ReadAll(accepted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Errorf("read %d bytes before EOF, want the %d written", len(got), len(data))
+	}
+}
@@ -0,0 +1,84 @@
+package utp
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// packet types
+const (
+	stData  = 0
+	stFin   = 1
+	stState = 2
+	stReset = 3
+	stSyn   = 4
+)
+
+const (
+	version    = 1
+	headerSize = 20
+)
+
+type header struct {
+	typ    uint8
+	connID uint16
+	// timestamp is when the packet was sent, timestampDiff the delay the
+	// sender last measured for our packets, both in microseconds
+	timestamp     uint32
+	timestampDiff uint32
+	wnd           uint32
+	seq           uint16
+	ack           uint16
+}
+
+func (h *header) marshal(payload []byte) []byte {
+	buf := make([]byte, headerSize+len(payload))
+	buf[0] = h.typ<<4 | version
+	// no extensions
+	buf[1] = 0
+	binary.BigEndian.PutUint16(buf[2:], h.connID)
+	binary.BigEndian.PutUint32(buf[4:], h.timestamp)
+	binary.BigEndian.PutUint32(buf[8:], h.timestampDiff)
+	binary.BigEndian.PutUint32(buf[12:], h.wnd)
+	binary.BigEndian.PutUint16(buf[16:], h.seq)
+	binary.BigEndian.PutUint16(buf[18:], h.ack)
+	copy(buf[headerSize:], payload)
+	return buf
+}
+
+// parsePacket splits a packet into its header and payload, skipping
+// extension headers such as selective acks.
+func parsePacket(buf []byte) (header, []byte, error) {
+	if len(buf) < headerSize {
+		return header{}, nil, fmt.Errorf("packet of %d bytes", len(buf))
+	}
+	h := header{
+		typ:           buf[0] >> 4,
+		connID:        binary.BigEndian.Uint16(buf[2:]),
+		timestamp:     binary.BigEndian.Uint32(buf[4:]),
+		timestampDiff: binary.BigEndian.Uint32(buf[8:]),
+		wnd:           binary.BigEndian.Uint32(buf[12:]),
+		seq:           binary.BigEndian.Uint16(buf[16:]),
+		ack:           binary.BigEndian.Uint16(buf[18:]),
+	}
+	if buf[0]&0x0f != version || h.typ > stSyn {
+		return header{}, nil, fmt.Errorf("not a uTP packet")
+	}
+
+	ext := buf[1]
+	rest := buf[headerSize:]
+	for ext != 0 {
+		if len(rest) < 2 || len(rest) < 2+int(rest[1]) {
+			return header{}, nil, fmt.Errorf("truncated extension header")
+		}
+		ext = rest[0]
+		rest = rest[2+int(rest[1]):]
+	}
+	return h, rest, nil
+}
+
+// seqLess reports whether sequence number a comes before b, allowing for
+// wrap around.
+func seqLess(a, b uint16) bool {
+	return int16(a-b) < 0
+}
@@ -0,0 +1,267 @@
+// Package utp implements the Micro Transport Protocol (BEP 29): reliable,
+// ordered streams over UDP whose LEDBAT congestion control backs off as soon
+// as the link starts queueing, leaving room for other traffic.
+package utp
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// how often connections are checked for lost packets
+const tickInterval = 50 * time.Millisecond
+
+// a SYN is sent again after this long without an answer
+const synInterval = time.Second
+
+// number of inbound connections waiting for Accept
+const acceptBacklog = 32
+
+// size we ask the kernel to make the socket's buffers
+const socketBufferSize = 4 << 20
+
+type connKey struct {
+	addr string
+	id   uint16
+}
+
+// Socket is a UDP socket shared by all uTP connections to and from one
+// port. It is a net.Listener for inbound connections.
+type Socket struct {
+	conn *net.UDPConn
+
+	mu     sync.Mutex
+	conns  map[connKey]*Conn
+	accept chan *Conn
+	// diverted are the other protocols on the socket by first byte
+	diverted map[byte]*PacketConn
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// Listen opens a socket on the UDP address addr, e.g. ":6881".
+func Listen(addr string) (*Socket, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	// room for the bursts of many connections
+	conn.SetReadBuffer(socketBufferSize)
+	conn.SetWriteBuffer(socketBufferSize)
+	s := &Socket{
+		conn:     conn,
+		conns:    make(map[connKey]*Conn),
+		accept:   make(chan *Conn, acceptBacklog),
+		diverted: make(map[byte]*PacketConn),
+		done:     make(chan struct{}),
+	}
+	go s.serve()
+	go s.tick()
+	return s, nil
+}
+
+func (s *Socket) Addr() net.Addr {
+	return s.conn.LocalAddr()
+}
+
+// Accept waits for the next inbound connection.
+func (s *Socket) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close closes the socket and with it every connection.
+func (s *Socket) Close() error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.done)
+		err = s.conn.Close()
+
+		s.mu.Lock()
+		conns := make([]*Conn, 0, len(s.conns))
+		for _, c := range s.conns {
+			conns = append(conns, c)
+		}
+		s.mu.Unlock()
+		for _, c := range conns {
+			c.fail(net.ErrClosed)
+		}
+	})
+	return err
+}
+
+// DialTimeout connects to a uTP peer at addr, a host:port.
+func (s *Socket) DialTimeout(addr string, timeout time.Duration) (*Conn, error) {
+	raddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// the connection id the peer sends to is one above the one we send to
+	s.mu.Lock()
+	var c *Conn
+	for {
+		id := uint16(rand.Intn(1 << 16))
+		_, taken := s.conns[connKey{raddr.String(), id}]
+		_, takenNext := s.conns[connKey{raddr.String(), id + 1}]
+		if !taken && !takenNext {
+			c = newConn(s, raddr, id, id+1)
+			break
+		}
+	}
+	c.state = stateSynSent
+	c.seqNr = 1
+	s.conns[connKey{raddr.String(), c.recvID}] = c
+	s.mu.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		c.sendSyn()
+		c.mu.Unlock()
+
+		wait := synInterval
+		if time.Until(deadline) < wait {
+			wait = time.Until(deadline)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-c.established:
+			timer.Stop()
+			return c, nil
+		case <-timer.C:
+		case <-s.done:
+			timer.Stop()
+			return nil, net.ErrClosed
+		}
+	}
+	c.fail(fmt.Errorf("uTP connection to %s timed out", addr))
+	return nil, fmt.Errorf("uTP connection to %s timed out", addr)
+}
+
+func (s *Socket) remove(c *Conn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := connKey{c.raddr.String(), c.recvID}
+	if s.conns[key] == c {
+		delete(s.conns, key)
+	}
+}
+
+func (s *Socket) send(addr *net.UDPAddr, h *header, payload []byte) {
+	s.conn.WriteToUDP(h.marshal(payload), addr)
+}
+
+func (s *Socket) serve() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-s.done:
+				return
+			default:
+				continue
+			}
+		}
+		if n > 0 {
+			if pc := s.diverter(buf[0]); pc != nil {
+				pc.deliver(buf[:n], addr)
+				continue
+			}
+		}
+		h, payload, err := parsePacket(buf[:n])
+		if err != nil {
+			continue
+		}
+		now := time.Now()
+
+		if h.typ == stSyn {
+			s.handleSyn(h, addr, now)
+			continue
+		}
+		s.mu.Lock()
+		c := s.conns[connKey{addr.String(), h.connID}]
+		s.mu.Unlock()
+		if c == nil {
+			if h.typ != stReset {
+				s.send(addr, &header{typ: stReset, connID: h.connID, ack: h.seq}, nil)
+			}
+			continue
+		}
+		c.handle(h, append([]byte(nil), payload...), now)
+	}
+}
+
+func (s *Socket) handleSyn(h header, addr *net.UDPAddr, now time.Time) {
+	key := connKey{addr.String(), h.connID + 1}
+	s.mu.Lock()
+	c, ok := s.conns[key]
+	if !ok {
+		c = newConn(s, addr, h.connID+1, h.connID)
+		c.state = stateConnected
+		c.seqNr = uint16(rand.Intn(1 << 16))
+		c.ackNr = h.seq
+		c.lastAck = c.seqNr - 1
+		s.conns[key] = c
+	}
+	s.mu.Unlock()
+
+	c.mu.Lock()
+	c.lastRecv = now
+	c.replyMicro = micros(now) - h.timestamp
+	c.peerWnd = h.wnd
+	// a repeated SYN means our answer got lost
+	c.sendState()
+	c.mu.Unlock()
+	if ok {
+		return
+	}
+
+	select {
+	case s.accept <- c:
+	default:
+		c.reset()
+	}
+}
+
+// tick retransmits lost packets of every connection.
+func (s *Socket) tick() {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			s.mu.Lock()
+			conns := make([]*Conn, 0, len(s.conns))
+			for _, c := range s.conns {
+				conns = append(conns, c)
+			}
+			s.mu.Unlock()
+			for _, c := range conns {
+				c.checkTimeout(now)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+var epoch = time.Now()
+
+// micros returns a timestamp in microseconds, as carried by packets.
+func micros(t time.Time) uint32 {
+	return uint32(t.Sub(epoch).Microseconds())
+}
@@ -0,0 +1,42 @@
+package utp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAcceptBacklogFull(t *testing.T) {
+	s := newTestSocket(t)
+	raw, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer raw.Close()
+
+	// nobody accepts, so the connection after the backlog is refused
+	buf := make([]byte, 1500)
+	for id := uint16(0); id <= acceptBacklog; id++ {
+		syn := (&header{typ: stSyn, connID: 2 * id, seq: 1}).marshal(nil)
+		_, err := raw.WriteToUDP(syn, s.Addr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []uint8{stState}
+		if id == acceptBacklog {
+			want = append(want, stReset)
+		}
+		raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for _, typ := range want {
+			n, _, err := raw.ReadFromUDP(buf)
+			if err != nil {
+				t.Fatalf("SYN %d: %v", id, err)
+			}
+			h, _, err := parsePacket(buf[:n])
+			if err != nil || h.connID != 2*id || h.typ != typ {
+				t.Fatalf("SYN %d answered with type %d for connection %d, want type %d", id, h.typ, h.connID, typ)
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aryanA101a/villi/torrentfile"
+	"github.com/aryanA101a/villi/utils"
+)
+
+// exit codes of `villi verify`
+const (
+	verifyComplete   = 0
+	verifyIncomplete = 1
+	verifyError      = 2
+)
+
+func runVerify(args []string) int {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	quietFlag := fs.Bool("q", false, "Only print the overall result")
+	fs.BoolVar(quietFlag, "quiet", false, "Only print the overall result")
+	fs.Usage = func() {
+		fmt.Print(verifyUsageText)
+	}
+	args = parseArgs(fs, args)
+	if len(args) != 2 {
+		fs.Usage()
+		return verifyError
+	}
+
+	tf, err := torrentfile.Open(args[0], args[1])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, utils.BoldRed(err))
+		return verifyError
+	}
+
+	report, err := tf.Verify(func(done, total int) {
+		if !*quietFlag {
+			fmt.Fprintf(os.Stderr, "\rchecking piece %d/%d", done, total)
+		}
+	})
+	if !*quietFlag {
+		fmt.Fprintln(os.Stderr)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, utils.BoldRed(err))
+		return verifyError
+	}
+
+	if !*quietFlag {
+		for _, f := range report.Files {
+			fmt.Printf("%7.2f%%  %8s  %s\n", f.Ratio()*100, utils.ConvertToHumanReadable(f.Length), f.Path)
+		}
+		fmt.Println()
+	}
+	fmt.Println(utils.Bold(fmt.Sprintf("%s: %.2f%% complete (%d/%d pieces)",
+		tf.Name, report.Ratio()*100, len(tf.PieceHashes)-len(report.BadPieces), len(tf.PieceHashes))))
+
+	if report.Complete() {
+		return verifyComplete
+	}
+	fmt.Println(utils.BoldRed("bad pieces: ", formatPieceRanges(report.BadPieces)))
+	return verifyIncomplete
+}
+
+// formatPieceRanges turns a sorted list of piece indexes into "1-4, 7, 9-10".
+func formatPieceRanges(indexes []int) string {
+	var ranges []string
+	for i := 0; i < len(indexes); {
+		j := i
+		for j+1 < len(indexes) && indexes[j+1] == indexes[j]+1 {
+			j++
+		}
+		if i == j {
+			ranges = append(ranges, strconv.Itoa(indexes[i]))
+		} else {
+			ranges = append(ranges, strconv.Itoa(indexes[i])+"-"+strconv.Itoa(indexes[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(ranges, ", ")
+}
+
+var verifyUsageText = `Usage: villi verify [options] torrent_file data_directory
+
+Checks the data in data_directory against the piece hashes of torrent_file
+without downloading anything.
+
+Options:
+  -q, --quiet      Only print the overall result
+
+Exit status:
+  0  all pieces are present and correct
+  1  some pieces are missing or corrupt
+  2  the torrent or the data could not be read
+`